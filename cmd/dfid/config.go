@@ -31,6 +31,10 @@ import (
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
+
+	dfi "github.com/dfindex/dfi"
+	dht "github.com/dfindex/dfi/dht"
+	proto "github.com/dfindex/dfi/proto"
 )
 
 func SetupConfig() {
@@ -58,9 +62,17 @@ func SetupConfig() {
 		"http": "127.0.0.1:8080",
 	})
 
+	// The identity, peers.db, collections and mirrors all live here.
+	viper.SetDefault("data", map[string]string{
+		"path": dfi.DefaultDataDir,
+	})
+
 	// someday support postgresql, etc. Hence the map :)
+	// The memory driver keeps nothing between runs. An empty path puts posts.db
+	// in the data directory.
 	viper.SetDefault("database", map[string]string{
-		"path": "./data/posts.db",
+		"driver": "sqlite",
+		"path":   "",
 	})
 
 	viper.SetDefault("tor", map[string]interface{}{
@@ -73,7 +85,14 @@ func SetupConfig() {
 	viper.SetDefault("socks", map[string]interface{}{"enabled": true, "port": 10050})
 
 	viper.SetDefault("net", map[string]interface{}{
-		"maxPeers": 100,
+		"maxPeers":          100,
+		"timeout":           proto.DefaultTimeout.String(),
+		"requireEncryption": false,
+	})
+
+	viper.SetDefault("dht", map[string]interface{}{
+		"entryTTL": dht.DefaultEntryTTL.String(),
+		"work":     0,
 	})
 
 	viper.WatchConfig()
@@ -29,13 +29,19 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 
 	"strings"
+	"time"
 
 	dfi "github.com/dfindex/dfi"
 	data "github.com/dfindex/dfi/data"
+	sqlite "github.com/dfindex/dfi/data/sqlite"
 	dht "github.com/dfindex/dfi/dht"
+	proto "github.com/dfindex/dfi/proto"
+	"github.com/dfindex/dfi/util"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 
 	log "github.com/sirupsen/logrus"
@@ -49,6 +55,8 @@ var (
 
 func SetupLocalPeer(addr string) *dfi.LocalPeer {
 	var lp dfi.LocalPeer
+	lp.DataDir = viper.GetString("data.path")
+	lp.EntryTTL = viper.GetDuration("dht.entryTTL")
 
 	if lp.ReadKey() != nil {
 		lp.GenerateKey()
@@ -59,6 +67,86 @@ func SetupLocalPeer(addr string) *dfi.LocalPeer {
 	return &lp
 }
 
+// Where posts.db is kept, the data directory unless configured otherwise.
+func databasePath() string {
+	if path := viper.GetString("database.path"); path != "" {
+		return path
+	}
+
+	return filepath.Join(viper.GetString("data.path"), "posts.db")
+}
+
+// Refuses to run on databases from a newer version of dfi, migrations only go
+// up so there is no way of knowing what has changed.
+func checkSchemas() error {
+	err := util.CheckSchema(filepath.Join(viper.GetString("data.path"), "peers.db"), dht.Migrations)
+
+	if err != nil {
+		return err
+	}
+
+	err = util.CheckSchema(databasePath(), sqlite.Migrations)
+
+	if err != nil {
+		return err
+	}
+
+	mirrors, err := filepath.Glob(filepath.Join(viper.GetString("data.path"), "*", "posts.db"))
+
+	if err != nil {
+		return err
+	}
+
+	for _, i := range mirrors {
+		err = util.CheckSchema(i, sqlite.Migrations)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Request timeouts, net.timeouts overrides net.timeout by message header.
+func setupTimeouts() error {
+	proto.DefaultTimeout = viper.GetDuration("net.timeout")
+
+	for header, timeout := range viper.GetStringMapString("net.timeouts") {
+		d, err := time.ParseDuration(timeout)
+
+		if err != nil {
+			return fmt.Errorf("Bad timeout for %s: %s", header, err)
+		}
+
+		proto.Timeouts[header] = d
+	}
+
+	return nil
+}
+
+// Per peer request limits, net.limits overrides them by message header.
+func setupLimits() error {
+	for header, v := range viper.GetStringMap("net.limits") {
+		limit := cast.ToStringMap(v)
+		rate, err := time.ParseDuration(cast.ToString(limit["rate"]))
+
+		if err != nil {
+			return fmt.Errorf("Bad rate limit for %s: %s", header, err)
+		}
+
+		burst := cast.ToInt(limit["burst"])
+
+		if rate <= 0 || burst < 1 {
+			return fmt.Errorf("Bad rate limit for %s, rate and burst must be positive", header)
+		}
+
+		proto.RateLimits[header] = util.Limit{Rate: rate, Burst: burst}
+	}
+
+	return nil
+}
+
 func main() {
 
 	log.SetLevel(log.DebugLevel)
@@ -67,10 +155,31 @@ func main() {
 	formatter.TimestampFormat = "15:04:05"
 	log.SetFormatter(formatter)
 
-	os.Mkdir("./data", 0777)
-
 	SetupConfig()
 
+	dht.RequiredWork = viper.GetInt("dht.work")
+	proto.RequireEncryption = viper.GetBool("net.requireEncryption")
+
+	err := setupTimeouts()
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	err = setupLimits()
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	os.MkdirAll(viper.GetString("data.path"), 0777)
+
+	err = checkSchemas()
+
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	addr := viper.GetString("bind.dfi")
 	fmt.Println(addr)
 
@@ -121,18 +230,24 @@ func main() {
 	lp.SignEntry()
 	lp.SaveEntry()
 
-	err := lp.SaveEntry()
+	err = lp.SaveEntry()
 
 	if err != nil {
 		panic(err)
 	}
 
-	lp.Database = data.NewDatabase(viper.GetString("database.path"))
+	if viper.GetString("database.driver") == "memory" {
+		lp.Database = data.NewMemoryStore()
+	} else {
+		db := sqlite.NewDatabase(databasePath())
 
-	err = lp.Database.Connect()
+		err = db.Connect()
 
-	if err != nil {
-		log.Fatal(err.Error())
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		lp.Database = db
 	}
 
 	lp.Listen(viper.GetString("bind.dfi"))
@@ -72,6 +72,10 @@ type CommandPeerRecent struct {
 type CommandPeerPopular CommandPeerRecent
 type CommandMirror CommandPeer
 type CommandMirrorProgress CommandPeer
+type CommandPeerPiece struct {
+	CommandPeer
+	Id int `json:"id"`
+}
 type CommandPeerIndex struct {
 	CommandPeer
 	Since int `json:"since"`
@@ -85,6 +89,32 @@ type CommandAddPost struct {
 	data.Post
 	Index bool
 }
+type CommandImport struct {
+	Magnets []string `json:"magnets"`
+	// .torrent files and CSV/JSONL dumps, see data.ReadImport
+	Files []ImportFile `json:"-"`
+	Index bool         `json:"index"`
+}
+type ImportFile struct {
+	Name string
+	Data io.Reader
+}
+type CommandExport struct {
+	// Empty for our own index
+	CommandPeer
+	// data.ExportJSONL, data.ExportCSV or SnapshotFormat
+	Format string    `json:"format"`
+	Writer io.Writer `json:"-"`
+}
+type CommandImportSnapshot struct {
+	Data io.Reader `json:"-"`
+}
+type CommandDeletePost struct {
+	Id int `json:"id"`
+}
+type CommandAmendPost struct {
+	data.Post
+}
 type CommandSelfIndex struct {
 	Since int `json:"since"`
 }
@@ -99,6 +129,13 @@ type CommandSelfSearch struct {
 	CommandSuggest
 	Page int `json:"page"`
 }
+type CommandSearch struct {
+	CommandSelfSearch
+	// Also ask connected peers we have not mirrored
+	Peers bool `json:"peers"`
+	// In milliseconds, results that arrive later are dropped
+	Timeout int `json:"timeout"`
+}
 type CommandSelfRecent struct {
 	Page int `json:"page"`
 }
@@ -112,6 +149,7 @@ type CommandSaveCollection interface{}
 type CommandRebuildCollection interface{}
 type CommandPeers interface{}
 type CommandSaveRoutingTable interface{}
+type CommandCollectGarbage interface{}
 
 // Used for setting values in the localpeer entry
 type CommandLocalSet struct {
@@ -137,6 +175,22 @@ type CommandNetMap struct {
 	Address string
 }
 
+type CommandReputation interface{}
+type CommandBans interface{}
+
+type CommandBan struct {
+	Address string `json:"address"`
+	Public  string `json:"public"`
+	Reason  string `json:"reason"`
+	// seconds, zero for forever
+	Duration int64 `json:"duration"`
+}
+
+type CommandUnban struct {
+	Address string `json:"address"`
+	Public  string `json:"public"`
+}
+
 // Command output types
 
 type CommandResult struct {
@@ -25,6 +25,7 @@
 package dfi
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -36,12 +37,18 @@ import (
 
 	"github.com/dfindex/dfi/data"
 	"github.com/dfindex/dfi/dht"
-	"github.com/dfindex/dfi/util"
+	"github.com/dfindex/dfi/proto"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/streamrail/concurrent-map"
 )
 
+// How long a federated search waits for sources, by default and at most.
+const (
+	DefaultSearchTimeout = time.Second * 5
+	MaxSearchTimeout     = time.Second * 30
+)
+
 // Command server type
 
 type CommandServer struct {
@@ -77,7 +84,10 @@ func (cs *CommandServer) Ping(p CommandPing) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	time, err := peer.Ping(time.Second * 10)
+	ctx, cancel := context.WithTimeout(context.Background(), proto.DefaultTimeout)
+	defer cancel()
+
+	time, err := peer.Ping(ctx)
 
 	return CommandResult{err == nil, time.Seconds(), err}
 }
@@ -106,7 +116,7 @@ func (cs *CommandServer) Announce(a CommandAnnounce) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	err = peer.Announce(cs.LocalPeer)
+	err = peer.Announce(context.Background(), cs.LocalPeer)
 
 	return CommandResult{err == nil, nil, err}
 }
@@ -132,7 +142,7 @@ func (cs *CommandServer) RSearch(rs CommandRSearch) CommandResult {
 		}
 	}
 
-	posts, err := peer.Search(rs.Query, rs.Page)
+	posts, err := peer.Search(context.Background(), rs.Query, rs.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
@@ -147,7 +157,7 @@ func (cs *CommandServer) PeerSearch(ps CommandPeerSearch) CommandResult {
 
 	db, _ := cs.LocalPeer.Databases.Get(ps.CommandPeer.Address)
 
-	posts, err := cs.LocalPeer.SearchProvider.Search(ps.CommandPeer.Address, db.(*data.Database), ps.Query, ps.Page)
+	posts, err := cs.LocalPeer.SearchProvider.Search(ps.CommandPeer.Address, db.(data.PostStore), ps.Query, ps.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
@@ -200,7 +210,7 @@ func (cs *CommandServer) PeerRecent(pr CommandPeerRecent) CommandResult {
 		}
 	}
 
-	posts, err = peer.Recent(pr.Page)
+	posts, err = peer.Recent(context.Background(), pr.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
@@ -231,7 +241,7 @@ func (cs *CommandServer) PeerPopular(pp CommandPeerPopular) CommandResult {
 		}
 	}
 
-	posts, err = peer.Popular(pp.Page)
+	posts, err = peer.Popular(context.Background(), pp.Page)
 
 	return CommandResult{err == nil, posts, err}
 }
@@ -268,17 +278,17 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 				}
 
 				// balances load amongst all seeds
-				util.ShuffleBytes(entry.Seeds)
+				dht.ShuffleSeeds(entry.Seeds)
 
 				// Keep picking seeds until one connects
 				for _, i := range entry.Seeds {
-					addr := &dht.Address{Raw: i}
+					addr := i.Seed
 
 					if addr.Equals(cs.LocalPeer.Address()) {
 						continue
 					}
 
-					peer, _, err = cs.LocalPeer.ConnectPeer(*addr)
+					peer, _, err = cs.LocalPeer.ConnectPeer(addr)
 
 					if err != nil || peer == nil {
 						continue
@@ -288,6 +298,7 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 					// peers act a little differently when seeding for another
 					peer.seed = true
 					peer.seedFor = entry
+					break
 				}
 
 			} else {
@@ -300,17 +311,38 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 		return CommandResult{false, nil, PeerUnreachable}
 	}
 
-	// TODO: make this configurable
-	d := fmt.Sprintf("./data/%s", mirroring.Address.StringOr(""))
+	db, err := cs.LocalPeer.MirrorDatabase(mirroring.Address)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	// everything else we can reach is used as an extra source of pieces
+	seeds := make([]*Peer, 0, len(mirroring.Seeds))
+
+	for _, i := range mirroring.Seeds {
+		addr := i.Seed
+
+		if addr.Equals(cs.LocalPeer.Address()) || addr.Equals(peer.Address()) {
+			continue
+		}
+
+		seed := cs.LocalPeer.GetPeer(addr)
+
+		if seed == nil {
+			seed, _, err = cs.LocalPeer.ConnectPeer(addr)
 
-	os.Mkdir(d, 0777)
+			if err != nil || seed == nil {
+				continue
+			}
+		}
 
-	db := data.NewDatabase(fmt.Sprintf("%s/posts.db", d))
-	db.Connect()
+		seeds = append(seeds, seed)
+	}
 
-	cs.LocalPeer.Databases.Set(peer.Address().StringOr(""), db)
+	log.WithField("seeds", len(seeds)).Info("Mirroring with seeds")
 
-	progressChan := make(chan int)
+	progressChan := make(chan PieceProgress)
 
 	go func() {
 		for i := range progressChan {
@@ -318,7 +350,16 @@ func (cs *CommandServer) Mirror(cm CommandMirror) CommandResult {
 		}
 	}()
 
-	err = peer.Mirror(db, *cs.LocalPeer.Address(), progressChan)
+	err = peer.Mirror(context.Background(), db, *cs.LocalPeer.Address(), seeds, progressChan)
+
+	if err == ErrMirrorMismatch {
+		log.WithField("peer", cm.Address).Warn("Discarding mirror")
+
+		if derr := cs.LocalPeer.DiscardMirror(mirroring.Address); derr != nil {
+			log.Error(derr.Error())
+		}
+	}
+
 	if err != nil {
 		return CommandResult{false, nil, err}
 	}
@@ -333,7 +374,33 @@ func (cs *CommandServer) GetMirrorProgress(cmp CommandMirrorProgress) CommandRes
 
 	progress, _ := cs.MirrorProgress.Get(cmp.Address)
 
-	return CommandResult{true, progress.(int), nil}
+	return CommandResult{true, progress.(PieceProgress), nil}
+}
+
+// Fetch a single piece from a peer, verified against the collection hash in
+// it's entry.
+func (cs *CommandServer) PeerPiece(cp CommandPeerPiece) CommandResult {
+	log.Info("Command: Peer Piece request")
+
+	address, err := dht.DecodeAddress(cp.Address)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	peer, entry, err := cs.LocalPeer.ConnectPeer(address)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	piece, err := peer.Piece(context.Background(), *entry, cp.Id)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	return CommandResult{true, piece.Posts, nil}
 }
 
 func (cs *CommandServer) PeerIndex(ci CommandPeerIndex) CommandResult {
@@ -346,7 +413,7 @@ func (cs *CommandServer) PeerIndex(ci CommandPeerIndex) CommandResult {
 	}
 
 	db, _ := cs.LocalPeer.Databases.Get(ci.CommandPeer.Address)
-	err = db.(*data.Database).GenerateFts(int64(ci.Since))
+	err = db.(data.PostStore).GenerateFts(int64(ci.Since))
 
 	return CommandResult{err == nil, nil, err}
 }
@@ -379,6 +446,102 @@ func (cs *CommandServer) AddPost(ap CommandAddPost) CommandResult {
 
 	return CommandResult{true, id, nil}
 }
+func (cs *CommandServer) Import(ci CommandImport) CommandResult {
+	log.Info("Command: Import request")
+
+	importer := cs.LocalPeer.NewImporter()
+
+	for _, i := range ci.Magnets {
+		post, err := data.ParseMagnet(i)
+
+		if err != nil {
+			return CommandResult{false, nil, err}
+		}
+
+		err = importer.Add(post)
+
+		if err != nil {
+			return CommandResult{false, nil, err}
+		}
+	}
+
+	for _, i := range ci.Files {
+		err := data.ReadImport(i.Name, i.Data, importer.Add)
+
+		if err != nil {
+			// whatever was read before the error is still added
+			importer.Close(ci.Index)
+			return CommandResult{false, nil, fmt.Errorf("%s: %s", i.Name, err)}
+		}
+	}
+
+	result, err := importer.Close(ci.Index)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	return CommandResult{true, result, nil}
+}
+
+// Writes an index to ce.Writer. Nothing is written if the format or index is
+// not valid.
+func (cs *CommandServer) Export(ce CommandExport) CommandResult {
+	log.Info("Command: Export request")
+
+	address := *cs.LocalPeer.Address()
+
+	if ce.Address != "" {
+		var err error
+		address, err = dht.DecodeAddress(ce.Address)
+
+		if err != nil {
+			return CommandResult{false, nil, err}
+		}
+	}
+
+	db, _, err := cs.LocalPeer.Index(address)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	switch ce.Format {
+	case SnapshotFormat:
+		err = cs.LocalPeer.ExportSnapshot(address, ce.Writer)
+	case data.ExportJSONL, data.ExportCSV:
+		err = data.WriteExport(ce.Format, db, ce.Writer)
+	default:
+		return CommandResult{false, nil, errors.New("Unknown export format")}
+	}
+
+	return CommandResult{err == nil, nil, err}
+}
+func (cs *CommandServer) ImportSnapshot(ci CommandImportSnapshot) CommandResult {
+	log.Info("Command: Import Snapshot request")
+
+	entry, err := cs.LocalPeer.ImportSnapshot(ci.Data)
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	return CommandResult{true, entry.Address.StringOr(""), nil}
+}
+func (cs *CommandServer) DeletePost(dp CommandDeletePost) CommandResult {
+	log.Info("Command: Delete Post request")
+
+	err := cs.LocalPeer.DeletePost(dp.Id)
+
+	return CommandResult{err == nil, nil, err}
+}
+func (cs *CommandServer) AmendPost(ap CommandAmendPost) CommandResult {
+	log.Info("Command: Amend Post request")
+
+	err := cs.LocalPeer.AmendPost(ap.Id, ap.Post)
+
+	return CommandResult{err == nil, nil, err}
+}
 func (cs *CommandServer) SelfIndex(ci CommandSelfIndex) CommandResult {
 	log.Info("Command: FTS Index request")
 
@@ -425,9 +588,27 @@ func (cs *CommandServer) Bootstrap(cb CommandBootstrap) CommandResult {
 		return CommandResult{false, nil, err}
 	}
 
-	err = peer.Bootstrap(cs.LocalPeer.DHT)
+	err = peer.Bootstrap(context.Background(), cs.LocalPeer.DHT)
 
-	return CommandResult{err == nil, nil, err}
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	// looking ourselves up fills the routing table with our neighbours, and
+	// lets them know about us
+	found, err := cs.LocalPeer.FindNode(*cs.LocalPeer.Address())
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	for _, i := range found {
+		cs.LocalPeer.DHT.Insert(*i)
+	}
+
+	log.WithField("found", len(found)).Info("Bootstrap lookup complete")
+
+	return CommandResult{true, nil, nil}
 }
 func (cs *CommandServer) SelfSuggest(css CommandSuggest) CommandResult {
 	completions, err := cs.LocalPeer.SearchProvider.Suggest(cs.LocalPeer.Database, css.Query)
@@ -442,10 +623,96 @@ func (cs *CommandServer) PeerSuggest(css CommandPeerSearch) CommandResult {
 
 	db, _ := cs.LocalPeer.Databases.Get(css.Address)
 
-	completions, err := cs.LocalPeer.SearchProvider.Suggest(db.(*data.Database), css.Query)
+	completions, err := cs.LocalPeer.SearchProvider.Suggest(db.(data.PostStore), css.Query)
 
 	return CommandResult{err == nil, completions, err}
 }
+
+// Searches our own database, every mirror, and optionally connected peers all at
+// once. Results are merged by infohash, anything that has not arrived by the
+// deadline is left out.
+func (cs *CommandServer) Search(s CommandSearch) CommandResult {
+	log.Info("Command: Federated Search request")
+
+	timeout := DefaultSearchTimeout
+	if s.Timeout > 0 {
+		timeout = time.Duration(s.Timeout) * time.Millisecond
+	}
+
+	if timeout > MaxSearchTimeout {
+		timeout = MaxSearchTimeout
+	}
+
+	// sources still searching once this is done are cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	queries := make([]func() (*data.SearchResult, error), 0)
+
+	local := func(source string, db data.PostStore) func() (*data.SearchResult, error) {
+		return func() (*data.SearchResult, error) {
+			res, err := cs.LocalPeer.SearchProvider.Search(source, db, s.Query, s.Page)
+			return &res, err
+		}
+	}
+
+	queries = append(queries, local(cs.LocalPeer.Address().StringOr(""), cs.LocalPeer.Database))
+
+	// mirrors are keyed by the address of the peer they are a copy of
+	for address, db := range cs.LocalPeer.Databases.Items() {
+		queries = append(queries, local(address, db.(data.PostStore)))
+	}
+
+	if s.Peers {
+		for address, peer := range cs.LocalPeer.Peers() {
+			// already searched locally
+			if cs.LocalPeer.Databases.Has(address) {
+				continue
+			}
+
+			p := peer
+			queries = append(queries, func() (*data.SearchResult, error) {
+				return p.Search(ctx, s.Query, s.Page)
+			})
+		}
+	}
+
+	// buffered so that late sources do not block once we stop listening
+	results := make(chan *data.SearchResult, len(queries))
+	sources := len(queries)
+
+	for _, query := range queries {
+		go func(query func() (*data.SearchResult, error)) {
+			res, err := query()
+
+			if err != nil {
+				log.Error(err.Error())
+				results <- nil
+				return
+			}
+
+			results <- res
+		}(query)
+	}
+
+	collected := make([]data.SearchResult, 0, sources)
+
+wait:
+	for i := 0; i < sources; i++ {
+		select {
+		case res := <-results:
+			if res != nil {
+				collected = append(collected, *res)
+			}
+
+		case <-ctx.Done():
+			log.WithField("missing", sources-i).Info("Search deadline reached")
+			break wait
+		}
+	}
+
+	return CommandResult{true, data.MergeResults(collected), nil}
+}
 func (cs *CommandServer) SelfSearch(css CommandSelfSearch) CommandResult {
 	log.Info("Command: Search request")
 
@@ -478,8 +745,7 @@ func (cs *CommandServer) AddMeta(cam CommandAddMeta) CommandResult {
 func (cs *CommandServer) SaveCollection(csc CommandSaveCollection) CommandResult {
 	log.Info("Command: Save Collection request")
 
-	// TODO: make this configurable
-	cs.LocalPeer.Collection.Save("./data/collection.dat")
+	cs.LocalPeer.Collection.Save(cs.LocalPeer.DataPath("collection.dat"))
 
 	return CommandResult{true, nil, nil}
 }
@@ -491,6 +757,17 @@ func (cs *CommandServer) RebuildCollection(crc CommandRebuildCollection) Command
 	cs.LocalPeer.Collection, err = data.CreateCollection(cs.LocalPeer.Database, 0, data.PieceSize)
 	return CommandResult{err == nil, nil, err}
 }
+func (cs *CommandServer) CollectGarbage(ccg CommandCollectGarbage) CommandResult {
+	log.Info("Command: Collect Garbage request")
+
+	result, err := cs.LocalPeer.DHT.CollectGarbage()
+
+	if err != nil {
+		return CommandResult{false, nil, err}
+	}
+
+	return CommandResult{true, result, nil}
+}
 func (cs *CommandServer) Peers(cp CommandPeers) CommandResult {
 	log.Info("Command: Peers request")
 
@@ -505,7 +782,7 @@ func (cs *CommandServer) Peers(cp CommandPeers) CommandResult {
 
 	i := 1
 	for _, p := range cs.LocalPeer.Peers() {
-		ps[i], err = p.Entry()
+		ps[i], err = p.Entry(context.Background())
 
 		if err != nil {
 			return CommandResult{false, nil, err}
@@ -538,7 +815,7 @@ func (cs *CommandServer) RequestAddPeer(crap CommandRequestAddPeer) CommandResul
 		return CommandResult{true, nil, err}
 	}
 
-	err = peer.RequestAddPeer(*entry)
+	err = peer.RequestAddPeer(context.Background(), *entry)
 
 	return CommandResult{err == nil, nil, err}
 }
@@ -667,3 +944,47 @@ func (cs *CommandServer) NetMap(cnm CommandNetMap) CommandResult {
 
 	return CommandResult{true, ret, nil}
 }
+
+func (cs *CommandServer) Reputation(cr CommandReputation) CommandResult {
+	log.Info("Command: Reputation request")
+
+	return CommandResult{true, cs.LocalPeer.peerManager.Reputations(), nil}
+}
+
+func (cs *CommandServer) Bans(cb CommandBans) CommandResult {
+	log.Info("Command: Bans request")
+
+	return CommandResult{true, cs.LocalPeer.peerManager.Bans(), nil}
+}
+
+func (cs *CommandServer) Ban(cb CommandBan) CommandResult {
+	log.WithFields(log.Fields{
+		"address": cb.Address,
+		"public":  cb.Public,
+	}).Info("Command: Ban request")
+
+	ban := Ban{
+		Address:       cb.Address,
+		PublicAddress: cb.Public,
+		Reason:        cb.Reason,
+	}
+
+	if cb.Duration > 0 {
+		ban.Until = time.Now().Add(time.Duration(cb.Duration) * time.Second).Unix()
+	}
+
+	err := cs.LocalPeer.peerManager.Ban(ban)
+
+	return CommandResult{err == nil, nil, err}
+}
+
+func (cs *CommandServer) Unban(cu CommandUnban) CommandResult {
+	log.WithFields(log.Fields{
+		"address": cu.Address,
+		"public":  cu.Public,
+	}).Info("Command: Unban request")
+
+	err := cs.LocalPeer.peerManager.Unban(cu.Address, cu.Public)
+
+	return CommandResult{err == nil, nil, err}
+}
@@ -25,14 +25,18 @@
 
 package common
 
-import "github.com/dfindex/dfi/dht"
+import (
+	"context"
+
+	"github.com/dfindex/dfi/dht"
+)
 
 type ConnectPeer func(dht.Address) (interface{}, error)
 
 type Peer interface {
 	EAddress() Encoder
-	FindClosest(dht.Address) ([]Verifier, error)
-	Query(dht.Address) (Verifier, error)
+	FindClosest(context.Context, dht.Address) ([]Verifier, error)
+	Query(context.Context, dht.Address) (Verifier, error)
 }
 
 type Closable interface {
@@ -0,0 +1,166 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Just enough bencode to read .torrent files. Integers decode to int64,
+// strings to string, lists to []interface{} and dictionaries to
+// map[string]interface{}.
+type bdecoder struct {
+	buf []byte
+	pos int
+	// The raw bytes of the top level info dictionary, which is what an infohash
+	// is the hash of.
+	info []byte
+}
+
+var errBencode = errors.New("Invalid bencode")
+
+func bdecode(buf []byte) (map[string]interface{}, []byte, error) {
+	d := bdecoder{buf: buf}
+
+	value, err := d.value(0)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dict, ok := value.(map[string]interface{})
+
+	if !ok || d.pos != len(buf) {
+		return nil, nil, errBencode
+	}
+
+	return dict, d.info, nil
+}
+
+func (d *bdecoder) value(depth int) (interface{}, error) {
+	if d.pos >= len(d.buf) || depth > 64 {
+		return nil, errBencode
+	}
+
+	switch c := d.buf[d.pos]; {
+	case c == 'i':
+		d.pos++
+		return d.integer('e')
+
+	case c == 'l':
+		d.pos++
+		list := make([]interface{}, 0)
+
+		for d.pos < len(d.buf) && d.buf[d.pos] != 'e' {
+			value, err := d.value(depth + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			list = append(list, value)
+		}
+
+		return list, d.end()
+
+	case c == 'd':
+		d.pos++
+		dict := make(map[string]interface{})
+
+		for d.pos < len(d.buf) && d.buf[d.pos] != 'e' {
+			key, err := d.str()
+
+			if err != nil {
+				return nil, err
+			}
+
+			start := d.pos
+			value, err := d.value(depth + 1)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if depth == 0 && key == "info" {
+				d.info = d.buf[start:d.pos]
+			}
+
+			dict[key] = value
+		}
+
+		return dict, d.end()
+
+	case c >= '0' && c <= '9':
+		return d.str()
+	}
+
+	return nil, errBencode
+}
+
+// Consumes the e that closes a list or dictionary.
+func (d *bdecoder) end() error {
+	if d.pos >= len(d.buf) {
+		return errBencode
+	}
+
+	d.pos++
+
+	return nil
+}
+
+func (d *bdecoder) integer(term byte) (int64, error) {
+	start := d.pos
+
+	for d.pos < len(d.buf) && d.buf[d.pos] != term {
+		d.pos++
+	}
+
+	if d.pos >= len(d.buf) {
+		return 0, errBencode
+	}
+
+	n, err := strconv.ParseInt(string(d.buf[start:d.pos]), 10, 64)
+	d.pos++
+
+	if err != nil {
+		return 0, errBencode
+	}
+
+	return n, nil
+}
+
+func (d *bdecoder) str() (string, error) {
+	n, err := d.integer(':')
+
+	if err != nil || n < 0 || n > int64(len(d.buf)-d.pos) {
+		return "", errBencode
+	}
+
+	s := string(d.buf[d.pos : d.pos+int(n)])
+	d.pos += int(n)
+
+	return s, nil
+}
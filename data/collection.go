@@ -26,36 +26,34 @@ package data
 
 import (
 	"errors"
-	"hash"
 	"io/ioutil"
 	"math"
-
-	"golang.org/x/crypto/sha3"
 )
 
 // A collection of pieces, by extension a structure containing all posts this
 // peer has. Whether or not the pieces are *actually* there is optional, if not
 // this is essentially a hash list.
+// The hash list forms the leaves of a Merkle tree, RootHash is the root of it.
 type Collection struct {
 	Pieces   []*Piece
 	HashList []byte
-	RootHash hash.Hash
+	RootHash []byte
 }
 
 // Create a new collection, set all it's members to the correct default values.
 func NewCollection() *Collection {
 	col := &Collection{}
 
-	col.RootHash = sha3.New256()
 	col.Pieces = make([]*Piece, 0, 2)
 	col.HashList = make([]byte, 0)
+	col.RootHash = MerkleRoot(col.HashList)
 
 	return col
 }
 
 // Takes a database, starting id, and piece size. From this we create a
 // collection, except it does not contain any posts - consider making this optional.
-func CreateCollection(db *Database, start, pieceSize int) (*Collection, error) {
+func CreateCollection(db PostStore, start, pieceSize int) (*Collection, error) {
 	col := NewCollection()
 
 	postCount := db.PostCount()
@@ -68,9 +66,11 @@ func CreateCollection(db *Database, start, pieceSize int) (*Collection, error) {
 			return nil, err
 		}
 
-		col.Add(piece)
+		col.Put(piece)
 	}
 
+	col.Rehash()
+
 	return col, nil
 }
 
@@ -86,7 +86,7 @@ func LoadCollection(path string) (col *Collection, err error) {
 		return
 	}
 
-	if len(data)%32 != 0 {
+	if len(data)%HashSize != 0 {
 		err = errors.New("Invalid collection data file")
 		return
 	}
@@ -102,34 +102,45 @@ func (c *Collection) Save(path string) error {
 	return ioutil.WriteFile(path, c.HashList, 0777)
 }
 
-// Add a piece to the collection, storing it in c.Pieces and appending it's hash
-// to the hash list.
+// Add a piece to the collection, appending it's hash to the hash list. If the
+// piece is already in the list, it's hash is replaced.
 func (c *Collection) Add(piece *Piece) {
-	if uint(len(c.HashList)) < piece.Id+1 {
+	c.Put(piece)
+	c.Rehash()
+}
+
+// The same as Add, without recomputing the root hash. When adding many pieces,
+// Put each of them and then Rehash once.
+func (c *Collection) Put(piece *Piece) {
+	if uint(c.Size()) < piece.Id+1 {
 		c.HashList = append(c.HashList, piece.Hash()...)
 	} else {
-		copy(c.HashList[piece.Id*32:piece.Id*32+32], piece.Hash())
+		copy(c.HashList[piece.Id*HashSize:piece.Id*HashSize+HashSize], piece.Hash())
 	}
+}
 
-	c.RootHash.Write(piece.Hash())
+// The number of pieces in the hash list.
+func (c *Collection) Size() int {
+	return len(c.HashList) / HashSize
 }
 
-// Return the hash of the hash list, which can then go on to be signed by the
-// LocalPeer. This allows proper validation of an entire collection, but the
-// localpeer only needs to sign a single hash.
+// Return the Merkle root of the hash list, which can then go on to be signed by
+// the LocalPeer. This allows proper validation of an entire collection, or of
+// any single piece, but the localpeer only needs to sign a single hash.
 func (c *Collection) Hash() []byte {
-	var ret []byte
-
-	ret = c.RootHash.Sum(nil)
+	ret := make([]byte, len(c.RootHash))
+	copy(ret, c.RootHash)
 
 	return ret
 }
 
+// Returns the audit path for a piece, this is sent alongside the piece so that
+// it can be checked against the root without the rest of the hash list.
+func (c *Collection) Proof(id int) ([][]byte, error) {
+	return MerkleProof(c.HashList, id)
+}
+
 // Regenerates the root hash from the hash list we have.
 func (c *Collection) Rehash() {
-	c.RootHash = sha3.New256()
-
-	for i := 0; i < len(c.HashList)/32; i++ {
-		c.RootHash.Write(c.HashList[i*32 : i*32+32])
-	}
+	c.RootHash = MerkleRoot(c.HashList)
 }
@@ -0,0 +1,124 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+const (
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+)
+
+// Calls each for every post in the store, in id order. Tombstones are
+// included.
+func EachPost(db PostStore, each func(*Post) error) error {
+	pieces := int(math.Ceil(float64(db.PostCount()) / float64(PieceSize)))
+	posts := db.QueryPiecePosts(0, pieces, true)
+
+	// the channel must be drained, otherwise the query is never closed
+	defer func() {
+		for range posts {
+		}
+	}()
+
+	for i := range posts {
+		if err := each(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes every post as JSONL or CSV, in the formats ReadImport reads. Tombstones
+// are left out.
+func WriteExport(format string, db PostStore, w io.Writer) error {
+	switch format {
+	case ExportJSONL:
+		return EachPost(db, func(p *Post) error {
+			if p.IsTombstone() {
+				return nil
+			}
+
+			return WriteJSONL(p, w)
+		})
+	case ExportCSV:
+		writer := csv.NewWriter(w)
+
+		err := writer.Write(append([]string{"id"}, importColumns...))
+
+		if err != nil {
+			return err
+		}
+
+		err = EachPost(db, func(p *Post) error {
+			if p.IsTombstone() {
+				return nil
+			}
+
+			return writer.Write([]string{
+				strconv.Itoa(p.Id),
+				p.InfoHash,
+				p.Title,
+				strconv.Itoa(p.Size),
+				strconv.Itoa(p.FileCount),
+				strconv.Itoa(p.Seeders),
+				strconv.Itoa(p.Leechers),
+				strconv.Itoa(p.UploadDate),
+				p.Tags,
+				p.Meta,
+			})
+		})
+
+		if err != nil {
+			return err
+		}
+
+		writer.Flush()
+
+		return writer.Error()
+	}
+
+	return errors.New("Unknown export format")
+}
+
+// Writes a single post as a line of JSON.
+func WriteJSONL(p *Post, w io.Writer) error {
+	dat, err := p.Json()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(dat, '\n'))
+
+	return err
+}
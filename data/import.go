@@ -0,0 +1,324 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Posts can be imported in bulk from .torrent files, magnet links (one per
+// line in a .magnet or .txt file), CSV dumps and JSONL dumps. Infohashes are
+// always stored as lowercase hex.
+
+// The largest .torrent file that will be read.
+const MaxTorrentSize = 10 << 20
+
+// CSV dumps must have a header row, using these names. Other columns are
+// ignored, info_hash and title are required.
+var importColumns = []string{"info_hash", "title", "size", "file_count",
+	"seeders", "leechers", "upload_date", "tags", "meta"}
+
+// Reads every post out of a file, calling each for every one. The format is
+// decided by the file extension.
+func ReadImport(name string, r io.Reader, each func(Post) error) error {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".torrent":
+		dat, err := ioutil.ReadAll(io.LimitReader(r, MaxTorrentSize+1))
+
+		if err != nil {
+			return err
+		}
+
+		if len(dat) > MaxTorrentSize {
+			return errors.New("Torrent file too large")
+		}
+
+		post, err := ParseTorrent(dat)
+
+		if err != nil {
+			return err
+		}
+
+		return each(post)
+	case ".magnet", ".txt":
+		return ReadMagnets(r, each)
+	case ".csv":
+		return ReadCSV(r, each)
+	case ".jsonl", ".json":
+		return ReadJSONL(r, each)
+	}
+
+	return errors.New("Unknown import format")
+}
+
+// Reads the infohash, name, size and file count from a .torrent file.
+func ParseTorrent(dat []byte) (Post, error) {
+	var post Post
+
+	torrent, info, err := bdecode(dat)
+
+	if err != nil {
+		return post, err
+	}
+
+	dict, ok := torrent["info"].(map[string]interface{})
+
+	if !ok {
+		return post, errors.New("Torrent has no info dictionary")
+	}
+
+	hash := sha1.Sum(info)
+	post.InfoHash = hex.EncodeToString(hash[:])
+
+	post.Title, _ = dict["name"].(string)
+
+	if files, ok := dict["files"].([]interface{}); ok {
+		post.FileCount = len(files)
+
+		for _, i := range files {
+			file, _ := i.(map[string]interface{})
+			length, _ := file["length"].(int64)
+			post.Size += int(length)
+		}
+	} else {
+		length, _ := dict["length"].(int64)
+		post.FileCount = 1
+		post.Size = int(length)
+	}
+
+	post.UploadDate = int(time.Now().Unix())
+
+	if created, ok := torrent["creation date"].(int64); ok && created > 0 &&
+		created < int64(post.UploadDate) {
+		post.UploadDate = int(created)
+	}
+
+	return post, nil
+}
+
+// Reads a magnet URI. Only the infohash (xt), name (dn) and size (xl) are used,
+// the file count is unknown and left at 0.
+func ParseMagnet(uri string) (Post, error) {
+	var post Post
+
+	u, err := url.Parse(strings.TrimSpace(uri))
+
+	if err != nil {
+		return post, err
+	}
+
+	if u.Scheme != "magnet" {
+		return post, errors.New("Not a magnet link")
+	}
+
+	query := u.Query()
+
+	for _, i := range query["xt"] {
+		if strings.HasPrefix(i, "urn:btih:") {
+			post.InfoHash, err = NormaliseInfoHash(strings.TrimPrefix(i, "urn:btih:"))
+
+			if err != nil {
+				return post, err
+			}
+		}
+	}
+
+	if post.InfoHash == "" {
+		return post, errors.New("Magnet link has no BitTorrent infohash")
+	}
+
+	post.Title = query.Get("dn")
+	post.Size, _ = strconv.Atoi(query.Get("xl"))
+	post.UploadDate = int(time.Now().Unix())
+
+	return post, nil
+}
+
+// Infohashes are either 40 hex characters, or 32 base32 characters in older
+// magnet links. Either way they are returned as lowercase hex.
+func NormaliseInfoHash(hash string) (string, error) {
+	switch len(hash) {
+	case 40:
+		dat, err := hex.DecodeString(hash)
+
+		if err != nil {
+			return "", err
+		}
+
+		return hex.EncodeToString(dat), nil
+	case 32:
+		dat, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+
+		if err != nil {
+			return "", err
+		}
+
+		return hex.EncodeToString(dat), nil
+	}
+
+	return "", errors.New("Invalid infohash")
+}
+
+// One magnet link per line, blank lines and lines starting with # are skipped.
+func ReadMagnets(r io.Reader, each func(Post) error) error {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		post, err := ParseMagnet(line)
+
+		if err != nil {
+			return err
+		}
+
+		if err = each(post); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Reads a CSV dump with a header row, see importColumns.
+func ReadCSV(r io.Reader, each func(Post) error) error {
+	reader := csv.NewReader(r)
+
+	header, err := reader.Read()
+
+	if err != nil {
+		return err
+	}
+
+	columns := make(map[string]int)
+
+	for n, i := range header {
+		columns[strings.ToLower(strings.TrimSpace(i))] = n
+	}
+
+	for _, i := range importColumns[:2] {
+		if _, ok := columns[i]; !ok {
+			return errors.New("CSV is missing the " + i + " column")
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		field := func(name string) string {
+			if n, ok := columns[name]; ok && n < len(record) {
+				return record[n]
+			}
+
+			return ""
+		}
+
+		number := func(name string) int {
+			n, _ := strconv.Atoi(field(name))
+			return n
+		}
+
+		post := Post{
+			Title:      field("title"),
+			Size:       number("size"),
+			FileCount:  number("file_count"),
+			Seeders:    number("seeders"),
+			Leechers:   number("leechers"),
+			UploadDate: number("upload_date"),
+			Tags:       field("tags"),
+			Meta:       field("meta"),
+		}
+
+		post.InfoHash, err = NormaliseInfoHash(field("info_hash"))
+
+		if err != nil {
+			return err
+		}
+
+		if err = each(post); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads a dump of one JSON post per line, in the same form /self/addpost/
+// takes.
+func ReadJSONL(r io.Reader, each func(Post) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxPostSize*4)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" {
+			continue
+		}
+
+		var post Post
+
+		if err := json.Unmarshal([]byte(line), &post); err != nil {
+			return err
+		}
+
+		hash, err := NormaliseInfoHash(post.InfoHash)
+
+		if err != nil {
+			return err
+		}
+
+		post.InfoHash = hash
+
+		if err = each(post); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,159 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/dfindex/dfi/data"
+)
+
+const testInfo = "d5:filesld6:lengthi10e4:pathl1:aeed6:lengthi20e4:pathl1:beee4:name6:ubuntu12:piece lengthi16384ee"
+
+func TestParseTorrent(t *testing.T) {
+	torrent := "d8:announce3:url13:creation datei1000e4:info" + testInfo + "e"
+
+	post, err := data.ParseTorrent([]byte(torrent))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := sha1.Sum([]byte(testInfo))
+
+	if post.InfoHash != hex.EncodeToString(hash[:]) {
+		t.Fatal("Infohash is not the hash of the info dictionary")
+	}
+
+	if post.Title != "ubuntu" || post.Size != 30 || post.FileCount != 2 ||
+		post.UploadDate != 1000 {
+		t.Fatal("Unexpected post: ", post)
+	}
+
+	for _, i := range []string{"", "d4:infoi1ee", "d4:info" + testInfo, "l1:ae"} {
+		if _, err := data.ParseTorrent([]byte(i)); err == nil {
+			t.Fatal("Accepted invalid torrent: ", i)
+		}
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	hex := "c12fe1c06bba254a9dc9f519b335aa7c1367a88a"
+
+	post, err := data.ParseMagnet("magnet:?xt=urn:btih:" + strings.ToUpper(hex) +
+		"&dn=ubuntu+16.04&xl=1024")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if post.InfoHash != hex || post.Title != "ubuntu 16.04" || post.Size != 1024 {
+		t.Fatal("Unexpected post: ", post)
+	}
+
+	post, err = data.ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK&dn=a")
+
+	if err != nil || post.InfoHash != hex {
+		t.Fatal("Base32 infohash was not converted to hex")
+	}
+
+	if _, err = data.ParseMagnet("http://example.com/?xt=urn:btih:" + hex); err == nil {
+		t.Fatal("Accepted a link that is not a magnet link")
+	}
+}
+
+func TestReadDumps(t *testing.T) {
+	csv := "title,info_hash,size,tags\n" +
+		"ubuntu,C12FE1C06BBA254A9DC9F519B335AA7C1367A88A,10,\"linux,iso\"\n"
+
+	jsonl := `{"InfoHash": "c12fe1c06bba254a9dc9f519b335aa7c1367a88a", "Title": "ubuntu", "Size": 10, "Tags": "linux,iso"}` +
+		"\n\n"
+
+	for name, dump := range map[string]string{"dump.csv": csv, "dump.jsonl": jsonl} {
+		posts := make([]data.Post, 0)
+
+		err := data.ReadImport(name, strings.NewReader(dump), func(p data.Post) error {
+			posts = append(posts, p)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(posts) != 1 || posts[0].Title != "ubuntu" || posts[0].Size != 10 ||
+			posts[0].Tags != "linux,iso" ||
+			posts[0].InfoHash != "c12fe1c06bba254a9dc9f519b335aa7c1367a88a" {
+			t.Fatal(name, ": unexpected posts ", posts)
+		}
+	}
+
+	err := data.ReadImport("dump.csv", strings.NewReader("title\nubuntu\n"),
+		func(p data.Post) error { return nil })
+
+	if err == nil {
+		t.Fatal("Accepted a CSV dump without infohashes")
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	db := data.NewMemoryStore()
+
+	for i, title := range []string{"ubuntu", "deleted", "debian, with a comma"} {
+		post := testPost(0, title)
+		post.InfoHash = strings.Repeat("abc"[i:i+1], 40)
+		post.Tags = "linux,iso"
+		db.InsertPost(post)
+	}
+
+	db.ApplyOperation(&data.Operation{Id: 1, Type: data.OpTombstone, PostId: 2})
+
+	for _, format := range []string{data.ExportJSONL, data.ExportCSV} {
+		buf := bytes.Buffer{}
+
+		if err := data.WriteExport(format, db, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		titles := make([]string, 0)
+
+		err := data.ReadImport("export."+format, &buf, func(p data.Post) error {
+			titles = append(titles, p.Title)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(titles) != 2 || titles[1] != "debian, with a comma" {
+			t.Fatal(format, ": unexpected posts ", titles)
+		}
+	}
+}
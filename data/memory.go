@@ -0,0 +1,620 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A PostStore that keeps everything in memory. It behaves the same as
+// sqlite.Database as far as callers can tell, apart from relevance which has no
+// bm25 and so falls back to seeders. Nothing is persisted.
+type MemoryStore struct {
+	// Indexed by id - 1, nil where there is a gap.
+	posts      []*Post
+	infoHashes map[string]int
+	ops        []*Operation
+	mutex      sync.RWMutex
+}
+
+// Orderings for SearchQuery, the same as querySorts.
+var memorySorts = map[string]func(a, b *Post) bool{
+	"relevance": popularity,
+	"seeders":   popularity,
+	"leechers":  func(a, b *Post) bool { return a.Leechers > b.Leechers },
+	"size":      func(a, b *Post) bool { return a.Size > b.Size },
+	"files":     func(a, b *Post) bool { return a.FileCount > b.FileCount },
+	"date":      func(a, b *Post) bool { return a.UploadDate > b.UploadDate },
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{infoHashes: make(map[string]int)}
+}
+
+func popularity(a, b *Post) bool {
+	return float64(a.Seeders)*1.1+float64(a.Leechers) >
+		float64(b.Seeders)*1.1+float64(b.Leechers)
+}
+
+// Adds a post with the next id, unless the infohash is already present.
+// Like Database, an ignored post is not an error, and 0 is returned.
+func (ms *MemoryStore) insert(post Post) int64 {
+	if _, ok := ms.infoHashes[post.InfoHash]; ok {
+		return 0
+	}
+
+	post.Id = len(ms.posts) + 1
+	ms.posts = append(ms.posts, &post)
+	ms.infoHashes[post.InfoHash] = post.Id
+
+	return int64(post.Id)
+}
+
+// Stores a post with the given id, unless the id or the info hash is already
+// taken, as INSERT OR IGNORE would. Any ids skipped over are left as gaps.
+func (ms *MemoryStore) insertAt(post Post, id int) {
+	if id < 1 || ms.get(id) != nil {
+		return
+	}
+
+	if _, ok := ms.infoHashes[post.InfoHash]; ok {
+		return
+	}
+
+	for len(ms.posts) < id {
+		ms.posts = append(ms.posts, nil)
+	}
+
+	post.Id = id
+	ms.posts[id-1] = &post
+	ms.infoHashes[post.InfoHash] = id
+}
+
+func (ms *MemoryStore) remove(id int) {
+	if id < 1 || id > len(ms.posts) || ms.posts[id-1] == nil {
+		return
+	}
+
+	delete(ms.infoHashes, ms.posts[id-1].InfoHash)
+	ms.posts[id-1] = nil
+}
+
+// Drops trailing gaps, so the next post gets MAX(id) + 1 as it would in SQLite.
+func (ms *MemoryStore) trim() {
+	for len(ms.posts) > 0 && ms.posts[len(ms.posts)-1] == nil {
+		ms.posts = ms.posts[:len(ms.posts)-1]
+	}
+}
+
+func (ms *MemoryStore) get(id int) *Post {
+	if id < 1 || id > len(ms.posts) {
+		return nil
+	}
+
+	return ms.posts[id-1]
+}
+
+// Every post that is not a tombstone, optionally only the n most recent.
+func (ms *MemoryStore) visible(recent int) []*Post {
+	ret := make([]*Post, 0, len(ms.posts))
+
+	for _, i := range ms.posts {
+		if i != nil && !i.IsTombstone() {
+			p := *i
+			ret = append(ret, &p)
+		}
+	}
+
+	if recent > 0 {
+		sort.SliceStable(ret, func(a, b int) bool {
+			return ret[a].UploadDate > ret[b].UploadDate
+		})
+
+		if len(ret) > recent {
+			ret = ret[:recent]
+		}
+	}
+
+	return ret
+}
+
+func paginate(posts []*Post, page, pageSize int) []*Post {
+	start := page * pageSize
+
+	if start >= len(posts) || start < 0 {
+		return make([]*Post, 0)
+	}
+
+	if start+pageSize < len(posts) {
+		return posts[start : start+pageSize]
+	}
+
+	return posts[start:]
+}
+
+func (ms *MemoryStore) InsertPost(post Post) (int64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	id := ms.insert(post)
+
+	if id == 0 {
+		return -1, ErrDuplicatePost
+	}
+
+	return id, nil
+}
+
+func (ms *MemoryStore) InsertPiece(piece *Piece) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for _, i := range piece.Posts {
+		ms.insert(i)
+	}
+
+	return nil
+}
+
+// Same rules as Database.ReplacePiece.
+func (ms *MemoryStore) ReplacePiece(piece *Piece) error {
+	start := int(piece.Id) * PieceSize
+	end := start + PieceSize
+
+	last := start
+	for _, i := range piece.Posts {
+		if i.Id <= last || i.Id > end {
+			return errors.New("Post id outside of piece")
+		}
+
+		last = i.Id
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for i := start + 1; i <= end; i++ {
+		ms.remove(i)
+	}
+
+	for _, i := range piece.Posts {
+		post := i
+
+		// INSERT OR REPLACE removes any other row with the same infohash
+		if id, ok := ms.infoHashes[post.InfoHash]; ok {
+			ms.remove(id)
+		}
+
+		for len(ms.posts) < post.Id {
+			ms.posts = append(ms.posts, nil)
+		}
+
+		ms.posts[post.Id-1] = &post
+		ms.infoHashes[post.InfoHash] = post.Id
+	}
+
+	ms.trim()
+
+	return nil
+}
+
+// Inserts pieces until the channel gives nil, then closes it.
+func (ms *MemoryStore) InsertPieces(pieces chan *Piece, fts bool) error {
+	defer close(pieces)
+
+	for piece := range pieces {
+		if piece == nil {
+			return nil
+		}
+
+		ms.InsertPiece(piece)
+	}
+
+	return nil
+}
+
+// There is no index to generate, posts are matched as they are searched.
+func (ms *MemoryStore) GenerateFts(since int64) error {
+	return nil
+}
+
+func (ms *MemoryStore) Search(query string, page, pageSize int) ([]*Post, error) {
+	q, err := ParseQuery(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ms.SearchQuery(q, page, pageSize)
+}
+
+func (ms *MemoryStore) SearchQuery(q *Query, page, pageSize int) ([]*Post, error) {
+	if q.Empty() {
+		return make([]*Post, 0), nil
+	}
+
+	less, ok := memorySorts[q.Sort]
+
+	if !ok {
+		return nil, errors.New("Unknown sort")
+	}
+
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	posts := make([]*Post, 0)
+
+	for _, i := range ms.visible(0) {
+		if q.Match(i) {
+			posts = append(posts, i)
+		}
+	}
+
+	sort.SliceStable(posts, func(a, b int) bool {
+		return less(posts[a], posts[b])
+	})
+
+	return paginate(posts, page, pageSize), nil
+}
+
+// Titles matching a LIKE pattern, as Database.Suggest.
+func (ms *MemoryStore) Suggest(query string) ([]string, error) {
+	suggest_size := 5
+
+	pattern := regexp.QuoteMeta(query)
+	pattern = strings.Replace(pattern, "%", ".*", -1)
+	pattern = strings.Replace(pattern, "_", ".", -1)
+
+	like, err := regexp.Compile("(?is)^" + pattern + "$")
+
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	posts := make([]*Post, 0)
+
+	for _, i := range ms.visible(100000) {
+		if like.MatchString(i.Title) {
+			posts = append(posts, i)
+		}
+	}
+
+	sort.SliceStable(posts, func(a, b int) bool {
+		return popularity(posts[a], posts[b])
+	})
+
+	ret := make([]string, 0, suggest_size)
+
+	for _, i := range paginate(posts, 0, suggest_size) {
+		ret = append(ret, i.Title)
+	}
+
+	return ret, nil
+}
+
+func (ms *MemoryStore) QueryRecent(page int) ([]*Post, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	return paginate(ms.visible(len(ms.posts)), page, 25), nil
+}
+
+func (ms *MemoryStore) QueryPopular(page int) ([]*Post, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	posts := ms.visible(10000)
+
+	sort.SliceStable(posts, func(a, b int) bool {
+		return posts[a].Seeders+posts[a].Leechers > posts[b].Seeders+posts[b].Leechers
+	})
+
+	return paginate(posts, page, 25), nil
+}
+
+// Returns an empty post if there is none with the id, as Database does.
+func (ms *MemoryStore) QueryPostId(id uint) (Post, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	if post := ms.get(int(id)); post != nil {
+		return *post, nil
+	}
+
+	return Post{}, nil
+}
+
+func (ms *MemoryStore) QueryInfoHash(infoHash string) (Post, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	if post := ms.get(ms.infoHashes[infoHash]); post != nil {
+		return *post, nil
+	}
+
+	return Post{}, nil
+}
+
+// Up to count posts after the given id, in id order.
+func (ms *MemoryStore) postsAfter(start, count int) []Post {
+	ret := make([]Post, 0)
+
+	for i := start + 1; i <= len(ms.posts) && len(ret) < count; i++ {
+		if post := ms.get(i); post != nil {
+			ret = append(ret, *post)
+		}
+	}
+
+	return ret
+}
+
+func (ms *MemoryStore) QueryPiece(id uint, store bool) (*Piece, error) {
+	var piece Piece
+	piece.Setup()
+	piece.Id = id
+
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	for _, i := range ms.postsAfter(int(id)*PieceSize, PieceSize) {
+		piece.Add(i, store)
+	}
+
+	return &piece, nil
+}
+
+func (ms *MemoryStore) QueryPiecePosts(start, length int, store bool) chan *Post {
+	ret := make(chan *Post)
+
+	ms.mutex.RLock()
+	posts := ms.postsAfter(start*PieceSize, PieceSize*length)
+	ms.mutex.RUnlock()
+
+	go func() {
+		defer close(ret)
+
+		for i := range posts {
+			ret <- &posts[i]
+		}
+	}()
+
+	return ret
+}
+
+// The highest id, as with Database gaps are counted.
+func (ms *MemoryStore) PostCount() uint {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	return uint(len(ms.posts))
+}
+
+func (ms *MemoryStore) AddMeta(pid int, value string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if post := ms.get(pid); post != nil {
+		post.Meta = value
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) SetSeeders(id, seeders uint) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if post := ms.get(int(id)); post != nil {
+		post.Seeders = int(seeders)
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) SetLeechers(id, leechers uint) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if post := ms.get(int(id)); post != nil {
+		post.Leechers = int(leechers)
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) ApplyOperation(op *Operation) error {
+	return ms.ApplyOperations([]*Operation{op})
+}
+
+// Same rules as Database.ApplyOperations. The whole batch is checked before
+// anything is changed, so like the transaction there it is either applied in
+// full or not at all.
+func (ms *MemoryStore) ApplyOperations(ops []*Operation) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	err := ms.checkOperations(ops)
+
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if op.Id <= ms.lastOperation() {
+			continue
+		}
+
+		ms.applyOperation(op)
+	}
+
+	return nil
+}
+
+// Fails if an operation in the batch has an unknown type, or would amend a post
+// to an infohash another post has, as the UNIQUE constraint in SQLite would.
+// Infohashes are tracked through the batch as applyOperation would change them.
+func (ms *MemoryStore) checkOperations(ops []*Operation) error {
+	last := ms.lastOperation()
+
+	// changes made by the batch so far, infohash to post id and back
+	owners := make(map[string]int)
+	hashes := make(map[int]string)
+
+	owner := func(hash string) int {
+		if id, ok := owners[hash]; ok {
+			return id
+		}
+
+		return ms.infoHashes[hash]
+	}
+
+	for _, op := range ops {
+		switch op.Type {
+		case OpAdd, OpTombstone, OpAmend:
+		default:
+			return errors.New("Unknown operation type")
+		}
+
+		if op.Id <= last {
+			continue
+		}
+
+		last = op.Id
+
+		current, exists := hashes[op.PostId]
+
+		if !exists {
+			if post := ms.get(op.PostId); post != nil {
+				current, exists = post.InfoHash, true
+			}
+		}
+
+		switch op.Type {
+		case OpAdd:
+			if exists || op.PostId < 1 || owner(op.Post.InfoHash) != 0 {
+				continue
+			}
+
+		case OpAmend:
+			if !exists {
+				continue
+			}
+
+			if id := owner(op.Post.InfoHash); id != 0 && id != op.PostId {
+				return ErrDuplicatePost
+			}
+
+			owners[current] = 0
+
+		default:
+			continue
+		}
+
+		owners[op.Post.InfoHash] = op.PostId
+		hashes[op.PostId] = op.Post.InfoHash
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) applyOperation(op *Operation) {
+	logged := *op
+
+	switch op.Type {
+	case OpAdd:
+		ms.insertAt(op.Post, op.PostId)
+
+	case OpTombstone:
+		if post := ms.get(op.PostId); post != nil {
+			post.Tombstone()
+		}
+
+		logged.Post = Post{}
+
+	case OpAmend:
+		if post := ms.get(op.PostId); post != nil {
+			p := op.Post
+
+			delete(ms.infoHashes, post.InfoHash)
+			ms.infoHashes[p.InfoHash] = post.Id
+
+			post.InfoHash = p.InfoHash
+			post.Title = p.Title
+			post.Size = p.Size
+			post.FileCount = p.FileCount
+			post.UploadDate = p.UploadDate
+			post.Tags = p.Tags
+			post.Meta = p.Meta
+		}
+	}
+
+	ms.ops = append(ms.ops, &logged)
+}
+
+func (ms *MemoryStore) QueryOperations(since, count int) ([]*Operation, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	ops := make([]*Operation, 0, count)
+
+	for _, i := range ms.ops {
+		if len(ops) >= count {
+			break
+		}
+
+		if i.Id > since {
+			op := *i
+			ops = append(ops, &op)
+		}
+	}
+
+	return ops, nil
+}
+
+func (ms *MemoryStore) lastOperation() int {
+	if len(ms.ops) == 0 {
+		return 0
+	}
+
+	return ms.ops[len(ms.ops)-1].Id
+}
+
+func (ms *MemoryStore) LastOperation() int {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	return ms.lastOperation()
+}
+
+// Nothing to close.
+func (ms *MemoryStore) Close() {
+}
@@ -0,0 +1,448 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data_test
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/dfindex/dfi/data"
+)
+
+// Opens a new sqlite Database, nil when built without cgo.
+var testDatabase func(t *testing.T) (data.PostStore, func())
+
+func testPost(id int, title string) data.Post {
+	return data.Post{
+		Id:         id,
+		InfoHash:   strconv.Itoa(id) + title,
+		Title:      title,
+		Size:       1,
+		FileCount:  1,
+		UploadDate: 1,
+	}
+}
+
+// Runs the same test against every PostStore.
+func eachStore(t *testing.T, test func(t *testing.T, db data.PostStore)) {
+	if testDatabase != nil {
+		t.Run("sqlite", func(t *testing.T) {
+			db, cleanup := testDatabase(t)
+			defer cleanup()
+
+			test(t, db)
+		})
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		test(t, data.NewMemoryStore())
+	})
+}
+
+func testStorePiece(t *testing.T, db data.PostStore) {
+	piece := &data.Piece{Id: 0}
+	piece.Setup()
+
+	small := testPost(1, "ubuntu desktop")
+	small.Size = 1 << 20
+	small.Tags = "linux,iso"
+	small.Seeders = 10
+	small.UploadDate = 2
+
+	large := testPost(2, "ubuntu server")
+	large.Size = 2 << 30
+	large.Tags = "linux"
+	large.Seeders = 20
+
+	other := testPost(3, "debian")
+	other.Meta = `{"author": "ubuntu"}`
+	other.UploadDate = 3
+
+	piece.Add(small, true)
+	piece.Add(large, true)
+	piece.Add(other, true)
+
+	if err := db.ReplacePiece(piece); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkIds(t *testing.T, name string, posts []*data.Post, ids ...int) {
+	if len(posts) != len(ids) {
+		t.Fatalf("%s: expected %d results, got %d", name, len(ids), len(posts))
+	}
+
+	for n, i := range ids {
+		if posts[n].Id != i {
+			t.Fatalf("%s: unexpected result %d", name, posts[n].Id)
+		}
+	}
+}
+
+func TestStoreSearch(t *testing.T) {
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		testStorePiece(t, db)
+
+		check := func(query string, ids ...int) {
+			posts, err := db.Search(query, 0, 10)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkIds(t, query, posts, ids...)
+		}
+
+		check("ubuntu sort:seeders", 2, 1, 3)
+		check("ubuntu size:>1G", 2)
+		check("serv*", 2)
+		check("serv")
+		check("tag:iso", 1)
+		check("tag:linux sort:size", 2, 1)
+		check("sort:date after:1970-01-01", 3, 1, 2)
+
+		suggestions, err := db.Suggest("ubuntu%")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(suggestions) != 2 || suggestions[0] != "ubuntu server" {
+			t.Fatal("Unexpected suggestions: ", suggestions)
+		}
+	})
+}
+
+func TestStoreRecentAndPopular(t *testing.T) {
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		testStorePiece(t, db)
+
+		posts, err := db.QueryRecent(0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkIds(t, "recent", posts, 3, 1, 2)
+
+		posts, err = db.QueryPopular(0)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkIds(t, "popular", posts, 2, 1, 3)
+	})
+}
+
+func TestStoreInsert(t *testing.T) {
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		testStorePiece(t, db)
+
+		id, err := db.InsertPost(testPost(0, "arch"))
+
+		if err != nil || id != 4 {
+			t.Fatal("Post was not inserted after the piece")
+		}
+
+		// the infohash is already present
+		id, err = db.InsertPost(testPost(1, "ubuntu desktop"))
+
+		if err != data.ErrDuplicatePost || id != -1 {
+			t.Fatal("Duplicate infohash was not refused, got id ", id)
+		}
+
+		if db.PostCount() != 4 {
+			t.Fatal("Inserted a duplicate infohash")
+		}
+
+		if err = db.SetSeeders(4, 50); err != nil {
+			t.Fatal(err)
+		}
+
+		post, err := db.QueryPostId(4)
+
+		if err != nil || post.Seeders != 50 || post.Title != "arch" {
+			t.Fatal("Seeders were not updated")
+		}
+
+		post, err = db.QueryInfoHash(testPost(0, "arch").InfoHash)
+
+		if err != nil || post.Id != 4 {
+			t.Fatal("Post not found by infohash")
+		}
+
+		post, err = db.QueryInfoHash("missing")
+
+		if err != nil || post.Id != 0 {
+			t.Fatal("Found a post that does not exist")
+		}
+	})
+}
+
+// Pieces must hash the same whichever store they come from, otherwise a
+// mirror could never verify against a node with a different backend.
+func TestStorePieceHash(t *testing.T) {
+	hashes := make([][]byte, 0)
+
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		testStorePiece(t, db)
+
+		piece, err := db.QueryPiece(0, false)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hashes = append(hashes, piece.Hash())
+
+		n := 0
+		for range db.QueryPiecePosts(0, 1, true) {
+			n++
+		}
+
+		if n != 3 {
+			t.Fatal("Expected 3 posts from QueryPiecePosts, got ", n)
+		}
+	})
+
+	for _, i := range hashes[1:] {
+		if !bytes.Equal(hashes[0], i) {
+			t.Fatal("Stores disagree on the piece hash")
+		}
+	}
+}
+
+func TestStoreOperations(t *testing.T) {
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		testStorePiece(t, db)
+
+		amended := testPost(1, "ubuntu 16.04")
+
+		ops := []*data.Operation{
+			{Id: 1, Type: data.OpTombstone, PostId: 2, Signature: []byte{1}},
+			{Id: 2, Type: data.OpAmend, PostId: 1, Post: amended, Signature: []byte{2}},
+		}
+
+		for _, i := range ops {
+			if err := db.ApplyOperation(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// already applied
+		db.ApplyOperation(ops[0])
+
+		logged, err := db.QueryOperations(0, 10)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(logged) != 2 || db.LastOperation() != 2 {
+			t.Fatal("Operations were not logged")
+		}
+
+		posts, err := db.Search("ubuntu", 0, 10)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkIds(t, "ubuntu", posts, 1, 3)
+
+		if posts[0].Title != "ubuntu 16.04" {
+			t.Fatal("Post was not amended")
+		}
+	})
+}
+
+func testOp(id int, opType string, post data.Post) *data.Operation {
+	op := &data.Operation{Id: id, Type: opType, PostId: post.Id, Signature: []byte{byte(id)}}
+
+	if opType != data.OpTombstone {
+		op.Post = post
+	}
+
+	return op
+}
+
+// An amend cannot take an infohash another post already has, and the batch it
+// is in is not applied at all.
+func TestStoreAmendDuplicate(t *testing.T) {
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		testStorePiece(t, db)
+
+		first, err := db.QueryPostId(1)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		amended := testPost(2, "ubuntu server 18.04")
+		amended.InfoHash = first.InfoHash
+
+		err = db.ApplyOperations([]*data.Operation{
+			testOp(1, data.OpTombstone, testPost(3, "")),
+			testOp(2, data.OpAmend, amended),
+		})
+
+		if err != data.ErrDuplicatePost {
+			t.Fatal("Amended a post to a duplicate infohash, got ", err)
+		}
+
+		if db.LastOperation() != 0 {
+			t.Fatal("Part of a failed batch was applied")
+		}
+
+		post, err := db.QueryInfoHash(first.InfoHash)
+
+		if err != nil || post.Id != 1 {
+			t.Fatal("Infohash no longer finds its post")
+		}
+
+		// the same infohash moving between posts within a batch is fine
+		moved := testPost(2, "ubuntu server 18.04")
+		moved.InfoHash = "moved"
+		amended.Id = 1
+		amended.InfoHash = testPost(2, "ubuntu server").InfoHash
+
+		err = db.ApplyOperations([]*data.Operation{
+			testOp(1, data.OpAmend, moved),
+			testOp(2, data.OpAmend, amended),
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		post, err = db.QueryInfoHash(amended.InfoHash)
+
+		if err != nil || post.Id != 1 {
+			t.Fatal("Infohash was not moved to the other post")
+		}
+	})
+}
+
+// Pieces already hold the latest state of each post, replaying the log over
+// them must not bring back anything older.
+func TestStoreReplay(t *testing.T) {
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		piece := &data.Piece{Id: 0}
+		piece.Setup()
+		piece.Add(testPost(1, "bbbb"), true)
+		piece.Add(testPost(2, "cccc"), true)
+
+		if err := db.ReplacePiece(piece); err != nil {
+			t.Fatal(err)
+		}
+
+		before, _ := db.QueryPiece(0, false)
+
+		ops := []*data.Operation{
+			testOp(1, data.OpAdd, testPost(1, "aaaa")),
+			testOp(2, data.OpAdd, testPost(2, "cccc")),
+			testOp(3, data.OpAmend, testPost(1, "bbbb")),
+		}
+
+		if err := db.ApplyOperations(ops); err != nil {
+			t.Fatal(err)
+		}
+
+		if db.PostCount() != 2 {
+			t.Fatalf("Replay left %d posts, expected 2", db.PostCount())
+		}
+
+		after, _ := db.QueryPiece(0, false)
+
+		if !bytes.Equal(before.Hash(), after.Hash()) {
+			t.Fatal("Replay changed the piece")
+		}
+
+		// once applied, an operation is not applied again
+		db.ApplyOperation(testOp(1, data.OpAmend, testPost(1, "aaaa")))
+
+		if post, _ := db.QueryPostId(1); post.Title != "bbbb" {
+			t.Fatal("Replayed an operation that was already applied")
+		}
+	})
+}
+
+// A mirror made before a tombstone and an amendment catches up by replaying the
+// log, and ends up with the same pieces as the origin.
+func TestStorePropagation(t *testing.T) {
+	eachStore(t, func(t *testing.T, mirror data.PostStore) {
+		origin := data.NewMemoryStore()
+
+		err := origin.ApplyOperations([]*data.Operation{
+			testOp(1, data.OpAdd, testPost(1, "ubuntu")),
+			testOp(2, data.OpAdd, testPost(2, "debian")),
+			testOp(3, data.OpAdd, testPost(3, "arch")),
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		piece, _ := origin.QueryPiece(0, true)
+
+		if err := mirror.ReplacePiece(piece); err != nil {
+			t.Fatal(err)
+		}
+
+		amended := testPost(1, "ubuntu 16.04")
+		tombstoned := testPost(2, "debian")
+		tombstoned.Tombstone()
+
+		origin.ApplyOperation(testOp(4, data.OpTombstone, tombstoned))
+		origin.ApplyOperation(testOp(5, data.OpAmend, amended))
+
+		ops, err := origin.QueryOperations(mirror.LastOperation(), 100)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mirror.ApplyOperations(ops); err != nil {
+			t.Fatal(err)
+		}
+
+		want, _ := origin.QueryPiece(0, false)
+		got, _ := mirror.QueryPiece(0, false)
+
+		if !bytes.Equal(want.Hash(), got.Hash()) {
+			t.Fatal("Mirror does not match the origin after replay")
+		}
+
+		if post, _ := mirror.QueryPostId(2); !post.IsTombstone() {
+			t.Fatal("Tombstone was not propagated")
+		}
+
+		if post, _ := mirror.QueryPostId(1); post.Title != "ubuntu 16.04" {
+			t.Fatal("Amendment was not propagated")
+		}
+	})
+}
@@ -0,0 +1,161 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package data
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// The collection is a binary Merkle tree over the piece hashes, built the same
+// way as RFC 6962 (Certificate Transparency). Leaves and inner nodes are hashed
+// with a different prefix byte so that one can never be passed off as the
+// other. This means a single piece can be checked against the signed root with
+// only log2(n) hashes, rather than the entire hash list.
+
+const HashSize = 32
+
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+var ErrProofIndex = errors.New("Piece index out of range of collection")
+
+// Hash a piece hash into a leaf of the tree.
+func MerkleLeaf(pieceHash []byte) []byte {
+	h := sha3.New256()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(pieceHash)
+
+	return h.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha3.New256()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+
+	return h.Sum(nil)
+}
+
+// The largest power of two that is smaller than n, n must be > 1.
+func merkleSplit(n int) int {
+	k := 1
+
+	for k<<1 < n {
+		k <<= 1
+	}
+
+	return k
+}
+
+// Returns the root of the tree built from a hash list, which is just piece
+// hashes concatenated together.
+func MerkleRoot(hashList []byte) []byte {
+	if len(hashList) == 0 {
+		h := sha3.Sum256(nil)
+		return h[:]
+	}
+
+	return merkleRoot(hashList, len(hashList)/HashSize)
+}
+
+func merkleRoot(hashList []byte, n int) []byte {
+	if n == 1 {
+		return MerkleLeaf(hashList[:HashSize])
+	}
+
+	k := merkleSplit(n)
+
+	return merkleNode(merkleRoot(hashList[:k*HashSize], k),
+		merkleRoot(hashList[k*HashSize:], n-k))
+}
+
+// Generates the audit path for the piece at the given index. The path is
+// ordered from the leaf upwards.
+func MerkleProof(hashList []byte, index int) ([][]byte, error) {
+	n := len(hashList) / HashSize
+
+	if index < 0 || index >= n {
+		return nil, ErrProofIndex
+	}
+
+	return merkleProof(hashList, index, n), nil
+}
+
+func merkleProof(hashList []byte, index, n int) [][]byte {
+	if n == 1 {
+		return make([][]byte, 0)
+	}
+
+	k := merkleSplit(n)
+
+	if index < k {
+		return append(merkleProof(hashList[:k*HashSize], index, k),
+			merkleRoot(hashList[k*HashSize:], n-k))
+	}
+
+	return append(merkleProof(hashList[k*HashSize:], index-k, n-k),
+		merkleRoot(hashList[:k*HashSize], k))
+}
+
+// Checks that the piece hash at index is part of a collection of size pieces
+// with the given root.
+func VerifyMerkleProof(root, pieceHash []byte, index, size int, proof [][]byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+
+	fn := index
+	sn := size - 1
+	r := MerkleLeaf(pieceHash)
+
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = merkleNode(p, r)
+
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNode(r, p)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(r, root)
+}
@@ -0,0 +1,151 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package data_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dfindex/dfi/data"
+	"golang.org/x/crypto/sha3"
+)
+
+func hashList(n int) []byte {
+	ret := make([]byte, 0, n*data.HashSize)
+
+	for i := 0; i < n; i++ {
+		h := sha3.Sum256([]byte{byte(i), byte(i >> 8)})
+		ret = append(ret, h[:]...)
+	}
+
+	return ret
+}
+
+func TestMerkleProof(t *testing.T) {
+	// include sizes that are not powers of two, these give unbalanced trees
+	for _, size := range []int{1, 2, 3, 5, 8, 13, 100} {
+		list := hashList(size)
+		root := data.MerkleRoot(list)
+
+		for i := 0; i < size; i++ {
+			proof, err := data.MerkleProof(list, i)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			leaf := list[i*data.HashSize : i*data.HashSize+data.HashSize]
+
+			if !data.VerifyMerkleProof(root, leaf, i, size, proof) {
+				t.Fatalf("Proof failed, size: %d index: %d", size, i)
+			}
+
+			// the same proof should not work for any other leaf
+			other := list[((i+1)%size)*data.HashSize : ((i+1)%size)*data.HashSize+data.HashSize]
+
+			if size > 1 && data.VerifyMerkleProof(root, other, i, size, proof) {
+				t.Fatalf("Proof verified wrong leaf, size: %d index: %d", size, i)
+			}
+		}
+	}
+}
+
+func TestMerkleProofOutOfRange(t *testing.T) {
+	list := hashList(4)
+
+	if _, err := data.MerkleProof(list, 4); err == nil {
+		t.Fatal("Proof generated for piece outside of collection")
+	}
+
+	if data.VerifyMerkleProof(data.MerkleRoot(list), list[:data.HashSize], 4, 4, nil) {
+		t.Fatal("Proof verified for piece outside of collection")
+	}
+}
+
+func TestCollectionAdd(t *testing.T) {
+	col := data.NewCollection()
+
+	for i := 0; i < 3; i++ {
+		piece := &data.Piece{Id: uint(i)}
+		piece.Setup()
+		piece.Add(data.Post{Id: i, InfoHash: "hash", Title: "title"}, false)
+
+		col.Add(piece)
+	}
+
+	if col.Size() != 3 {
+		t.Fatalf("Collection size incorrect: %d", col.Size())
+	}
+
+	if !bytes.Equal(col.Hash(), data.MerkleRoot(col.HashList)) {
+		t.Fatal("Collection root does not match hash list")
+	}
+
+	// replacing a piece should not grow the hash list
+	piece := &data.Piece{Id: 1}
+	piece.Setup()
+	piece.Add(data.Post{Id: 1, InfoHash: "other", Title: "title"}, false)
+
+	before := col.Hash()
+	col.Add(piece)
+
+	if col.Size() != 3 {
+		t.Fatalf("Collection grew on replace: %d", col.Size())
+	}
+
+	if bytes.Equal(before, col.Hash()) {
+		t.Fatal("Collection root did not change on replace")
+	}
+}
+
+func TestCollectionPut(t *testing.T) {
+	added := data.NewCollection()
+	put := data.NewCollection()
+
+	for i := 0; i < 5; i++ {
+		piece := &data.Piece{Id: uint(i)}
+		piece.Setup()
+		piece.Add(data.Post{Id: i, InfoHash: "hash", Title: "title"}, false)
+
+		added.Add(piece)
+		put.Put(piece)
+	}
+
+	if !bytes.Equal(put.HashList, added.HashList) {
+		t.Fatal("Put and Add built different hash lists")
+	}
+
+	// only once asked to
+	if bytes.Equal(put.Hash(), added.Hash()) {
+		t.Fatal("Put recomputed the root hash")
+	}
+
+	put.Rehash()
+
+	if !bytes.Equal(put.Hash(), added.Hash()) {
+		t.Fatal("Collection root does not match after rehashing")
+	}
+}
@@ -0,0 +1,123 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package data
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Posts are immutable once added, apart from seeders and leechers, but the
+// owner of an index may still need to retract or correct them. Every change is
+// recorded as a signed operation in an append-only log. Mirrors download the
+// log from the origin (or a seed), check the signatures against the origin's
+// public key, then apply the same operations to their own copy.
+const (
+	OpAdd       = "add"
+	OpTombstone = "tombstone"
+	OpAmend     = "amend"
+)
+
+type Operation struct {
+	// The position in the log, starting at 1. Operations must be applied in
+	// order.
+	Id     int
+	Type   string
+	PostId int
+	// The post after the operation has been applied. Empty for tombstones.
+	Post      Post
+	Created   int64
+	Signature []byte
+}
+
+// This is what gets signed.
+func (o *Operation) Bytes() []byte {
+	buf := bytes.Buffer{}
+
+	buf.WriteString(strconv.Itoa(o.Id))
+	buf.WriteString("|")
+	buf.WriteString(o.Type)
+	buf.WriteString("|")
+	buf.WriteString(strconv.Itoa(o.PostId))
+	buf.WriteString("|")
+	buf.WriteString(strconv.FormatInt(o.Created, 10))
+	buf.WriteString("|")
+
+	if o.Type != OpTombstone {
+		buf.Write(o.Post.Canonical())
+	}
+
+	return buf.Bytes()
+}
+
+// Anything that can sign an operation, a common.Signer will do. Package common
+// is not used here as it brings in dht, and with it cgo sqlite.
+type Signer interface {
+	Sign([]byte) []byte
+}
+
+func (o *Operation) Sign(s Signer) {
+	o.Signature = s.Sign(o.Bytes())
+}
+
+// Checks that the operation is well formed, and was signed by the given key.
+func (o *Operation) Verify(publicKey []byte) error {
+	switch o.Type {
+	case OpAdd, OpAmend:
+		if o.Post.Id != o.PostId {
+			return errors.New("Operation post id mismatch")
+		}
+
+		if err := o.Post.Valid(); err != nil {
+			return err
+		}
+
+	case OpTombstone:
+	default:
+		return errors.New("Unknown operation type")
+	}
+
+	if o.Id < 1 {
+		return errors.New("Invalid operation id")
+	}
+
+	if len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("Invalid public key")
+	}
+
+	if len(o.Signature) != ed25519.SignatureSize {
+		return errors.New("Signature too small")
+	}
+
+	if !ed25519.Verify(publicKey, o.Bytes(), o.Signature) {
+		return errors.New("Failed to verify operation signature")
+	}
+
+	return nil
+}
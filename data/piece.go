@@ -53,8 +53,7 @@ func (p *Piece) Add(post Post, store bool) error {
 		p.Posts = append(p.Posts, post)
 	}
 
-	data := post.String("|", "", false)
-	p.hash.Write([]byte(data))
+	p.hash.Write(post.Canonical())
 
 	return nil
 }
@@ -71,8 +70,7 @@ func (p *Piece) Rehash() ([]byte, error) {
 	p.hash = sha3.New256()
 
 	for _, i := range p.Posts {
-		data := i.Bytes([]byte("|"), []byte(""), false)
-		p.hash.Write([]byte(data))
+		p.hash.Write(i.Canonical())
 	}
 
 	log.Info("Piece rehashed")
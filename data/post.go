@@ -26,6 +26,7 @@ package data
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"io"
@@ -129,7 +130,42 @@ func (p *Post) Write(sep, term string, seedLeech bool, w io.Writer) {
 		bw.Flush()*/
 }
 
+// The form a post takes when it is hashed or signed. Strings are length
+// prefixed and integers fixed width, so unlike the text format no field can run
+// into another. Seeders and leechers are left out as they change over time.
+func (p *Post) Canonical() []byte {
+	buf := bytes.Buffer{}
+	scratch := make([]byte, binary.MaxVarintLen64)
+
+	writeInt := func(i int) {
+		binary.BigEndian.PutUint64(scratch, uint64(int64(i)))
+		buf.Write(scratch[:8])
+	}
+
+	writeString := func(s string) {
+		n := binary.PutUvarint(scratch, uint64(len(s)))
+		buf.Write(scratch[:n])
+		buf.WriteString(s)
+	}
+
+	writeInt(p.Id)
+	writeString(p.InfoHash)
+	writeString(p.Title)
+	writeInt(p.Size)
+	writeInt(p.FileCount)
+	writeInt(p.UploadDate)
+	writeString(p.Tags)
+	writeString(p.Meta)
+
+	return buf.Bytes()
+}
+
 func (p *Post) Valid() error {
+	// An empty title is how a tombstone is stored
+	if len(p.Title) == 0 {
+		return errors.New("Title required")
+	}
+
 	if len(p.Title) > 140 {
 		return errors.New("Title too long")
 	}
@@ -140,3 +176,20 @@ func (p *Post) Valid() error {
 
 	return nil
 }
+
+// Clears everything but the id, infohash and upload date. The row is kept so
+// that piece boundaries do not move, and the infohash so that it cannot just be
+// added again.
+func (p *Post) Tombstone() {
+	p.Title = ""
+	p.Size = 0
+	p.FileCount = 0
+	p.Seeders = 0
+	p.Leechers = 0
+	p.Tags = ""
+	p.Meta = ""
+}
+
+func (p *Post) IsTombstone() bool {
+	return p.Title == ""
+}
@@ -0,0 +1,393 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Searches may contain filters as well as text, for example:
+//
+//	ubuntu size:>1G tag:linux after:2016-01-01 files:<10 sort:seeders
+//
+// Anything that is not a filter, including words like Re:Zero that only look
+// like one, is matched against titles, tags and meta by the full text index.
+// Filters are compiled to parameterised SQL, only the columns and operators
+// below ever end up in the query string itself. Stores that are not backed by
+// SQL can use Match instead.
+
+const QueryDateFormat = "2006-01-02"
+
+var queryComparisons = []string{">=", "<=", ">", "<", "="}
+
+var querySizeUnits = map[byte]int{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+}
+
+// Relevance is the bm25 score of the title, tags and meta (weighted in that
+// order), scaled by up to twice as much again for well seeded posts. bm25 is
+// negative, lower is better.
+var querySorts = map[string]string{
+	"relevance": `bm25(fts_post, 10.0, 5.0, 1.0) *
+		(1.0 + ((post.seeders * 1.1) + post.leechers) /
+		((post.seeders * 1.1) + post.leechers + 100.0)) ASC`,
+	"seeders":  "((post.seeders * 1.1) + post.leechers) DESC",
+	"leechers": "post.leechers DESC",
+	"size":     "post.size DESC",
+	"files":    "post.file_count DESC",
+	"date":     "post.upload_date DESC",
+}
+
+// Columns that can be compared with numbers.
+var queryColumns = map[string]string{
+	"size":  "post.size",
+	"files": "post.file_count",
+	"date":  "post.upload_date",
+}
+
+// Every filter that can be given, others such as Re:Zero are searched as text.
+var queryFilters = map[string]bool{
+	"size":   true,
+	"files":  true,
+	"after":  true,
+	"before": true,
+	"tag":    true,
+	"sort":   true,
+}
+
+// Keys within meta that are searched, as well as titles and tags.
+// sql_index_fts in package sqlite must use the same keys.
+var SearchableMetaKeys = []string{"description", "category", "author", "language"}
+
+type queryFilter struct {
+	// Either one of queryColumns, or tag
+	field string
+	op    string
+	value int64
+	tag   string
+}
+
+type Query struct {
+	// Passed to the full text index
+	Text    string
+	Sort    string
+	filters []queryFilter
+}
+
+func ParseQuery(query string) (*Query, error) {
+	q := &Query{Sort: "relevance"}
+	text := make([]string, 0)
+
+	for _, word := range strings.Fields(query) {
+		sep := strings.Index(word, ":")
+
+		if sep < 1 {
+			text = append(text, word)
+			continue
+		}
+
+		key, value := strings.ToLower(word[:sep]), word[sep+1:]
+
+		if !queryFilters[key] {
+			text = append(text, word)
+			continue
+		}
+
+		if value == "" {
+			return nil, fmt.Errorf("No value given for %s", key)
+		}
+
+		var err error
+
+		switch key {
+		case "size":
+			err = q.compare("size", value, parseSize)
+		case "files":
+			err = q.compare("files", value, strconv.Atoi)
+		case "after":
+			err = q.date(">=", value)
+		case "before":
+			err = q.date("<", value)
+		case "tag":
+			if !IsAlnumWord(value) {
+				return nil, errors.New("Tags must be alphanumeric")
+			}
+
+			q.filters = append(q.filters, queryFilter{field: "tag", tag: value})
+		case "sort":
+			if _, ok := querySorts[strings.ToLower(value)]; !ok {
+				return nil, fmt.Errorf("Cannot sort by %s", value)
+			}
+
+			q.Sort = strings.ToLower(value)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	q.Text = strings.Join(text, " ")
+
+	return q, nil
+}
+
+// True if there is nothing to search for.
+func (q *Query) Empty() bool {
+	return q.Text == "" && len(q.filters) == 0
+}
+
+// Returns the statement and its arguments, which select post ids.
+func (q *Query) SQL(offset, count int) (string, []interface{}) {
+	clauses := make([]string, 0, len(q.filters)+1)
+	args := make([]interface{}, 0, len(q.filters)+3)
+
+	stmt := "SELECT post.id FROM post"
+	sort := q.Sort
+
+	if q.Text != "" {
+		stmt = "SELECT post.id FROM fts_post JOIN post ON post.id = fts_post.rowid"
+		clauses = append(clauses, "fts_post MATCH ?")
+		args = append(args, ftsQuery(q.Text))
+
+	} else {
+		// nothing to be relevant to
+		if sort == "relevance" {
+			sort = "seeders"
+		}
+
+		// tombstones are not in the full text index, but they are in post
+		clauses = append(clauses, "post.title != ''")
+	}
+
+	for _, i := range q.filters {
+		if i.field == "tag" {
+			// tags are stored comma separated
+			clauses = append(clauses, "(',' || post.tags || ',') LIKE ?")
+			args = append(args, "%,"+i.tag+",%")
+			continue
+		}
+
+		clauses = append(clauses, queryColumns[i.field]+" "+i.op+" ?")
+		args = append(args, i.value)
+	}
+
+	stmt = fmt.Sprintf("%s WHERE %s ORDER BY %s LIMIT ?,?", stmt,
+		strings.Join(clauses, " AND "), querySorts[sort])
+	args = append(args, offset, count)
+
+	return stmt, args
+}
+
+// Whether a post matches, for stores that cannot use SQL. Words match the
+// start of words in the title, tags or searchable meta, and filters are
+// checked as they would be in SQL. Tombstones never match.
+func (q *Query) Match(p *Post) bool {
+	if p.IsTombstone() {
+		return false
+	}
+
+	for _, i := range q.filters {
+		if !i.match(p) {
+			return false
+		}
+	}
+
+	if q.Text == "" {
+		return true
+	}
+
+	words := make(map[string]bool)
+
+	add := func(text string) {
+		for _, i := range strings.FieldsFunc(strings.ToLower(text), isSeparator) {
+			words[i] = true
+		}
+	}
+
+	add(p.Title)
+	add(p.Tags)
+
+	meta := make(map[string]interface{})
+
+	if json.Unmarshal([]byte(p.Meta), &meta) == nil {
+		for _, i := range SearchableMetaKeys {
+			if value, ok := meta[i].(string); ok {
+				add(value)
+			}
+		}
+	}
+
+	for _, i := range strings.FieldsFunc(strings.ToLower(q.Text), isSeparator) {
+		prefix := strings.HasSuffix(i, "*")
+		i = strings.TrimRight(i, "*")
+
+		found := words[i]
+
+		for word := range words {
+			if found || !prefix {
+				break
+			}
+
+			found = strings.HasPrefix(word, i)
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f queryFilter) match(p *Post) bool {
+	var n int64
+
+	switch f.field {
+	case "tag":
+		for _, i := range strings.Split(p.Tags, ",") {
+			if strings.EqualFold(i, f.tag) {
+				return true
+			}
+		}
+
+		return false
+	case "size":
+		n = int64(p.Size)
+	case "files":
+		n = int64(p.FileCount)
+	case "date":
+		n = int64(p.UploadDate)
+	}
+
+	switch f.op {
+	case ">=":
+		return n >= f.value
+	case "<=":
+		return n <= f.value
+	case ">":
+		return n > f.value
+	case "<":
+		return n < f.value
+	default:
+		return n == f.value
+	}
+}
+
+// Splits text into words the same way for posts and queries, the * is kept so
+// prefix searches still work.
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '*'
+}
+
+// Quotes every word, so punctuation (ubuntu-16.04) is tokenised rather than
+// read as fts5 syntax. A trailing * is kept as a prefix search.
+func ftsQuery(text string) string {
+	words := make([]string, 0)
+
+	for _, i := range strings.Fields(text) {
+		prefix := ""
+
+		if strings.HasSuffix(i, "*") {
+			prefix = "*"
+			i = strings.TrimRight(i, "*")
+		}
+
+		if i == "" {
+			continue
+		}
+
+		words = append(words, `"`+strings.Replace(i, `"`, `""`, -1)+`"`+prefix)
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Adds a comparison, ie >1G, <=10 or just 10.
+func (q *Query) compare(field, value string, parse func(string) (int, error)) error {
+	op := "="
+
+	for _, i := range queryComparisons {
+		if strings.HasPrefix(value, i) {
+			op = i
+			value = value[len(i):]
+			break
+		}
+	}
+
+	n, err := parse(value)
+
+	if err != nil {
+		return fmt.Errorf("Invalid number %s", value)
+	}
+
+	q.filters = append(q.filters, queryFilter{field: field, op: op, value: int64(n)})
+
+	return nil
+}
+
+func (q *Query) date(op, value string) error {
+	t, err := time.Parse(QueryDateFormat, value)
+
+	if err != nil {
+		return fmt.Errorf("Invalid date %s, use YYYY-MM-DD", value)
+	}
+
+	q.filters = append(q.filters, queryFilter{field: "date", op: op, value: t.Unix()})
+
+	return nil
+}
+
+// Sizes are in bytes, optionally with a K, M, G or T suffix (powers of 1024)
+// and a trailing B.
+func parseSize(value string) (int, error) {
+	value = strings.TrimSuffix(strings.ToUpper(value), "B")
+	multiplier := 1
+
+	if len(value) > 0 {
+		if m, ok := querySizeUnits[value[len(value)-1]]; ok {
+			multiplier = m
+			value = value[:len(value)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n * float64(multiplier)), nil
+}
@@ -0,0 +1,192 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package data_test
+
+import (
+	"testing"
+
+	"github.com/dfindex/dfi/data"
+)
+
+func TestParseQuery(t *testing.T) {
+	q, err := data.ParseQuery("ubuntu size:>1G tag:linux after:2016-01-01 files:<10 sort:date desktop")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Text != "ubuntu desktop" {
+		t.Fatal("Unexpected text: ", q.Text)
+	}
+
+	if q.Sort != "date" {
+		t.Fatal("Unexpected sort: ", q.Sort)
+	}
+}
+
+// Words that only look like filters are searched for.
+func TestParseQueryText(t *testing.T) {
+	q, err := data.ParseQuery("Re:Zero S01E01: http://example.com tag:anime")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Text != "Re:Zero S01E01: http://example.com" {
+		t.Fatal("Unexpected text: ", q.Text)
+	}
+
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		piece := &data.Piece{Id: 0}
+		piece.Setup()
+		piece.Add(testPost(1, "Re:Zero S01E01"), true)
+		piece.Add(testPost(2, "Zero Escape"), true)
+
+		if err := db.ReplacePiece(piece); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.GenerateFts(0); err != nil {
+			t.Fatal(err)
+		}
+
+		posts, err := db.Search("Re:Zero S01E01:", 0, 10)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkIds(t, "Re:Zero", posts, 1)
+	})
+}
+
+func TestParseQueryInvalid(t *testing.T) {
+	invalid := []string{
+		"size:>big",
+		"after:yesterday",
+		"tag:a'b",
+		"sort:title",
+		"size:",
+	}
+
+	for _, i := range invalid {
+		if _, err := data.ParseQuery(i); err == nil {
+			t.Fatal("Accepted invalid query: ", i)
+		}
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		piece := &data.Piece{Id: 0}
+		piece.Setup()
+
+		small := testPost(1, "ubuntu")
+		small.Size = 1 << 20
+		small.Tags = "linux,iso"
+
+		large := testPost(2, "ubuntu")
+		large.Size = 2 << 30
+		large.Tags = "linux"
+
+		piece.Add(small, true)
+		piece.Add(large, true)
+
+		if err := db.ReplacePiece(piece); err != nil {
+			t.Fatal(err)
+		}
+
+		check := func(query string, ids ...int) {
+			posts, err := db.Search(query, 0, 10)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(posts) != len(ids) {
+				t.Fatalf("%s: expected %d results, got %d", query, len(ids), len(posts))
+			}
+
+			for n, i := range ids {
+				if posts[n].Id != i {
+					t.Fatalf("%s: unexpected result %d", query, posts[n].Id)
+				}
+			}
+		}
+
+		check("ubuntu size:>1G", 2)
+		check("ubuntu size:<=1M", 1)
+		check("tag:iso", 1)
+		check("tag:linux sort:size", 2, 1)
+		check("ubuntu tag:lin")
+	})
+}
+
+func TestSearchTagsAndMeta(t *testing.T) {
+	eachStore(t, func(t *testing.T, db data.PostStore) {
+		piece := &data.Piece{Id: 0}
+		piece.Setup()
+
+		tagged := testPost(1, "debian")
+		tagged.Tags = "linux,iso"
+
+		described := testPost(2, "arch")
+		described.Meta = `{"description": "a linux distribution", "url": "penguin"}`
+
+		piece.Add(tagged, true)
+		piece.Add(described, true)
+
+		if err := db.ReplacePiece(piece); err != nil {
+			t.Fatal(err)
+		}
+
+		posts, err := db.Search("linux", 0, 10)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(posts) != 2 {
+			t.Fatal("Tags and meta were not indexed")
+		}
+
+		// only searchable meta keys are indexed
+		posts, err = db.Search("penguin", 0, 10)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(posts) != 0 {
+			t.Fatal("Indexed a meta key that is not searchable")
+		}
+
+		// punctuation is not fts syntax
+		if _, err = db.Search("ubuntu-16.04 (amd64)", 0, 10); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -28,6 +28,7 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 	"unicode"
 )
@@ -46,6 +47,51 @@ type SearchResult struct {
 	Source string  `json:"source"`
 }
 
+// A single hit from a federated search, along with every source that returned
+// it. Sources are addresses, our own included.
+type FederatedResult struct {
+	Post    *Post    `json:"post"`
+	Sources []string `json:"sources"`
+	Score   float64  `json:"score"`
+}
+
+// Dampens how much the top few results of each source dominate when merging,
+// see reciprocal rank fusion.
+const RankFusionK = 60
+
+// Merges results from several sources into one ranking. Posts are deduplicated
+// by infohash, each source adds 1/(RankFusionK + rank) to the score of every
+// post it returned, so posts found near the top by many sources rank highest.
+func MergeResults(results []SearchResult) []*FederatedResult {
+	merged := make(map[string]*FederatedResult)
+	ret := make([]*FederatedResult, 0)
+
+	for _, result := range results {
+		for rank, post := range result.Posts {
+			fr, ok := merged[post.InfoHash]
+
+			if !ok {
+				fr = &FederatedResult{Post: post}
+				merged[post.InfoHash] = fr
+				ret = append(ret, fr)
+			}
+
+			fr.Sources = append(fr.Sources, result.Source)
+			fr.Score += 1 / float64(RankFusionK+rank+1)
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Score != ret[j].Score {
+			return ret[i].Score > ret[j].Score
+		}
+
+		return ret[i].Post.Seeders > ret[j].Post.Seeders
+	})
+
+	return ret
+}
+
 func NewSearchProvider() *SearchProvider {
 	sp := &SearchProvider{true}
 
@@ -79,7 +125,7 @@ func SanitiseForAuto(in string) string {
 	return buffer.String()
 }
 
-func (sp *SearchProvider) Suggest(db *Database, query string) ([]string, error) {
+func (sp *SearchProvider) Suggest(db PostStore, query string) ([]string, error) {
 	checked, err := db.Suggest(fmt.Sprintf("%s%%", query))
 
 	if err != nil {
@@ -95,7 +141,7 @@ func (sp *SearchProvider) Suggest(db *Database, query string) ([]string, error)
 	return ret, nil
 }
 
-func (sp *SearchProvider) Search(source string, db *Database, query string, page int) (SearchResult, error) {
+func (sp *SearchProvider) Search(source string, db PostStore, query string, page int) (SearchResult, error) {
 	// TODO: Instead of searching for spell-corrected versions, suggest an
 	// alternate search.
 	results, err := db.Search(query, page, 25)
@@ -22,14 +22,19 @@
 // OTHER DEALINGS IN THE SOFTWARE.
 
 // For more information, please refer to <http://unlicense.org/>
-package data
+package sqlite
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/util"
 )
 
 type Database struct {
@@ -59,29 +64,57 @@ func (db *Database) Connect() error {
 
 	//db.conn.SetMaxOpenConns(1)
 
-	_, err = db.conn.Exec(sql_create_post_table)
-	if err != nil {
-		return err
-	}
+	return util.Migrate(db.conn, Migrations)
+}
 
-	_, err = db.conn.Exec(sql_create_fts_post)
-	if err != nil {
-		return err
-	}
+// Inserts a piece into the database. All the posts are iterated over and inserted
+// within a single SQL transaction.
+func (db *Database) InsertPiece(piece *data.Piece) (err error) {
+	tx, err := db.conn.Begin()
 
-	_, err = db.conn.Exec(sql_create_upload_date_index)
-	if err != nil {
-		return err
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	for _, i := range piece.Posts {
+		_, err = tx.Exec(sql_insert_post, i.InfoHash, i.Title, i.Size, i.FileCount,
+			i.Seeders, i.Leechers, i.UploadDate, i.Tags, i.Meta)
+
+		if err != nil {
+			return
+		}
 	}
 
-	return nil
+	return
 }
 
-// Inserts a piece into the database. All the posts are iterated over and inserted
-// within a single SQL transaction.
-func (db *Database) InsertPiece(piece *Piece) (err error) {
+// Replaces every post in the range covered by the piece with the posts in the
+// piece, then reindexes just that range. Post ids are kept, and must all fall
+// within the piece.
+func (db *Database) ReplacePiece(piece *data.Piece) (err error) {
+	start := int(piece.Id) * data.PieceSize
+	end := start + data.PieceSize
+
+	last := start
+	for _, i := range piece.Posts {
+		if i.Id <= last || i.Id > end {
+			return errors.New("Post id outside of piece")
+		}
+
+		last = i.Id
+	}
+
 	tx, err := db.conn.Begin()
 
+	if err != nil {
+		return err
+	}
+
 	defer func() {
 		if err != nil {
 			tx.Rollback()
@@ -91,22 +124,36 @@ func (db *Database) InsertPiece(piece *Piece) (err error) {
 		err = tx.Commit()
 	}()
 
+	_, err = tx.Exec(sql_delete_fts_range, start, end)
+
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(sql_delete_post_range, start, end)
+
+	if err != nil {
+		return
+	}
+
 	for _, i := range piece.Posts {
-		_, err = tx.Exec(sql_insert_post, i.InfoHash, i.Title, i.Size, i.FileCount,
-			i.Seeders, i.Leechers, i.UploadDate, i.Tags)
+		_, err = tx.Exec(sql_replace_post, i.Id, i.InfoHash, i.Title, i.Size,
+			i.FileCount, i.Seeders, i.Leechers, i.UploadDate, i.Tags, i.Meta)
 
 		if err != nil {
 			return
 		}
 	}
 
+	_, err = tx.Exec(sql_index_fts_range, start, end)
+
 	return
 }
 
 // Insert pieces from a channel, good for streaming them from a network or something.
 // The fts bool is whether or not a fts index will be generated on every transaction
 // commit. Transactions contain 100 pieces, or 100,000 posts.
-func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
+func (db *Database) InsertPieces(pieces chan *data.Piece, fts bool) (err error) {
 	tx, err := db.conn.Begin()
 	startPosts := db.PostCount()
 
@@ -177,8 +224,9 @@ func (db *Database) InsertPieces(pieces chan *Piece, fts bool) (err error) {
 	return
 }
 
-// Insert a single post into the database.
-func (db *Database) InsertPost(post Post) (int64, error) {
+// Insert a single post into the database. Fails with data.ErrDuplicatePost if
+// the infohash is already there.
+func (db *Database) InsertPost(post data.Post) (int64, error) {
 	// TODO: Is preparing all statements before hand worth doing for perf?
 	stmt, err := db.conn.Prepare(sql_insert_post)
 	if err != nil {
@@ -192,31 +240,52 @@ func (db *Database) InsertPost(post Post) (int64, error) {
 		return -1, err
 	}
 
-	id, err := res.LastInsertId()
+	// INSERT OR IGNORE, LastInsertId would be whatever was inserted before
+	inserted, err := res.RowsAffected()
+
+	if err != nil {
+		return -1, err
+	}
 
-	return id, nil
+	if inserted == 0 {
+		return -1, data.ErrDuplicatePost
+	}
+
+	return res.LastInsertId()
 }
 
-// Generate a full text search index since the given id. This should ideally be
-// done only for new additions, otherwise on a large dataset it can take a bit of
-// time.
+// (Re)generate the full text search index for every post with an id of at least
+// since. This should ideally be done only for new additions, otherwise on a
+// large dataset it can take a bit of time.
 func (db *Database) GenerateFts(since int64) error {
-	stmt, err := db.conn.Prepare(sql_generate_fts)
+	tx, err := db.conn.Begin()
 
 	if err != nil {
 		return err
 	}
 
-	stmt.Exec(since)
+	_, err = tx.Exec(sql_delete_fts_since, since)
 
-	return nil
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(sql_generate_fts, since)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // Performs a query upon the database where the only arguments are the page range.
 // This is useful for thing such as popular and recent posts.
-func (db *Database) PaginatedQuery(query string, page int) ([]*Post, error) {
+func (db *Database) PaginatedQuery(query string, page int) ([]*data.Post, error) {
 	page_size := 25
-	posts := make([]*Post, 0, page_size)
+	posts := make([]*data.Post, 0, page_size)
 
 	rows, err := db.conn.Query(query, page_size*page,
 		page_size)
@@ -226,7 +295,7 @@ func (db *Database) PaginatedQuery(query string, page int) ([]*Post, error) {
 	}
 
 	for rows.Next() {
-		var post Post
+		var post data.Post
 
 		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
 			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
@@ -243,23 +312,38 @@ func (db *Database) PaginatedQuery(query string, page int) ([]*Post, error) {
 }
 
 // Returns a page of posts ordered by upload data, descending.
-func (db *Database) QueryRecent(page int) ([]*Post, error) {
+func (db *Database) QueryRecent(page int) ([]*data.Post, error) {
 	return db.PaginatedQuery(sql_query_recent_post, page)
 }
 
 // Returns a page of posts ordered by popularity, descending.
 // Popularity is a combination of seeders and leechers, weighted ever so slightly
 // towards seeders.
-func (db *Database) QueryPopular(page int) ([]*Post, error) {
+func (db *Database) QueryPopular(page int) ([]*data.Post, error) {
 	return db.PaginatedQuery(sql_query_popular_post, page)
 }
 
-// Perform a query on the FTS table. The results returned are used to pull actual
-// results out of the post table, and these are returned.
-func (db *Database) Search(query string, page, pageSize int) ([]*Post, error) {
-	posts := make([]*Post, 0, pageSize)
-	rows, err := db.conn.Query(sql_search_post, query, page*pageSize,
-		pageSize)
+// Searches posts, the query may contain filters as well as text. See
+// data.ParseQuery.
+func (db *Database) Search(query string, page, pageSize int) ([]*data.Post, error) {
+	q, err := data.ParseQuery(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return db.SearchQuery(q, page, pageSize)
+}
+
+func (db *Database) SearchQuery(q *data.Query, page, pageSize int) ([]*data.Post, error) {
+	posts := make([]*data.Post, 0, pageSize)
+
+	if q.Empty() {
+		return posts, nil
+	}
+
+	stmt, args := q.SQL(page*pageSize, pageSize)
+	rows, err := db.conn.Query(stmt, args...)
 
 	if err != nil {
 		return nil, err
@@ -288,8 +372,8 @@ func (db *Database) Search(query string, page, pageSize int) ([]*Post, error) {
 }
 
 // Return a single post given it's id.
-func (db *Database) QueryPostId(id uint) (Post, error) {
-	var post Post
+func (db *Database) QueryPostId(id uint) (data.Post, error) {
+	var post data.Post
 	rows, err := db.conn.Query(sql_query_post_id, id)
 
 	if err != nil {
@@ -310,11 +394,26 @@ func (db *Database) QueryPostId(id uint) (Post, error) {
 	return post, nil
 }
 
+// Return the post with the given infohash, or an empty post if there is none.
+func (db *Database) QueryInfoHash(infoHash string) (data.Post, error) {
+	var post data.Post
+
+	err := db.conn.QueryRow(sql_query_post_info_hash, infoHash).Scan(&post.Id,
+		&post.InfoHash, &post.Title, &post.Size, &post.FileCount, &post.Seeders,
+		&post.Leechers, &post.UploadDate, &post.Tags, &post.Meta)
+
+	if err == sql.ErrNoRows {
+		return post, nil
+	}
+
+	return post, err
+}
+
 // Return a single piece given it's id. Optionally store the posts as well,
 // otherwise we just get a hash.
-func (db *Database) QueryPiece(id uint, store bool) (*Piece, error) {
-	page_size := PieceSize // TODO: Configure this elsewhere
-	var piece Piece
+func (db *Database) QueryPiece(id uint, store bool) (*data.Piece, error) {
+	page_size := data.PieceSize // TODO: Configure this elsewhere
+	var piece data.Piece
 	piece.Setup()
 	piece.Id = id
 
@@ -327,7 +426,7 @@ func (db *Database) QueryPiece(id uint, store bool) (*Piece, error) {
 
 	for rows.Next() {
 
-		var post Post
+		var post data.Post
 
 		err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
 			&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
@@ -346,15 +445,15 @@ func (db *Database) QueryPiece(id uint, store bool) (*Piece, error) {
 // Very simmilar to QueryPiece, except this returns a channel and streams posts
 // out as they arrive. Queries a range of posts, so you can ask for 100 posts
 // starting at an id.
-func (db *Database) QueryPiecePosts(start, length int, store bool) chan *Post {
-	ret := make(chan *Post)
-	page_size := PieceSize // TODO: Configure this elsewhere
+func (db *Database) QueryPiecePosts(start, length int, store bool) chan *data.Post {
+	ret := make(chan *data.Post)
+	page_size := data.PieceSize // TODO: Configure this elsewhere
 
 	go func() {
 		defer close(ret)
 
 		rows, err := db.conn.Query(sql_query_paged_post, start*page_size,
-			start+page_size*length)
+			page_size*length)
 
 		if err != nil {
 			return
@@ -362,7 +461,7 @@ func (db *Database) QueryPiecePosts(start, length int, store bool) chan *Post {
 
 		for rows.Next() {
 
-			var post Post
+			var post data.Post
 
 			err := rows.Scan(&post.Id, &post.InfoHash, &post.Title, &post.Size,
 				&post.FileCount, &post.Seeders, &post.Leechers, &post.UploadDate,
@@ -460,6 +559,162 @@ func (db *Database) SetLeechers(id, leechers uint) error {
 	return err
 }
 
+// Applies an operation to the post table, and appends it to the operation log.
+// Both happen in the same transaction, so the log never disagrees with the
+// posts. Operations already in the log are skipped.
+func (db *Database) ApplyOperation(op *data.Operation) error {
+	return db.ApplyOperations([]*data.Operation{op})
+}
+
+// Applies a batch of operations in a single transaction, if any fail none are
+// applied.
+func (db *Database) ApplyOperations(ops []*data.Operation) (err error) {
+	last := db.LastOperation()
+
+	tx, err := db.conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	for _, op := range ops {
+		if op.Id <= last {
+			continue
+		}
+
+		err = applyOperation(tx, op)
+
+		if err != nil {
+			return
+		}
+
+		last = op.Id
+	}
+
+	return
+}
+
+func applyOperation(tx *sql.Tx, op *data.Operation) (err error) {
+	post := ""
+
+	switch op.Type {
+	case data.OpAdd:
+		// a piece may already hold the post, amended since, which is kept
+		p := op.Post
+		_, err = tx.Exec(sql_insert_post_id, op.PostId, p.InfoHash, p.Title, p.Size,
+			p.FileCount, p.Seeders, p.Leechers, p.UploadDate, p.Tags, p.Meta)
+
+	case data.OpTombstone:
+		_, err = tx.Exec(sql_delete_fts_post, op.PostId)
+
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec(sql_tombstone_post, op.PostId)
+
+	case data.OpAmend:
+		p := op.Post
+		_, err = tx.Exec(sql_delete_fts_post, op.PostId)
+
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec(sql_amend_post, p.InfoHash, p.Title, p.Size, p.FileCount,
+			p.UploadDate, p.Tags, p.Meta, op.PostId)
+
+		// another post already has the infohash
+		if e, ok := err.(sqlite3.Error); ok && e.ExtendedCode == sqlite3.ErrConstraintUnique {
+			err = data.ErrDuplicatePost
+		}
+
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec(sql_index_fts_post, op.PostId)
+
+	default:
+		err = errors.New("Unknown operation type")
+	}
+
+	if err != nil {
+		return
+	}
+
+	if op.Type != data.OpTombstone {
+		var dat []byte
+		dat, err = op.Post.Json()
+
+		if err != nil {
+			return
+		}
+
+		post = string(dat)
+	}
+
+	_, err = tx.Exec(sql_insert_post_op, op.Id, op.Type, op.PostId, post,
+		op.Created, op.Signature)
+
+	return
+}
+
+// Returns up to count operations from the log, after the given id.
+func (db *Database) QueryOperations(since, count int) ([]*data.Operation, error) {
+	ops := make([]*data.Operation, 0, count)
+
+	rows, err := db.conn.Query(sql_query_post_ops, since, count)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var op data.Operation
+		var post string
+
+		err := rows.Scan(&op.Id, &op.Type, &op.PostId, &post, &op.Created,
+			&op.Signature)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if post != "" {
+			err = json.Unmarshal([]byte(post), &op.Post)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		ops = append(ops, &op)
+	}
+
+	return ops, nil
+}
+
+// The id of the last operation in the log, 0 if it is empty.
+func (db *Database) LastOperation() int {
+	var res int
+
+	db.conn.QueryRow(sql_last_post_op).Scan(&res)
+
+	return res
+}
+
 // Close the database connection.
 func (db *Database) Close() {
 	db.conn.Close()
@@ -0,0 +1,226 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package sqlite_test
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/data/sqlite"
+	"github.com/dfindex/dfi/util"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testDatabase(t *testing.T) (*sqlite.Database, func()) {
+	dir, err := ioutil.TempDir("", "dfi")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := sqlite.NewDatabase(filepath.Join(dir, "posts.db"))
+
+	if err := db.Connect(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func testPost(id int, title string) data.Post {
+	return data.Post{
+		Id:         id,
+		InfoHash:   strconv.Itoa(id) + title,
+		Title:      title,
+		Size:       1,
+		FileCount:  1,
+		UploadDate: 1,
+	}
+}
+
+func TestReplacePiece(t *testing.T) {
+	db, cleanup := testDatabase(t)
+	defer cleanup()
+
+	old := &data.Piece{Id: 0}
+	old.Setup()
+
+	for i := 1; i <= 3; i++ {
+		old.Add(testPost(i, "old"), true)
+	}
+
+	if err := db.ReplacePiece(old); err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := &data.Piece{Id: 0}
+	replacement.Setup()
+	replacement.Add(testPost(1, "old"), true)
+	replacement.Add(testPost(2, "new"), true)
+
+	if err := db.ReplacePiece(replacement); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := db.QueryPiece(0, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored.Posts) != 2 || stored.Posts[1].Title != "new" {
+		t.Fatal("Piece was not replaced")
+	}
+
+	if !bytes.Equal(stored.Hash(), replacement.Hash()) {
+		t.Fatal("Replaced piece hash mismatch")
+	}
+
+	results, err := db.Search("new", 0, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].Id != 2 {
+		t.Fatal("Replaced post was not reindexed")
+	}
+}
+
+func TestReplacePieceOutOfRange(t *testing.T) {
+	db, cleanup := testDatabase(t)
+	defer cleanup()
+
+	piece := &data.Piece{Id: 1}
+	piece.Setup()
+	piece.Add(testPost(1, "wrong piece"), true)
+
+	if db.ReplacePiece(piece) == nil {
+		t.Fatal("Accepted a post from another piece")
+	}
+}
+
+// Runs a fixture script against a new database file, returning its path.
+func loadFixture(t *testing.T, dir, fixture string) string {
+	script, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "posts.db")
+	conn, err := sql.Open("sqlite3", path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if _, err = conn.Exec(string(script)); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfi")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	db := sqlite.NewDatabase(loadFixture(t, dir, "posts-unversioned.sql"))
+
+	if err := db.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// the fts4 index only covered titles
+	posts, err := db.Search("installer", 0, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posts) != 1 || posts[0].Id != 2 {
+		t.Fatal("Index was not rebuilt")
+	}
+
+	if db.LastOperation() != 0 {
+		t.Fatal("Operation log was not created")
+	}
+}
+
+func TestMigrateTooNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfi")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := loadFixture(t, dir, "posts-unversioned.sql")
+	latest := util.LatestVersion(sqlite.Migrations)
+
+	conn, err := sql.Open("sqlite3", path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Exec(`CREATE TABLE schema_version(version INTEGER NOT NULL);
+		INSERT INTO schema_version VALUES(?)`, latest+1)
+	conn.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if util.CheckSchema(path, sqlite.Migrations) == nil {
+		t.Fatal("Schema check passed a newer database")
+	}
+
+	if sqlite.NewDatabase(path).Connect() != util.ErrSchemaTooNew {
+		t.Fatal("Connected to a newer database")
+	}
+}
@@ -0,0 +1,67 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package sqlite
+
+import (
+	"database/sql"
+
+	"github.com/dfindex/dfi/util"
+)
+
+// Migrations for posts.db, mirrors included. Never change one that has been
+// released, add another to the end instead.
+var Migrations = []util.Migration{
+	{
+		Version: 1,
+		Name:    "posts",
+		Up: util.MigrateSQL(
+			sql_create_post_table,
+			sql_create_upload_date_index,
+		),
+	},
+	{
+		Version: 2,
+		Name:    "operation log",
+		Up:      util.MigrateSQL(sql_create_post_op_table),
+	},
+	{
+		// Replaces the fts4 index of titles. The index is rebuilt whatever was
+		// there before.
+		Version: 3,
+		Name:    "fts5 index of titles, tags and meta",
+		Up: func(tx *sql.Tx) error {
+			err := util.MigrateSQL(sql_drop_fts_post, sql_create_fts_post)(tx)
+
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(sql_generate_fts, 0)
+
+			return err
+		},
+	},
+}
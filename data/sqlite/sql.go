@@ -22,7 +22,7 @@
 // OTHER DEALINGS IN THE SOFTWARE.
 
 // For more information, please refer to <http://unlicense.org/>
-package data
+package sqlite
 
 const sql_create_post_table string = `CREATE TABLE IF NOT EXISTS 
 										post(
@@ -38,14 +38,47 @@ const sql_create_post_table string = `CREATE TABLE IF NOT EXISTS
 											meta STRING
 										)`
 
+// The full text index stores its own copy of the text, rather than using post
+// as external content, so rows can be removed without the original values.
+// Tags are stored space separated, and meta is reduced to the values of the keys
+// in SearchableMetaKeys.
 const sql_create_fts_post string = `CREATE VIRTUAL TABLE IF NOT EXISTS
-									fts_post using fts4(
-										content="post",
+									fts_post using fts5(
 										title,
-										seeders,
-										leechers
+										tags,
+										meta
 									)`
 
+const sql_drop_fts_post = `DROP TABLE IF EXISTS fts_post`
+
+// Everything that goes into the full text index for a post. Tombstones are left
+// out.
+const sql_index_fts = `INSERT INTO fts_post(
+							rowid,
+							title,
+							tags,
+							meta)
+						SELECT id, title, replace(tags, ',', ' '),
+							CASE WHEN json_valid(meta) AND json_type(meta) = 'object' THEN
+								(SELECT group_concat(value, ' ') FROM json_each(post.meta)
+								WHERE type = 'text' AND
+								key IN ('description', 'category', 'author', 'language'))
+							ELSE '' END
+						FROM post
+						WHERE title != '' AND `
+
+// The signed log of adds, tombstones and amendments. The id is the position in
+// the origin's log, so mirrors insert it as is.
+const sql_create_post_op_table string = `CREATE TABLE IF NOT EXISTS
+										post_op(
+											id INTEGER PRIMARY KEY NOT NULL,
+											type STRING NOT NULL,
+											post_id INTEGER NOT NULL,
+											post STRING,
+											created INTEGER NOT NULL,
+											signature BLOB NOT NULL
+										)`
+
 const sql_create_upload_date_index string = `CREATE INDEX IF NOT EXISTS
 											port_upload_date_index
 											ON post(upload_date)`
@@ -62,24 +95,36 @@ const sql_insert_post string = `INSERT OR IGNORE INTO post(
 									meta
 								) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
+// Used when replaying the operation log, where the id must match the origin.
+const sql_insert_post_id string = `INSERT OR IGNORE INTO post(
+									id,
+									info_hash,
+									title,
+									size,
+									file_count,
+									seeders,
+									leechers,
+									upload_date,
+									tags,
+									meta
+								) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
 const sql_attach_meta string = `UPDATE POST
 								SET meta=?
 								WHERE id=?`
 
-const sql_generate_fts string = `INSERT OR IGNORE INTO fts_post(
-								docid,
-								title,
-								seeders,
-								leechers)
-							SELECT id, title, seeders, leechers FROM post 
-							WHERE id >= ?`
+const sql_generate_fts = sql_index_fts + `id >= ?`
+
+const sql_delete_fts_since = `DELETE FROM fts_post WHERE rowid >= ?`
 
 const sql_query_recent_post string = `SELECT 	 * FROM post
+												 WHERE title != ''
 												 ORDER BY upload_date DESC
 												 LIMIT ?,?`
 
 const sql_query_popular_post string = ` SELECT * FROM(
 													SELECT * FROM post 
+													WHERE title != ''
 													ORDER BY upload_date DESC
 													LIMIT 10000
 												)
@@ -89,6 +134,9 @@ const sql_query_popular_post string = ` SELECT * FROM(
 const sql_query_post_id string = `SELECT 	 * FROM post
 												 WHERE id = ?`
 
+const sql_query_post_info_hash string = `SELECT * FROM post
+											WHERE info_hash = ?`
+
 const sql_query_paged_post string = `SELECT 	 * FROM post
 												 WHERE id > ?
 												 LIMIT 0,?`
@@ -96,11 +144,6 @@ const sql_query_paged_post string = `SELECT 	 * FROM post
 // Seeders are weighted, things with more seeders are better than things with
 // more leechers, though both are important.
 // (for one, seeders DO still upload, and are indicative of popularity)
-const sql_search_post string = `SELECT docid FROM fts_post
-									WHERE title MATCH ?
-									ORDER BY ((seeders * 1.1) + leechers) DESC
-									LIMIT ?,?`
-
 const sql_suggest_posts string = `SELECT title FROM (
 										SELECT * FROM post
 										ORDER BY upload_date DESC
@@ -112,6 +155,68 @@ const sql_suggest_posts string = `SELECT title FROM (
 
 const sql_count_post = `SELECT MAX(id) FROM post`
 
+const sql_insert_post_op = `INSERT OR IGNORE INTO post_op(
+								id,
+								type,
+								post_id,
+								post,
+								created,
+								signature
+							) VALUES(?, ?, ?, ?, ?, ?)`
+
+const sql_query_post_ops = `SELECT * FROM post_op
+								WHERE id > ?
+								ORDER BY id ASC
+								LIMIT 0,?`
+
+const sql_last_post_op = `SELECT IFNULL(MAX(id), 0) FROM post_op`
+
+// Removes a post from the full text index, before it is changed or cleared.
+const sql_delete_fts_post = `DELETE FROM fts_post WHERE rowid=?`
+
+const sql_index_fts_post = sql_index_fts + `id = ?`
+
+const sql_tombstone_post = `UPDATE post SET
+								title='',
+								size=0,
+								file_count=0,
+								seeders=0,
+								leechers=0,
+								tags='',
+								meta=''
+							WHERE id=?`
+
+const sql_amend_post = `UPDATE post SET
+							info_hash=?,
+							title=?,
+							size=?,
+							file_count=?,
+							upload_date=?,
+							tags=?,
+							meta=?
+						WHERE id=?`
+
+// Used when a mirror replaces a whole piece. Ids are kept as they are on the
+// remote peer so pieces line up.
+const sql_delete_fts_range = `DELETE FROM fts_post WHERE rowid > ? AND rowid <= ?`
+
+const sql_delete_post_range = `DELETE FROM post WHERE id > ? AND id <= ?`
+
+const sql_replace_post = `INSERT OR REPLACE INTO post(
+								id,
+								info_hash,
+								title,
+								size,
+								file_count,
+								seeders,
+								leechers,
+								upload_date,
+								tags,
+								meta
+							) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+const sql_index_fts_range = sql_index_fts + `id > ? AND id <= ?`
+
 const sql_update_seed_leecth = `UPDATE post
 								SET seeders=?
 								WHERE id=?`
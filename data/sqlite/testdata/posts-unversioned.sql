@@ -0,0 +1,28 @@
+-- posts.db as created before schema versioning, with the fts4 title index.
+CREATE TABLE post(
+	id INTEGER PRIMARY KEY NOT NULL,
+	info_hash STRING UNIQUE,
+	title STRING NOT NULL,
+	size INTEGER NOT NULL,
+	file_count INTEGER NOT NULL,
+	seeders INTEGER NOT NULL,
+	leechers INTEGER NOT NULL,
+	upload_date INTEGER NOT NULL,
+	tags STRING,
+	meta STRING
+);
+
+CREATE VIRTUAL TABLE fts_post using fts4(
+	content="post",
+	title,
+	seeders,
+	leechers
+);
+
+CREATE INDEX port_upload_date_index ON post(upload_date);
+
+INSERT INTO post VALUES(1, 'aaaa', 'ubuntu desktop', 1024, 1, 10, 2, 1451606400, 'linux,iso', '');
+INSERT INTO post VALUES(2, 'bbbb', 'debian netinst', 2048, 1, 5, 1, 1451606400, 'linux', '{"description": "small installer"}');
+
+INSERT INTO fts_post(docid, title, seeders, leechers)
+	SELECT id, title, seeders, leechers FROM post;
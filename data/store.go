@@ -0,0 +1,64 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package data
+
+import "errors"
+
+// Infohashes are unique, a post cannot be added twice.
+var ErrDuplicatePost = errors.New("A post with that infohash already exists")
+
+// Everything a node needs from wherever its posts are kept. sqlite.Database is
+// backed by SQLite, MemoryStore keeps everything in memory for tests and
+// lightweight nodes that do not need to persist an index. Only the former needs
+// cgo, so it lives in its own package.
+type PostStore interface {
+	InsertPost(post Post) (int64, error)
+	InsertPiece(piece *Piece) error
+	InsertPieces(pieces chan *Piece, fts bool) error
+	ReplacePiece(piece *Piece) error
+	GenerateFts(since int64) error
+
+	Search(query string, page, pageSize int) ([]*Post, error)
+	SearchQuery(q *Query, page, pageSize int) ([]*Post, error)
+	Suggest(query string) ([]string, error)
+	QueryRecent(page int) ([]*Post, error)
+	QueryPopular(page int) ([]*Post, error)
+	QueryPostId(id uint) (Post, error)
+	QueryInfoHash(infoHash string) (Post, error)
+	QueryPiece(id uint, store bool) (*Piece, error)
+	QueryPiecePosts(start, length int, store bool) chan *Post
+	PostCount() uint
+
+	AddMeta(pid int, value string) error
+	SetSeeders(id, seeders uint) error
+	SetLeechers(id, leechers uint) error
+
+	ApplyOperation(op *Operation) error
+	ApplyOperations(ops []*Operation) error
+	QueryOperations(since, count int) ([]*Operation, error)
+	LastOperation() int
+
+	Close()
+}
@@ -129,6 +129,30 @@ func RandomAddress() (*Address, error) {
 	return &addr, err
 }
 
+// Generates a random address that falls into the given bucket of self's
+// routing table, it shares the first index bits with self and differs on the
+// next one.
+func RandomAddressInBucket(self Address, index int) (*Address, error) {
+	raw, err := util.CryptoRandBytes(len(self.Raw))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i <= index && i < len(raw)*8; i++ {
+		mask := byte(0x80 >> uint8(i%8))
+		bit := self.Raw[i/8] & mask
+
+		if i == index {
+			bit ^= mask
+		}
+
+		raw[i/8] = raw[i/8]&^mask | bit
+	}
+
+	return &Address{Raw: raw}, nil
+}
+
 // Generate a DFI address from a public key.
 // This process involves one SHA3-256 iteration, followed by BLAKE2. This is
 // similar to bitcoin, and the BLAKE2 makes the resulting address a bit shorter
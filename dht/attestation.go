@@ -0,0 +1,184 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// How long a seed attestation is trusted for, seeds are expected to renew
+// theirs well before this.
+var AttestationTTL = time.Hour * 24
+
+// A seed's signed claim that it holds a collection for another address at a
+// given time. Entries gossip these rather than bare addresses, as anyone can
+// append to an entry's seed list but only the seed itself can sign for it.
+type Attestation struct {
+	Seed           Address `json:"seed"`
+	For            Address `json:"for"`
+	CollectionHash []byte  `json:"collectionHash"`
+	Updated        uint64  `json:"updated"`
+
+	// The seed's public key, the seed address must be generated from it.
+	PublicKey []byte `json:"publicKey"`
+	Signature []byte `json:"signature"`
+}
+
+// Creates an unsigned attestation of node seeding entry, as of now.
+func NewAttestation(node Node, entry Entry) Attestation {
+	return Attestation{
+		Seed:           *node.Address(),
+		For:            entry.Address,
+		CollectionHash: entry.CollectionHash,
+		Updated:        uint64(time.Now().Unix()),
+		PublicKey:      node.PublicKey(),
+	}
+}
+
+// The data that is signed by the seed.
+func (a Attestation) Bytes() ([]byte, error) {
+	seed, err := a.Seed.String()
+
+	if err != nil {
+		return nil, err
+	}
+
+	pfor, err := a.For.String()
+
+	if err != nil {
+		return nil, err
+	}
+
+	str := seed + pfor + string(a.CollectionHash) + strconv.FormatUint(a.Updated, 10)
+
+	return []byte(str), nil
+}
+
+// Checks that the attestation was signed by the seed it names, and that it is
+// not from the future.
+func (a *Attestation) Verify() error {
+	if len(a.Seed.Raw) != AddressBinarySize || len(a.For.Raw) != AddressBinarySize {
+		return errors.New("Attestation address size invalid")
+	}
+
+	if len(a.PublicKey) != ed25519.PublicKeySize {
+		return errors.New("Attestation public key size invalid")
+	}
+
+	if len(a.Signature) != ed25519.SignatureSize {
+		return errors.New("Attestation signature size invalid")
+	}
+
+	var owner Address
+	owner.Generate(a.PublicKey)
+
+	if !owner.Equals(&a.Seed) {
+		return errors.New("Attestation public key does not match seed")
+	}
+
+	if int64(a.Updated) > time.Now().Add(MaxClockSkew).Unix() {
+		return ErrEntryFromFuture
+	}
+
+	data, err := a.Bytes()
+
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(a.PublicKey, data, a.Signature) {
+		return errors.New("Failed to verify attestation signature")
+	}
+
+	return nil
+}
+
+// True if the attestation is older than AttestationTTL.
+func (a *Attestation) Expired() bool {
+	return int64(a.Updated) < time.Now().Add(-AttestationTTL).Unix()
+}
+
+// Combines two lists of attestations, keeping only the newest from each seed.
+func MergeSeeds(one, two []Attestation) []Attestation {
+	ret := make([]Attestation, 0, len(one)+len(two))
+	index := make(map[string]int)
+
+	for _, i := range append(append([]Attestation{}, one...), two...) {
+		key := string(i.Seed.Raw)
+
+		if n, ok := index[key]; ok {
+			if i.Updated > ret[n].Updated {
+				ret[n] = i
+			}
+
+			continue
+		}
+
+		index[key] = len(ret)
+		ret = append(ret, i)
+	}
+
+	return ret
+}
+
+// The seeds of an entry that are for it, verify and have not expired, with
+// only the newest attestation from each seed kept.
+func (e Entry) VerifiedSeeds() []Attestation {
+	ret := make([]Attestation, 0, len(e.Seeds))
+
+	for _, i := range e.Seeds {
+		if !i.For.Equals(&e.Address) || i.Expired() || i.Verify() != nil {
+			continue
+		}
+
+		ret = append(ret, i)
+	}
+
+	return MergeSeeds(nil, ret)
+}
+
+// The addresses of all the seeds of an entry.
+func (e Entry) SeedAddresses() []Address {
+	ret := make([]Address, 0, len(e.Seeds))
+
+	for _, i := range e.Seeds {
+		ret = append(ret, i.Seed)
+	}
+
+	return ret
+}
+
+func ShuffleSeeds(slice []Attestation) {
+	for i := range slice {
+		j := rand.Intn(i + 1)
+
+		slice[i], slice[j] = slice[j], slice[i]
+	}
+}
@@ -0,0 +1,146 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi/dht"
+	"golang.org/x/crypto/ed25519"
+)
+
+// A signed entry along with the key it was signed with.
+func keyedEntry(t *testing.T) (dht.Entry, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	fatalErr(err, t)
+
+	entry := dht.Entry{
+		Name:          randString(10),
+		PublicKey:     pub,
+		PublicAddress: randomIP(),
+		Port:          5050,
+	}
+	entry.Address.Generate(pub)
+
+	dat, err := entry.Bytes()
+	fatalErr(err, t)
+	entry.Signature = ed25519.Sign(priv, dat)
+
+	return entry, priv
+}
+
+func attest(t *testing.T, seed dht.Entry, priv ed25519.PrivateKey, entry dht.Entry, updated time.Time) dht.Attestation {
+	a := dht.Attestation{
+		Seed:           seed.Address,
+		For:            entry.Address,
+		CollectionHash: entry.CollectionHash,
+		Updated:        uint64(updated.Unix()),
+		PublicKey:      seed.PublicKey,
+	}
+
+	dat, err := a.Bytes()
+	fatalErr(err, t)
+	a.Signature = ed25519.Sign(priv, dat)
+
+	return a
+}
+
+func TestAttestationVerify(t *testing.T) {
+	entry, _ := keyedEntry(t)
+	seed, priv := keyedEntry(t)
+	other, otherPriv := keyedEntry(t)
+
+	a := attest(t, seed, priv, entry, time.Now())
+	fatalErr(a.Verify(), t)
+
+	// claiming to be someone else
+	forged := attest(t, seed, otherPriv, entry, time.Now())
+	forged.PublicKey = other.PublicKey
+	if forged.Verify() == nil {
+		t.Fatal("Attestation for another seed verified")
+	}
+
+	tampered := a
+	tampered.CollectionHash = []byte("nope")
+	if tampered.Verify() == nil {
+		t.Fatal("Tampered attestation verified")
+	}
+
+	old := attest(t, seed, priv, entry, time.Now().Add(-dht.AttestationTTL*2))
+	if !old.Expired() {
+		t.Fatal("Old attestation has not expired")
+	}
+
+	entry.Seeds = []dht.Attestation{a, tampered, old}
+	if len(entry.VerifiedSeeds()) != 1 {
+		t.Fatalf("Verified %d seeds", len(entry.VerifiedSeeds()))
+	}
+}
+
+func TestInsertAttestedSeeds(t *testing.T) {
+	db := dbWithRandomAddress(t)
+
+	entry, _ := keyedEntry(t)
+	seed, priv := keyedEntry(t)
+	fake := randomEntry(t)
+
+	for _, i := range []dht.Entry{seed, fake} {
+		_, err := db.Insert(i)
+		fatalErr(err, t)
+	}
+
+	// the fake seed never signed anything, so is just dropped
+	older := attest(t, seed, priv, entry, time.Now().Add(-time.Hour))
+	entry.Seeds = []dht.Attestation{older, {Seed: fake.Address, For: entry.Address}}
+
+	_, err := db.Insert(entry)
+	fatalErr(err, t)
+
+	newer := attest(t, seed, priv, entry, time.Now())
+	entry.Seeds = []dht.Attestation{newer}
+
+	_, err = db.Insert(entry)
+	fatalErr(err, t)
+
+	// an older attestation never replaces a newer one
+	entry.Seeds = []dht.Attestation{older}
+
+	_, err = db.Insert(entry)
+	fatalErr(err, t)
+
+	stored, _, err := db.Query(entry.Address)
+	fatalErr(err, t)
+
+	if len(stored.Seeds) != 1 || !stored.Seeds[0].Seed.Equals(&seed.Address) {
+		t.Fatalf("Stored seeds: %+v", stored.Seeds)
+	}
+
+	if stored.Seeds[0].Updated != newer.Updated {
+		t.Fatal("Attestation was rolled back")
+	}
+
+	fatalErr(stored.Seeds[0].Verify(), t)
+}
@@ -0,0 +1,202 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht
+
+import (
+	"time"
+)
+
+const (
+	// How many addresses are kept per bucket to replace nodes that stop
+	// responding.
+	ReplacementCacheSize = BucketSize
+
+	// Buckets that have not had a lookup in this long are refreshed.
+	BucketRefreshAge = time.Hour
+
+	// A node that fails this many times in a row is replaced, if there is
+	// anything to replace it with.
+	MaxContactFailures = 3
+)
+
+// Checks a node is still alive, used before evicting the least recently seen
+// node from a full bucket.
+type PingFunc func(addr Address) error
+
+// A node in the routing table. Host is the entry's public address, which the
+// per-IP and per-subnet limits are counted on.
+type Contact struct {
+	Address  Address
+	Host     string
+	LastSeen time.Time
+	Failures int
+}
+
+// A k-bucket. Contacts are kept most recently seen first, new nodes that do
+// not fit wait in the replacement cache, also most recent first.
+type Bucket struct {
+	Contacts     []Contact
+	Replacements []Contact
+
+	// When any node in the bucket was last heard from, and when a lookup last
+	// targeted it.
+	LastSeen   time.Time
+	LastLookup time.Time
+
+	// The total number of failed pings and queries to nodes in the bucket.
+	Failures int
+
+	pinging bool
+}
+
+func newBucket() *Bucket {
+	return &Bucket{
+		Contacts:     make([]Contact, 0, BucketSize),
+		Replacements: make([]Contact, 0, ReplacementCacheSize),
+		LastLookup:   time.Now(),
+	}
+}
+
+func (b *Bucket) Addresses() []Address {
+	ret := make([]Address, 0, len(b.Contacts))
+
+	for _, i := range b.Contacts {
+		ret = append(ret, i.Address)
+	}
+
+	return ret
+}
+
+func (b *Bucket) find(addr Address) int {
+	for n, i := range b.Contacts {
+		if i.Address.Equals(&addr) {
+			return n
+		}
+	}
+
+	return -1
+}
+
+func (b *Bucket) remove(n int) Contact {
+	contact := b.Contacts[n]
+	b.Contacts = append(b.Contacts[:n], b.Contacts[n+1:]...)
+
+	return contact
+}
+
+// Moves a contact to the front of the bucket, returns false if it is not in
+// the bucket.
+func (b *Bucket) seen(addr Address, now time.Time) bool {
+	n := b.find(addr)
+
+	if n == -1 {
+		return false
+	}
+
+	contact := b.remove(n)
+	contact.LastSeen = now
+	contact.Failures = 0
+
+	b.Contacts = append([]Contact{contact}, b.Contacts...)
+	b.LastSeen = now
+
+	return true
+}
+
+// Adds a new contact to the front of the bucket, the caller makes sure there
+// is room.
+func (b *Bucket) add(contact Contact, now time.Time) {
+	b.removeReplacement(contact.Address)
+
+	contact.LastSeen = now
+	b.Contacts = append([]Contact{contact}, b.Contacts...)
+	b.LastSeen = now
+}
+
+func (b *Bucket) removeReplacement(addr Address) {
+	for n, i := range b.Replacements {
+		if i.Address.Equals(&addr) {
+			b.Replacements = append(b.Replacements[:n], b.Replacements[n+1:]...)
+			return
+		}
+	}
+}
+
+func (b *Bucket) addReplacement(contact Contact) {
+	b.removeReplacement(contact.Address)
+
+	b.Replacements = append([]Contact{contact}, b.Replacements...)
+
+	if len(b.Replacements) > ReplacementCacheSize {
+		b.Replacements = b.Replacements[:ReplacementCacheSize]
+	}
+}
+
+// The index of the most recently seen replacement that is allowed into the
+// table, or -1.
+func (b *Bucket) replacement(allow func(Contact) bool) int {
+	for n, i := range b.Replacements {
+		if allow(i) {
+			return n
+		}
+	}
+
+	return -1
+}
+
+// Moves the most recently seen allowed replacement into the bucket, if there
+// is one and there is room.
+func (b *Bucket) promote(now time.Time, allow func(Contact) bool) {
+	n := b.replacement(allow)
+
+	if n == -1 || len(b.Contacts) >= BucketSize {
+		return
+	}
+
+	contact := b.Replacements[n]
+	b.Replacements = append(b.Replacements[:n], b.Replacements[n+1:]...)
+
+	contact.LastSeen = now
+	b.Contacts = append([]Contact{contact}, b.Contacts...)
+}
+
+// Records a failure for a contact, and replaces it once it has failed too many
+// times. Nodes are only ever dropped if there is something to replace them
+// with, a stale node is better than an empty slot.
+func (b *Bucket) fail(addr Address, now time.Time, allow func(Contact) bool) {
+	n := b.find(addr)
+
+	if n == -1 {
+		return
+	}
+
+	b.Failures++
+	b.Contacts[n].Failures++
+
+	if b.Contacts[n].Failures >= MaxContactFailures && b.replacement(allow) != -1 {
+		b.remove(n)
+		b.promote(now, allow)
+	}
+}
@@ -0,0 +1,221 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi/dht"
+)
+
+// Inserts entries until bucket 0 of the table is full, returning the addresses
+// in the order they were inserted.
+func fillBucket(t *testing.T, db *dht.NetDB) []dht.Address {
+	ret := make([]dht.Address, 0, dht.BucketSize)
+
+	for len(ret) < dht.BucketSize {
+		entry := randomEntry(t)
+		_, err := db.Insert(entry)
+		fatalErr(err, t)
+
+		if contacts := db.Bucket(0).Contacts; len(contacts) > 0 && contacts[0].Address.Equals(&entry.Address) {
+			ret = append(ret, entry.Address)
+		}
+	}
+
+	return ret
+}
+
+// Inserts a new entry that falls into bucket 0.
+func insertIntoBucket(t *testing.T, db *dht.NetDB) dht.Address {
+	for {
+		entry := randomEntry(t)
+
+		if db.Bucket(0).Contacts[0].Address.Xor(&entry.Address).Raw[0]&0x80 != 0 {
+			continue
+		}
+
+		_, err := db.Insert(entry)
+		fatalErr(err, t)
+
+		return entry.Address
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("Timed out waiting for the table to update")
+		}
+	}
+}
+
+func TestBucketKeepsLiveNodes(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	inserted := fillBucket(t, db)
+	oldest := inserted[0]
+
+	pinged := make(chan dht.Address, 1)
+	db.SetPinger(func(addr dht.Address) error {
+		pinged <- addr
+		return nil
+	})
+
+	addr := insertIntoBucket(t, db)
+
+	if p := <-pinged; !p.Equals(&oldest) {
+		t.Fatal("Did not ping the least recently seen node")
+	}
+
+	waitFor(t, func() bool { return db.Bucket(0).Contacts[0].Address.Equals(&oldest) })
+
+	bucket := db.Bucket(0)
+
+	if len(bucket.Contacts) != dht.BucketSize {
+		t.Fatalf("Bucket has %d contacts", len(bucket.Contacts))
+	}
+
+	for _, i := range bucket.Contacts {
+		if i.Address.Equals(&addr) {
+			t.Fatal("Live node was evicted")
+		}
+	}
+
+	if len(bucket.Replacements) != 1 || !bucket.Replacements[0].Address.Equals(&addr) {
+		t.Fatal("New node not in the replacement cache")
+	}
+}
+
+func TestBucketEvictsDeadNodes(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	inserted := fillBucket(t, db)
+	oldest := inserted[0]
+
+	db.SetPinger(func(addr dht.Address) error {
+		return errors.New("Peer is down")
+	})
+
+	addr := insertIntoBucket(t, db)
+
+	waitFor(t, func() bool { return db.Bucket(0).Failures == 1 })
+
+	bucket := db.Bucket(0)
+
+	if !bucket.Contacts[0].Address.Equals(&addr) {
+		t.Fatal("Replacement was not moved into the bucket")
+	}
+
+	for _, i := range bucket.Contacts {
+		if i.Address.Equals(&oldest) {
+			t.Fatal("Dead node was not evicted")
+		}
+	}
+
+	if len(bucket.Replacements) != 0 {
+		t.Fatal("Replacement cache not emptied")
+	}
+}
+
+func TestBucketFailures(t *testing.T) {
+	db := dbWithRandomAddress(t)
+	inserted := fillBucket(t, db)
+	addr := insertIntoBucket(t, db)
+
+	// no pinger is set, so the new node waits in the replacement cache until a
+	// node in the bucket fails enough times
+	for i := 0; i < dht.MaxContactFailures; i++ {
+		if db.Bucket(0).Contacts[0].Address.Equals(&addr) {
+			t.Fatal("Node replaced too early")
+		}
+
+		db.MarkFailed(inserted[5])
+	}
+
+	bucket := db.Bucket(0)
+
+	if !bucket.Contacts[0].Address.Equals(&addr) {
+		t.Fatal("Failing node was not replaced")
+	}
+
+	if bucket.Failures != dht.MaxContactFailures {
+		t.Fatalf("Bucket recorded %d failures", bucket.Failures)
+	}
+}
+
+func TestRandomAddressInBucket(t *testing.T) {
+	self := randomAddress(t)
+
+	for _, i := range []int{0, 1, 7, 8, 63, 100, dht.AddressBinarySize*8 - 2} {
+		addr, err := dht.RandomAddressInBucket(*self, i)
+		fatalErr(err, t)
+
+		if index := addr.Xor(self).LeadingZeroes(); index != i {
+			t.Fatalf("Address in bucket %d, expected %d", index, i)
+		}
+	}
+}
+
+func TestTablePersists(t *testing.T) {
+	addr := randomAddress(t)
+	path := ".testing/" + addr.StringOr("")
+
+	db, err := dht.NewNetDB(*addr, path)
+	fatalErr(err, t)
+
+	inserted := fillBucket(t, db)
+	replacement := insertIntoBucket(t, db)
+	db.MarkFailed(inserted[3])
+
+	fatalErr(db.Close(), t)
+
+	db, err = dht.NewNetDB(*addr, path)
+	fatalErr(err, t)
+	defer db.Close()
+
+	length := db.TableLen()
+
+	if length < dht.BucketSize {
+		t.Fatalf("Table has %d nodes after reloading", length)
+	}
+
+	bucket := db.Bucket(0)
+
+	for n, i := range bucket.Contacts {
+		// most recently seen first
+		if expected := inserted[len(inserted)-1-n]; !i.Address.Equals(&expected) {
+			t.Fatal("Bucket order not kept")
+		}
+	}
+
+	if bucket.Contacts[len(inserted)-1-3].Failures != 1 || bucket.Failures != 1 {
+		t.Fatal("Failures not kept")
+	}
+
+	if len(bucket.Replacements) != 1 || !bucket.Replacements[0].Address.Equals(&replacement) {
+		t.Fatal("Replacement cache not kept")
+	}
+}
@@ -26,16 +26,19 @@ package dht
 
 import (
 	"database/sql"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 )
 
 type DHT struct {
-	db *NetDB
+	db  *NetDB
+	ttl time.Duration
 }
 
-// sets up the dht
-func NewDHT(addr Address, path string) *DHT {
-	ret := &DHT{}
+// sets up the dht, entries expire after ttl
+func NewDHT(addr Address, path string, ttl time.Duration) *DHT {
+	ret := &DHT{ttl: ttl}
 
 	db, err := NewNetDB(addr, path)
 
@@ -47,7 +50,7 @@ func NewDHT(addr Address, path string) *DHT {
 
 	log.Debug("Loading latest into DHT")
 	// insert a load of new entries, keep it fresh!
-	entries, err := db.QueryLatest()
+	entries, err := db.QueryLatest(ttl)
 
 	if err == sql.ErrNoRows {
 		return ret
@@ -83,12 +86,32 @@ func (dht *DHT) FindClosest(addr Address) (Entries, error) {
 	return dht.db.FindClosest(addr)
 }
 
-func (dht *DHT) SaveTable(path string) {
-	dht.db.SaveTable(path)
+func (dht *DHT) SetPinger(ping PingFunc) {
+	dht.db.SetPinger(ping)
+}
+
+func (dht *DHT) MarkSeen(addr Address) {
+	dht.db.MarkSeen(addr)
+}
+
+func (dht *DHT) MarkFailed(addr Address) {
+	dht.db.MarkFailed(addr)
+}
+
+func (dht *DHT) RecordLookup(target Address) {
+	dht.db.RecordLookup(target)
+}
+
+func (dht *DHT) StaleBuckets() []int {
+	return dht.db.StaleBuckets()
+}
+
+func (dht *DHT) CollectGarbage() (GCResult, error) {
+	return dht.db.CollectGarbage(dht.ttl)
 }
 
-func (dht *DHT) LoadTable(path string) {
-	dht.db.LoadTable(path)
+func (dht *DHT) Close() error {
+	return dht.db.Close()
 }
 
 func (dht *DHT) SearchEntries(name, desc string, page int) ([]Address, error) {
@@ -30,6 +30,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strconv"
+	"time"
 
 	msgpack "gopkg.in/vmihailenco/msgpack.v2"
 
@@ -41,6 +42,10 @@ const (
 	MaxEntryDescLength          = 160
 	MaxEntryPublicAddressLength = 253
 	MaxEntrySeeds               = 100000
+	MaxEntryWorkLength          = 32
+
+	// How far ahead of our own clock an entry's Updated time may be.
+	MaxClockSkew = time.Minute * 10
 )
 
 // This is an entry into the DHT. It is used to connect to a peer given just
@@ -62,9 +67,13 @@ type Entry struct {
 	CollectionHash []byte `json:"collectionHash"`
 	Port           int    `json:"port"`
 
-	Seeds   [][]byte `json:"seeds"`
-	Seeding [][]byte `json:"seeding"`
-	Seen    int      `json:"seed"`
+	// Signed by each seed rather than the owner, see Attestation.
+	Seeds   []Attestation `json:"seeds"`
+	Seeding [][]byte      `json:"seeding"`
+	Seen    int           `json:"seed"`
+
+	// A proof of work for the public key, see WorkDifficulty.
+	Work []byte `json:"work"`
 
 	// Used in the FindClosest function, for sorting.
 	distance Address
@@ -113,7 +122,7 @@ func (e Entry) String() (string, error) {
 	str += e.Desc
 	str += string(e.PublicAddress)
 	str += string(e.PublicKey)
-	str += string(e.Port)
+	str += string(rune(e.Port))
 	str += postCount
 	str += updated
 	str += string(e.CollectionHash)
@@ -122,8 +131,15 @@ func (e Entry) String() (string, error) {
 		str += string(i)
 	}
 
+	// only signed when there is some, so entries from before it existed still
+	// verify
+	if len(e.Work) > 0 {
+		str += string(e.Work)
+	}
+
 	// note that we do not, in fact, sign who the seeds are. This allows others
-	// to build the swarm while this peer is not online.
+	// to build the swarm while this peer is not online, each seed signs its
+	// own attestation instead.
 
 	return str, nil
 }
@@ -198,6 +214,10 @@ func (entry *Entry) Verify() error {
 		return errors.New("Signature too small")
 	}
 
+	if len(entry.Work) > MaxEntryWorkLength {
+		return errors.New("Entry work is too long")
+	}
+
 	data, _ := entry.Bytes()
 	verified := ed25519.Verify(entry.PublicKey, data, entry.Signature[:])
 
@@ -205,6 +225,10 @@ func (entry *Entry) Verify() error {
 		return errors.New("Failed to verify signature")
 	}
 
+	if WorkDifficulty(entry.PublicKey, entry.Work) < RequiredWork {
+		return errors.New("Entry does not have enough proof of work")
+	}
+
 	if len(entry.PublicAddress) == 0 {
 		return errors.New("Public address must be set")
 	}
@@ -215,7 +239,7 @@ func (entry *Entry) Verify() error {
 	}
 
 	if entry.Port > 65535 {
-		return errors.New("Port too large (" + string(entry.Port) + ")")
+		return errors.New("Port too large (" + strconv.Itoa(entry.Port) + ")")
 	}
 
 	return nil
@@ -24,7 +24,20 @@
 // For more information, please refer to <http://unlicense.org/>
 package dht
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// Returned when an entry is older than the copy we already hold, which
+	// would otherwise let anyone replay an old signed entry.
+	ErrEntryRollback = errors.New("Entry is older than the stored entry")
+
+	// Returned when an entry claims to be updated further in the future than
+	// MaxClockSkew allows.
+	ErrEntryFromFuture = errors.New("Entry is updated in the future")
+)
 
 type InvalidValue struct {
 	Value string
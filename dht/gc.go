@@ -0,0 +1,182 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht
+
+import (
+	"time"
+)
+
+// Entries that have not been heard from or updated in this long are removed.
+const DefaultEntryTTL = time.Hour * 24 * 7
+
+// What a garbage collection pass removed.
+type GCResult struct {
+	Entries  int64 `json:"entries"`
+	Seeds    int64 `json:"seeds"`
+	Contacts int   `json:"contacts"`
+}
+
+// Removes every entry that has not been seen or updated within the ttl, along
+// with any seed links to entries that no longer exist or whose attestation has
+// expired, and drops the expired nodes from the routing table.
+func (ndb *NetDB) CollectGarbage(ttl time.Duration) (result GCResult, err error) {
+	// make sure the seen times are up to date before anything is judged on them
+	err = ndb.FlushTable()
+
+	if err != nil {
+		return
+	}
+
+	self, err := ndb.addr.String()
+
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-ttl).Unix()
+
+	tx, err := ndb.conn.Begin()
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(sqlQueryExpired, cutoff, cutoff, self)
+
+	if err != nil {
+		return
+	}
+
+	expired := make([]Address, 0)
+
+	for rows.Next() {
+		var address string
+
+		if err = rows.Scan(&address); err != nil {
+			rows.Close()
+			return
+		}
+
+		if addr, err := DecodeAddress(address); err == nil {
+			expired = append(expired, addr)
+		}
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	// the fts table has external content, so it needs telling what is deleted
+	// while the rows are still there
+	_, err = tx.Exec(sqlDeleteExpiredFts, cutoff, cutoff, self)
+
+	if err != nil {
+		return
+	}
+
+	res, err := tx.Exec(sqlDeleteExpired, cutoff, cutoff, self)
+
+	if err != nil {
+		return
+	}
+
+	result.Entries, err = res.RowsAffected()
+
+	if err != nil {
+		return
+	}
+
+	res, err = tx.Exec(sqlDeleteDeadSeeds)
+
+	if err != nil {
+		return
+	}
+
+	result.Seeds, err = res.RowsAffected()
+
+	if err != nil {
+		return
+	}
+
+	res, err = tx.Exec(sqlDeleteExpiredAttestations, time.Now().Add(-AttestationTTL).Unix())
+
+	if err != nil {
+		return
+	}
+
+	attestations, err := res.RowsAffected()
+
+	if err != nil {
+		return
+	}
+
+	result.Seeds += attestations
+
+	// the routing table is only changed once the rows are really gone, so that
+	// it never disagrees with peers.db
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	result.Contacts = ndb.removeFromTable(expired)
+
+	return
+}
+
+// Removes addresses from the routing table entirely, returns how many were
+// found.
+func (ndb *NetDB) removeFromTable(addrs []Address) int {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	now := time.Now()
+	removed := 0
+
+	for _, i := range addrs {
+		index := ndb.bucketIndex(i)
+		bucket := ndb.table[index]
+
+		if n := bucket.find(i); n != -1 {
+			bucket.remove(n)
+			bucket.promote(now, ndb.allowed)
+			removed++
+		} else {
+			bucket.removeReplacement(i)
+		}
+
+		delete(ndb.seen, string(i.Raw))
+		ndb.dirty[index] = true
+	}
+
+	return removed
+}
@@ -0,0 +1,90 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi/dht"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	self := randomEntry(t)
+	db, err := dht.NewNetDB(self.Address, ".testing/"+randString(16))
+	fatalErr(err, t)
+	defer db.Close()
+
+	// random entries are never updated, so only being seen keeps them
+	dead := randomEntry(t)
+	alive := randomEntry(t)
+
+	for _, i := range []dht.Entry{self, dead, alive} {
+		_, err = db.Insert(i)
+		fatalErr(err, t)
+	}
+
+	fatalErr(db.InsertSeed(alive.Address, dead.Address), t)
+	fatalErr(db.InsertSeed(dead.Address, alive.Address), t)
+
+	db.MarkSeen(alive.Address)
+
+	result, err := db.CollectGarbage(time.Hour)
+	fatalErr(err, t)
+
+	if result.Entries != 1 || result.Seeds != 2 || result.Contacts != 1 {
+		t.Fatalf("Collected %+v", result)
+	}
+
+	for _, i := range []dht.Entry{self, alive} {
+		if entry, _, _ := db.Query(i.Address); entry == nil {
+			t.Fatal("Live entry was removed")
+		}
+	}
+
+	if entry, _, _ := db.Query(dead.Address); entry != nil {
+		t.Fatal("Expired entry was kept")
+	}
+
+	// our own entry is in the table too
+	if db.TableLen() != 2 {
+		t.Fatalf("Table has %d nodes", db.TableLen())
+	}
+
+	// the search index must not still point at the removed entry
+	found, err := db.SearchPeer(dead.Name, dead.Desc, 0)
+	fatalErr(err, t)
+
+	if len(found) != 0 {
+		t.Fatal("Expired entry still searchable")
+	}
+
+	latest, err := db.QueryLatest(time.Hour)
+	fatalErr(err, t)
+
+	if len(latest) != 1 || !latest[0].Address.Equals(&alive.Address) {
+		t.Fatal("Latest entries include expired ones")
+	}
+}
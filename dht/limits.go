@@ -0,0 +1,85 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht
+
+import (
+	"net"
+	"strings"
+)
+
+const (
+	// How many routing table slots are given to nodes on one host, and to
+	// nodes in one /24 (or /48 for IPv6). This stops anyone with a single
+	// machine or subnet from filling the table with addresses they generated.
+	MaxContactsPerHost   = 2
+	MaxContactsPerSubnet = 10
+)
+
+// The keys a host is counted under. Hosts that are not IPs, onion addresses
+// or domain names, only count towards the per-host limit.
+func hostKeys(host string) (string, string) {
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return strings.ToLower(host), ""
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String(), v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.String(), ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Whether a contact may take a slot in the routing table, given who is in it
+// already. Should be called with the table locked.
+func (ndb *NetDB) allowed(contact Contact) bool {
+	if contact.Address.Equals(&ndb.addr) {
+		return true
+	}
+
+	host, subnet := hostKeys(contact.Host)
+	hosts, subnets := 0, 0
+
+	for _, bucket := range ndb.table {
+		for _, i := range bucket.Contacts {
+			if i.Address.Equals(&contact.Address) {
+				continue
+			}
+
+			h, s := hostKeys(i.Host)
+
+			if h == host {
+				hosts++
+			}
+
+			if subnet != "" && s == subnet {
+				subnets++
+			}
+		}
+	}
+
+	return hosts < MaxContactsPerHost && subnets < MaxContactsPerSubnet
+}
@@ -0,0 +1,236 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht
+
+import (
+	"errors"
+	"sort"
+)
+
+// How many peers a lookup queries at once.
+const Alpha = 3
+
+var ErrNotFound = errors.New("Address could not be resolved")
+
+// Sends a single request to a peer during a lookup. If findValue is set and
+// the peer has the target's entry it is returned as value, otherwise the peer
+// returns the entries it knows of closest to the target.
+type QueryFunc func(contact *Entry, target Address, findValue bool) (value *Entry, closer Entries, err error)
+
+const (
+	lookupWaiting = iota
+	lookupQuerying
+	lookupResponded
+	lookupFailed
+)
+
+type lookupContact struct {
+	entry *Entry
+	state int
+}
+
+type lookupResult struct {
+	contact *lookupContact
+	value   *Entry
+	closer  Entries
+	err     error
+}
+
+// An iterative Kademlia lookup. A shortlist of contacts is kept sorted by
+// distance to the target, and the closest that have not yet been asked are
+// queried, Alpha at a time. Every response can add closer contacts to the
+// shortlist. The lookup ends once the BucketSize closest contacts have all
+// responded, or there is no one left to ask.
+type Lookup struct {
+	self   Address
+	target Address
+	query  QueryFunc
+
+	shortlist []*lookupContact
+	seen      map[string]bool
+}
+
+func NewLookup(self, target Address, query QueryFunc) *Lookup {
+	return &Lookup{
+		self:   self,
+		target: target,
+		query:  query,
+		seen:   make(map[string]bool),
+	}
+}
+
+// FIND_NODE, returns the closest contacts to the target that responded.
+func (l *Lookup) FindNode(seeds Entries) (Entries, error) {
+	_, closest, err := l.run(seeds, false)
+
+	return closest, err
+}
+
+// FIND_VALUE, returns the target's entry as soon as any contact has it.
+func (l *Lookup) FindValue(seeds Entries) (*Entry, error) {
+	value, _, err := l.run(seeds, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if value == nil {
+		return nil, ErrNotFound
+	}
+
+	return value, nil
+}
+
+// Adds contacts to the shortlist, keeping it sorted. Contacts with invalid
+// entries are dropped, as is our own address.
+func (l *Lookup) add(entries Entries) {
+	for _, i := range entries {
+		if i == nil || i.Address.Equals(&l.self) || l.seen[string(i.Address.Raw)] {
+			continue
+		}
+
+		if i.Verify() != nil {
+			continue
+		}
+
+		l.seen[string(i.Address.Raw)] = true
+
+		entry := *i
+		entry.distance = *entry.Address.Xor(&l.target)
+
+		l.shortlist = append(l.shortlist, &lookupContact{entry: &entry})
+	}
+
+	sort.SliceStable(l.shortlist, func(a, b int) bool {
+		return l.shortlist[a].entry.distance.Less(&l.shortlist[b].entry.distance)
+	})
+}
+
+// The closest contacts that have not failed, at most BucketSize of them.
+func (l *Lookup) closest() []*lookupContact {
+	ret := make([]*lookupContact, 0, BucketSize)
+
+	for _, i := range l.shortlist {
+		if len(ret) == BucketSize {
+			break
+		}
+
+		if i.state != lookupFailed {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
+
+// Whether an entry is the target's own, and not just signed by someone else
+// with the target's address in it.
+func (l *Lookup) isTarget(entry *Entry) bool {
+	if !entry.Address.Equals(&l.target) || entry.Verify() != nil {
+		return false
+	}
+
+	var owner Address
+	owner.Generate(entry.PublicKey)
+
+	return owner.Equals(&l.target)
+}
+
+func (l *Lookup) run(seeds Entries, findValue bool) (*Entry, Entries, error) {
+	l.add(seeds)
+
+	if len(l.shortlist) == 0 {
+		return nil, nil, errors.New("No peers to look up from")
+	}
+
+	// never more than Alpha queries are running, so a query that finishes after
+	// the lookup has returned never blocks
+	results := make(chan lookupResult, Alpha)
+	inFlight := 0
+
+	for {
+		closest := l.closest()
+		done := true
+
+		for _, i := range closest {
+			if i.state != lookupResponded {
+				done = false
+				break
+			}
+		}
+
+		if done {
+			break
+		}
+
+		for _, i := range closest {
+			if inFlight == Alpha {
+				break
+			}
+
+			if i.state != lookupWaiting {
+				continue
+			}
+
+			i.state = lookupQuerying
+			inFlight++
+
+			go func(c *lookupContact) {
+				value, closer, err := l.query(c.entry, l.target, findValue)
+				results <- lookupResult{c, value, closer, err}
+			}(i)
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		res := <-results
+		inFlight--
+
+		if res.err != nil {
+			res.contact.state = lookupFailed
+			continue
+		}
+
+		res.contact.state = lookupResponded
+
+		if findValue && res.value != nil && l.isTarget(res.value) {
+			return res.value, nil, nil
+		}
+
+		l.add(res.closer)
+	}
+
+	ret := make(Entries, 0, BucketSize)
+
+	for _, i := range l.closest() {
+		if i.state == lookupResponded {
+			ret = append(ret, i.entry)
+		}
+	}
+
+	return nil, ret, nil
+}
@@ -0,0 +1,211 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht_test
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/dfindex/dfi/dht"
+)
+
+// A network of n nodes kept in memory, each with a routing table of at most
+// BucketSize nodes per bucket.
+type testNetwork struct {
+	nodes  map[string]*dht.Entry
+	tables map[string]dht.Entries
+	down   map[string]bool
+
+	mutex    sync.Mutex
+	inFlight int
+	maxSeen  int
+}
+
+func closestTo(entries dht.Entries, target dht.Address, n int) dht.Entries {
+	sorted := append(dht.Entries{}, entries...)
+
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].Address.Xor(&target).Less(sorted[b].Address.Xor(&target))
+	})
+
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	return sorted
+}
+
+func newTestNetwork(t *testing.T, n int) *testNetwork {
+	network := &testNetwork{
+		nodes:  make(map[string]*dht.Entry),
+		tables: make(map[string]dht.Entries),
+		down:   make(map[string]bool),
+	}
+
+	all := make(dht.Entries, 0, n)
+
+	for i := 0; i < n; i++ {
+		entry := randomEntry(t)
+		network.nodes[string(entry.Address.Raw)] = &entry
+		all = append(all, &entry)
+	}
+
+	for _, i := range all {
+		buckets := make(map[int]dht.Entries)
+
+		// a node always knows its own neighbourhood, so fill buckets closest first
+		for _, j := range closestTo(all, i.Address, len(all)) {
+			if i == j {
+				continue
+			}
+
+			bucket := j.Address.Xor(&i.Address).LeadingZeroes()
+
+			if len(buckets[bucket]) < dht.BucketSize {
+				buckets[bucket] = append(buckets[bucket], j)
+			}
+		}
+
+		for _, bucket := range buckets {
+			network.tables[string(i.Address.Raw)] = append(network.tables[string(i.Address.Raw)], bucket...)
+		}
+	}
+
+	return network
+}
+
+func (tn *testNetwork) entries() dht.Entries {
+	ret := make(dht.Entries, 0, len(tn.nodes))
+
+	for _, i := range tn.nodes {
+		ret = append(ret, i)
+	}
+
+	return ret
+}
+
+func (tn *testNetwork) query(contact *dht.Entry, target dht.Address, findValue bool) (*dht.Entry, dht.Entries, error) {
+	tn.mutex.Lock()
+	tn.inFlight++
+
+	if tn.inFlight > tn.maxSeen {
+		tn.maxSeen = tn.inFlight
+	}
+
+	tn.mutex.Unlock()
+
+	defer func() {
+		tn.mutex.Lock()
+		tn.inFlight--
+		tn.mutex.Unlock()
+	}()
+
+	if tn.down[string(contact.Address.Raw)] {
+		return nil, nil, errors.New("Peer is down")
+	}
+
+	if findValue {
+		if entry, ok := tn.nodes[string(target.Raw)]; ok {
+			for _, i := range tn.tables[string(contact.Address.Raw)] {
+				if i.Address.Equals(&target) {
+					return entry, nil, nil
+				}
+			}
+		}
+	}
+
+	return nil, closestTo(tn.tables[string(contact.Address.Raw)], target, dht.BucketSize), nil
+}
+
+func TestLookupFindNode(t *testing.T) {
+	network := newTestNetwork(t, 200)
+	all := network.entries()
+
+	// some of the closest nodes are down, they should not be returned
+	target := randomAddress(t)
+
+	for _, i := range closestTo(all, *target, 3) {
+		network.down[string(i.Address.Raw)] = true
+	}
+
+	up := make(dht.Entries, 0, len(all))
+
+	for _, i := range all {
+		if !network.down[string(i.Address.Raw)] {
+			up = append(up, i)
+		}
+	}
+
+	self := randomAddress(t)
+	found, err := dht.NewLookup(*self, *target, network.query).FindNode(up[:1])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// peers still return the down nodes among their closest, so those slots
+	// can only be filled by nodes no one was asked about
+	if len(found) < dht.BucketSize-len(network.down) {
+		t.Fatalf("Found %d nodes, expected at least %d", len(found), dht.BucketSize-len(network.down))
+	}
+
+	// tables hold only BucketSize nodes per bucket, so only the very closest
+	// are certain to be found
+	for n, i := range closestTo(up, *target, 5) {
+		if !found[n].Address.Equals(&i.Address) {
+			t.Fatal("Lookup did not find the closest nodes")
+		}
+	}
+
+	if network.maxSeen > dht.Alpha {
+		t.Fatalf("%d queries ran at once", network.maxSeen)
+	}
+}
+
+func TestLookupFindValue(t *testing.T) {
+	network := newTestNetwork(t, 200)
+	all := network.entries()
+
+	self := randomAddress(t)
+	target := all[len(all)-1]
+
+	entry, err := dht.NewLookup(*self, target.Address, network.query).FindValue(all[:1])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !entry.Address.Equals(&target.Address) {
+		t.Fatal("Found the wrong entry")
+	}
+
+	_, err = dht.NewLookup(*self, *randomAddress(t), network.query).FindValue(all[:1])
+
+	if err != dht.ErrNotFound {
+		t.Fatal("Found an entry that does not exist")
+	}
+}
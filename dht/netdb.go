@@ -26,21 +26,35 @@ package dht
 
 import (
 	"database/sql"
-	"encoding/json"
-	"io/ioutil"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/dfindex/dfi/util"
 )
 
 const (
 	BucketSize = 20
+
+	// Changes to the routing table are written to the database in batches,
+	// this often.
+	TableFlushFrequency = time.Second * 30
 )
 
 type NetDB struct {
-	table [][]Address
-	addr  Address
-	conn  *sql.DB
+	table      []*Bucket
+	tableMutex sync.Mutex
+	addr       Address
+	conn       *sql.DB
+	ping       PingFunc
+
+	// buckets changed since the table was last written, and when nodes were
+	// last heard from
+	dirty     map[int]bool
+	seen      map[string]time.Time
+	flushStop chan bool
 
 	stmtInsertEntry      *sql.Stmt
 	stmtInsertFtsEntry   *sql.Stmt
@@ -53,6 +67,9 @@ type NetDB struct {
 	stmtQuerySeeding     *sql.Stmt
 	stmtQueryLatest      *sql.Stmt
 	stmtSearchPeer       *sql.Stmt
+
+	stmtInsertAttestation *sql.Stmt
+	stmtQueryAttestations *sql.Stmt
 }
 
 func NewNetDB(addr Address, path string) (*NetDB, error) {
@@ -62,12 +79,14 @@ func NewNetDB(addr Address, path string) (*NetDB, error) {
 	ret.addr = addr
 
 	// One bucket of addresses per bit in an address
-	// At the time of writing, uses roughly 64KB of memory
-	ret.table = make([][]Address, AddressBinarySize*8)
+	ret.table = make([]*Bucket, AddressBinarySize*8)
+	ret.dirty = make(map[int]bool)
+	ret.seen = make(map[string]time.Time)
+	ret.flushStop = make(chan bool)
 
 	// allocate each bucket
 	for n, _ := range ret.table {
-		ret.table[n] = make([]Address, 0, BucketSize)
+		ret.table[n] = newBucket()
 	}
 
 	ret.conn, err = sql.Open("sqlite3", path)
@@ -76,28 +95,7 @@ func NewNetDB(addr Address, path string) (*NetDB, error) {
 		return nil, err
 	}
 
-	// don't bother preparing these, they are only used at startup
-
-	// create the entries table first, it is most important
-	_, err = ret.conn.Exec(sqlCreateEntriesTable)
-	if err != nil {
-		return nil, err
-	}
-
-	// store seed lists
-	_, err = ret.conn.Exec(sqlCreateSeedsTable)
-	if err != nil {
-		return nil, err
-	}
-
-	// full text search
-	_, err = ret.conn.Exec(sqlCreateFtsTable)
-	if err != nil {
-		return nil, err
-	}
-
-	// speed up entry lookups
-	_, err = ret.conn.Exec(sqlIndexAddresses)
+	err = util.Migrate(ret.conn, Migrations)
 	if err != nil {
 		return nil, err
 	}
@@ -143,6 +141,16 @@ func NewNetDB(addr Address, path string) (*NetDB, error) {
 		return nil, err
 	}
 
+	ret.stmtInsertAttestation, err = ret.conn.Prepare(sqlInsertAttestation)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.stmtQueryAttestations, err = ret.conn.Prepare(sqlQueryAttestations)
+	if err != nil {
+		return nil, err
+	}
+
 	ret.stmtEntryLen, err = ret.conn.Prepare(sqlEntryLen)
 	if err != nil {
 		return nil, err
@@ -158,20 +166,69 @@ func NewNetDB(addr Address, path string) (*NetDB, error) {
 		return nil, err
 	}
 
+	err = ret.loadTable()
+	if err != nil {
+		return nil, err
+	}
+
+	go ret.flushTable()
+
 	return ret, nil
 }
 
+// Writes any outstanding changes to the routing table, then closes the
+// database.
+func (ndb *NetDB) Close() error {
+	close(ndb.flushStop)
+
+	err := ndb.FlushTable()
+
+	if err != nil {
+		return err
+	}
+
+	return ndb.conn.Close()
+}
+
 // Get the total size of the in-memory routing table
 func (ndb *NetDB) TableLen() int {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
 	size := 0
 
 	for _, i := range ndb.table {
-		size += len(i)
+		size += len(i.Contacts)
 	}
 
 	return size
 }
 
+// Sets how nodes are pinged before being evicted. Without one, new nodes only
+// make it into a full bucket once an existing node has failed.
+func (ndb *NetDB) SetPinger(ping PingFunc) {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	ndb.ping = ping
+}
+
+// Returns a copy of the bucket at the given index.
+func (ndb *NetDB) Bucket(index int) Bucket {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	bucket := *ndb.table[index]
+	bucket.Contacts = append([]Contact{}, bucket.Contacts...)
+	bucket.Replacements = append([]Contact{}, bucket.Replacements...)
+
+	return bucket
+}
+
+func (ndb *NetDB) bucketIndex(addr Address) int {
+	return addr.Xor(&ndb.addr).LeadingZeroes()
+}
+
 // Get the total number of entries we have stored
 func (ndb *NetDB) Len() (int, error) {
 	var length int
@@ -188,38 +245,139 @@ func (ndb *NetDB) Len() (int, error) {
 
 // Insert an address into the in memory routing table. Theere is no need to store
 // any data along with it as this can be fetched from the DB.
-func (ndb *NetDB) insertIntoTable(addr Address) {
+// Nodes already in the table are moved to the front of their bucket. If the
+// bucket is full the new node goes into the replacement cache, and the least
+// recently seen node is pinged, it is only evicted if it does not respond.
+// New nodes on a host or subnet that already has its share of the table are
+// turned away.
+func (ndb *NetDB) insertIntoTable(addr Address, host string) {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	now := time.Now()
+
 	// Find the distance between the kv address and our own address, this is the
 	// index in the table
-	index := addr.Xor(&ndb.addr).LeadingZeroes()
+	index := ndb.bucketIndex(addr)
 	bucket := ndb.table[index]
 
-	// there is capacity, insert at the front
-	// search to see if it is already inserted
+	if bucket.seen(addr, now) {
+		bucket.Contacts[0].Host = host
+		ndb.dirty[index] = true
+		return
+	}
 
-	found := -1
+	contact := Contact{Address: addr, Host: host}
 
-	for n, i := range bucket {
-		if i.Equals(&addr) {
-			found = n
-			break
-		}
+	if !ndb.allowed(contact) {
+		log.WithFields(log.Fields{
+			"peer": addr.StringOr(""),
+			"host": host,
+		}).Debug("Host has too many nodes in the table")
+
+		return
 	}
 
-	// if it already exists, it first needs to be removed from it's old position
-	if found != -1 {
-		bucket = append(bucket[:found], bucket[found+1:]...)
-	} else if len(bucket) == BucketSize {
+	ndb.dirty[index] = true
 
-		// remove the back of the bucket, this update will go at the front
-		bucket = bucket[:len(bucket)-1]
+	if len(bucket.Contacts) < BucketSize {
+		bucket.add(contact, now)
+		return
 	}
 
-	bucket = append([]Address{addr}, bucket...)
+	bucket.addReplacement(contact)
+
+	if ndb.ping != nil && !bucket.pinging {
+		bucket.pinging = true
+		go ndb.pingOldest(index, bucket.Contacts[len(bucket.Contacts)-1].Address)
+	}
+}
+
+// Pings the least recently seen node in a full bucket, evicting it in favour of
+// a replacement if it does not respond.
+func (ndb *NetDB) pingOldest(index int, addr Address) {
+	err := ndb.ping(addr)
 
-	ndb.table[index] = bucket
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
 
-	ndb.SaveTable("./data/table.dat")
+	now := time.Now()
+	bucket := ndb.table[index]
+	bucket.pinging = false
+
+	n := bucket.find(addr)
+
+	// it has been removed since
+	if n == -1 {
+		return
+	}
+
+	if err == nil {
+		bucket.seen(addr, now)
+	} else {
+		log.WithField("peer", addr.StringOr("")).Debug("Evicting unresponsive peer from table")
+
+		bucket.Failures++
+		bucket.remove(n)
+		bucket.promote(now, ndb.allowed)
+	}
+
+	ndb.dirty[index] = true
+}
+
+// Records that we have heard from a node directly. This keeps its entry from
+// expiring, and moves it to the front of its bucket if it is in the table.
+func (ndb *NetDB) MarkSeen(addr Address) {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	now := time.Now()
+	index := ndb.bucketIndex(addr)
+
+	ndb.seen[string(addr.Raw)] = now
+
+	if ndb.table[index].seen(addr, now) {
+		ndb.dirty[index] = true
+	}
+}
+
+// Records that a node in the table failed to respond to us.
+func (ndb *NetDB) MarkFailed(addr Address) {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	index := ndb.bucketIndex(addr)
+
+	ndb.table[index].fail(addr, time.Now(), ndb.allowed)
+	ndb.dirty[index] = true
+}
+
+// Records a lookup for the target, so its bucket does not need refreshing.
+func (ndb *NetDB) RecordLookup(target Address) {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	index := ndb.bucketIndex(target)
+
+	ndb.table[index].LastLookup = time.Now()
+	ndb.dirty[index] = true
+}
+
+// The indexes of all non-empty buckets that have not had a lookup in
+// BucketRefreshAge.
+func (ndb *NetDB) StaleBuckets() []int {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	ret := make([]int, 0)
+
+	for n, i := range ndb.table {
+		if len(i.Contacts) > 0 && time.Since(i.LastLookup) > BucketRefreshAge {
+			ret = append(ret, n)
+		}
+	}
+
+	return ret
 }
 
 // Returns updated, inserted. One should be zero.
@@ -231,12 +389,13 @@ func (ndb *NetDB) insertIntoDB(entry Entry) (int64, error) {
 		return 0, err
 	}
 
-	// Insert the entry into the main entry table
+	// Insert the entry into the main entry table, seen is left for MarkSeen as
+	// we have no idea when whoever sent us the entry last heard from it
 	res, err := ndb.stmtInsertEntry.Exec(addressString, entry.Name, entry.Desc,
 		entry.PublicAddress, entry.Port, entry.PublicKey,
 		entry.Signature, entry.CollectionHash,
 		entry.PostCount, len(entry.Seeds), len(entry.Seeding),
-		entry.Updated, entry.Seen)
+		entry.Updated, 0, entry.Work)
 
 	if err != nil {
 		return 0, err
@@ -282,12 +441,16 @@ func (ndb *NetDB) insertEntrySeeds(entry Entry) error {
 		}
 	}
 
-	// then register all of the seeds for the current peer!
-	for _, i := range entry.Seeds {
-		peer := Address{Raw: i}
+	// then register all of the seeds for the current peer! Only those that
+	// signed for it though, anyone could have added the rest.
+	for _, i := range entry.VerifiedSeeds() {
+		err := ndb.InsertAttestation(i)
 
-		// the peer is a seed for us
-		err := ndb.InsertSeed(entry.Address, peer)
+		// we cannot link a seed we have no entry for, it will be picked up
+		// again once we do
+		if err == sql.ErrNoRows {
+			continue
+		}
 
 		if err != nil {
 			return err
@@ -297,6 +460,45 @@ func (ndb *NetDB) insertEntrySeeds(entry Entry) error {
 	return nil
 }
 
+// Stores a verified attestation as a seed link, unless a newer one from the
+// same seed is already stored. Both entries must already be in the database.
+func (ndb *NetDB) InsertAttestation(a Attestation) error {
+	err := a.Verify()
+
+	if err != nil {
+		return err
+	}
+
+	forString, err := a.For.String()
+
+	if err != nil {
+		return err
+	}
+
+	seedString, err := a.Seed.String()
+
+	if err != nil {
+		return err
+	}
+
+	var forId, seedId int
+
+	err = ndb.stmtQueryIdByAddress.QueryRow(forString).Scan(&forId)
+	if err != nil {
+		return err
+	}
+
+	err = ndb.stmtQueryIdByAddress.QueryRow(seedString).Scan(&seedId)
+	if err != nil {
+		return err
+	}
+
+	_, err = ndb.stmtInsertAttestation.Exec(seedId, forId, a.CollectionHash,
+		a.Updated, a.Signature, seedId, forId, a.Updated)
+
+	return err
+}
+
 func (ndb *NetDB) InsertSeed(entry Address, seed Address) error {
 	// First we need to map the addresses, which are essentially a network-wide
 	// id, to an integer id which is local to our database.
@@ -340,18 +542,23 @@ func (ndb *NetDB) Insert(entry Entry) (int64, error) {
 
 	log.WithField("peer", entry.Address.StringOr("")).Debug("Inserting into NetDB")
 
-	ndb.insertIntoTable(entry.Address)
-
 	// attempts to update, if this fails then the insert succeeds. Otherwise it
 	// is updated and the insert fails
 	affected, err := ndb.Update(entry)
-	if err != nil {
+	if err == ErrEntryRollback || err == ErrEntryFromFuture {
+		log.WithField("peer", entry.Address.StringOr("")).Warn(err.Error())
+		return 0, err
+	} else if err != nil {
 		log.Error(err.Error())
 		return 0, err
 	}
 
+	// only touch the routing table once the entry has been accepted, so a
+	// replayed entry cannot move a contact to an old host
+	ndb.insertIntoTable(entry.Address, entry.PublicAddress)
+
 	if affected > 0 {
-		return affected, nil
+		return affected, ndb.insertEntrySeeds(entry)
 	}
 
 	affected, err = ndb.insertIntoDB(entry)
@@ -370,16 +577,22 @@ func (ndb *NetDB) Update(entry Entry) (int64, error) {
 		return 0, err
 	}
 
+	if int64(entry.Updated) > time.Now().Add(MaxClockSkew).Unix() {
+		return 0, ErrEntryFromFuture
+	}
+
 	addressString, err := entry.Address.String()
 
 	if err != nil {
 		return 0, err
 	}
 
+	// the update only applies if the stored entry is not newer, equal
+	// timestamps are allowed so seeding changes can be saved
 	res, err := ndb.stmtUpdateEntry.Exec(entry.Name, entry.Desc, entry.PublicAddress,
 		entry.Port, entry.PublicKey, entry.Signature,
 		entry.CollectionHash, entry.PostCount, len(entry.Seeds), len(entry.Seeding),
-		entry.Updated, entry.Seen, addressString)
+		entry.Updated, entry.Work, addressString, entry.Updated)
 
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -390,8 +603,20 @@ func (ndb *NetDB) Update(entry Entry) (int64, error) {
 	}
 
 	affected, err := res.RowsAffected()
+	if err != nil || affected > 0 {
+		return affected, err
+	}
 
-	return affected, err
+	// nothing was updated, either we do not have the entry or ours is newer
+	var id int64
+	err = ndb.stmtQueryIdByAddress.QueryRow(addressString).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return 0, ErrEntryRollback
 }
 
 // Returns the KeyValue if this node has the address, nil if not, and err otherwise
@@ -412,7 +637,8 @@ func (ndb *NetDB) Query(addr Address) (*Entry, int, error) {
 
 	err = row.Scan(&id, &address, &ret.Name, &ret.Desc, &ret.PublicAddress,
 		&ret.Port, &ret.PublicKey, &ret.Signature, &ret.CollectionHash,
-		&ret.PostCount, &seedCount, &seedingCount, &ret.Updated, &ret.Seen)
+		&ret.PostCount, &seedCount, &seedingCount, &ret.Updated, &ret.Seen,
+		&ret.Work)
 
 	if err == sql.ErrNoRows {
 		return nil, -1, nil
@@ -436,21 +662,17 @@ func (ndb *NetDB) Query(addr Address) (*Entry, int, error) {
 		return nil, 0, err
 	}
 
-	// resinsert into the table, this keeps popular things easy to access
-	// TODO: Store some sort of "lastQueried" in the database, then we have
-	// even more data on how popular something is.
-	// TODO: Make sure I'm not storing too much in the database :P
-	ndb.insertIntoTable(ret.Address)
+	// not reinserted into the table, reading an entry from disk says nothing
+	// about whether the node is still alive
 	return &ret, id, nil
 }
 
 func (ndb *NetDB) addSeedToEntry(e *Entry, seedCount, seedingCount, id int) error {
 	e.Seeding = make([][]byte, 0, seedingCount)
-	e.Seeds = make([][]byte, 0, seedCount)
 
 	// now that all the slices for seeds/seeding are there, we need to popular them
 	// we also already have the id, which is nice
-	seeds, err := ndb.querySeeds(id)
+	seeds, err := ndb.queryAttestations(id, e.Address)
 	if err != nil {
 		return err
 	}
@@ -460,9 +682,7 @@ func (ndb *NetDB) addSeedToEntry(e *Entry, seedCount, seedingCount, id int) erro
 		return err
 	}
 
-	for _, i := range seeds {
-		e.Seeds = append(e.Seeds, i.Raw)
-	}
+	e.Seeds = seeds
 
 	for _, i := range seeding {
 		e.Seeding = append(e.Seeding, i.Raw)
@@ -505,6 +725,42 @@ func (ndb *NetDB) querySeeds(id int) ([]Address, error) {
 	return ret, nil
 }
 
+// fetch the live attestations of the seeds for an entry, given its id and
+// address
+func (ndb *NetDB) queryAttestations(id int, addr Address) ([]Attestation, error) {
+	ret := make([]Attestation, 0)
+
+	cutoff := time.Now().Add(-AttestationTTL).Unix()
+	rows, err := ndb.stmtQueryAttestations.Query(id, cutoff)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var address string
+		a := Attestation{For: addr}
+
+		err = rows.Scan(&address, &a.PublicKey, &a.CollectionHash, &a.Updated, &a.Signature)
+
+		if err != nil {
+			return nil, err
+		}
+
+		a.Seed, err = DecodeAddress(address)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, a)
+	}
+
+	return ret, rows.Err()
+}
+
 // fetch what an entry is seeding
 func (ndb *NetDB) querySeeding(id int) ([]Address, error) {
 	ret := make([]Address, 0)
@@ -579,11 +835,20 @@ func (ndb *NetDB) queryAddresses(as []Address) Entries {
 	return ret
 }
 
+// Copies the addresses out of a bucket, so that they can be queried from the
+// database without holding the table lock.
+func (ndb *NetDB) bucketAddresses(index int) []Address {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	return ndb.table[index].Addresses()
+}
+
 func (ndb *NetDB) FindClosest(addr Address) (Entries, error) {
 	// Find the distance between the kv address and our own address, this is the
 	// index in the table
-	index := addr.Xor(&ndb.addr).LeadingZeroes()
-	bucket := ndb.table[index]
+	index := ndb.bucketIndex(addr)
+	bucket := ndb.bucketAddresses(index)
 
 	if len(bucket) == BucketSize {
 		return ndb.queryAddresses(bucket), nil
@@ -597,7 +862,7 @@ func (ndb *NetDB) FindClosest(addr Address) (Entries, error) {
 		len(ret) < BucketSize; i++ {
 
 		if index-i >= 0 {
-			bucket = ndb.table[index-i]
+			bucket = ndb.bucketAddresses(index - i)
 
 			for _, i := range bucket {
 				if len(ret) >= BucketSize {
@@ -614,8 +879,8 @@ func (ndb *NetDB) FindClosest(addr Address) (Entries, error) {
 			}
 		}
 
-		if index+i < len(addr.Raw)*8 {
-			bucket = ndb.table[index+i]
+		if i > 0 && index+i < len(addr.Raw)*8 {
+			bucket = ndb.bucketAddresses(index + i)
 
 			for _, i := range bucket {
 				if len(ret) >= BucketSize {
@@ -637,9 +902,11 @@ func (ndb *NetDB) FindClosest(addr Address) (Entries, error) {
 	return ret, nil
 }
 
-func (ndb *NetDB) QueryLatest() ([]Entry, error) {
+// The newest entries that have been seen or updated within the ttl.
+func (ndb *NetDB) QueryLatest(ttl time.Duration) ([]Entry, error) {
 	ret := make([]Entry, 0, 20)
-	entries, err := ndb.stmtQueryLatest.Query()
+	cutoff := time.Now().Add(-ttl).Unix()
+	entries, err := ndb.stmtQueryLatest.Query(cutoff, cutoff)
 
 	if err != nil {
 		return nil, err
@@ -655,7 +922,14 @@ func (ndb *NetDB) QueryLatest() ([]Entry, error) {
 
 		err = entries.Scan(&id, &address, &e.Name, &e.Desc, &e.PublicAddress,
 			&e.Port, &e.PublicKey, &e.Signature, &e.CollectionHash,
-			&e.PostCount, &seedCount, &seedingCount, &e.Updated, &e.Seen)
+			&e.PostCount, &seedCount, &seedingCount, &e.Updated, &e.Seen,
+			&e.Work)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e.Address, err = DecodeAddress(address)
 
 		if err != nil {
 			return nil, err
@@ -701,19 +975,201 @@ func (ndb *NetDB) SearchPeer(name, desc string, page int) ([]Address, error) {
 	return ret, nil
 }
 
-func (ndb *NetDB) SaveTable(path string) {
-	data, err := json.Marshal(ndb.table)
+func (ndb *NetDB) flushTable() {
+	ticker := time.NewTicker(TableFlushFrequency)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ndb.FlushTable(); err != nil {
+				log.Error(err.Error())
+			}
+		case <-ndb.flushStop:
+			return
+		}
+	}
+}
+
+// Writes every bucket that has changed since the last flush, along with when
+// nodes were last seen, all in one transaction so that a crash never leaves
+// half a table behind.
+func (ndb *NetDB) FlushTable() (err error) {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	if len(ndb.dirty) == 0 && len(ndb.seen) == 0 {
+		return nil
+	}
+
+	tx, err := ndb.conn.Begin()
 
 	if err != nil {
-		log.Error(err.Error())
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+
+		if err == nil {
+			ndb.dirty = make(map[int]bool)
+			ndb.seen = make(map[string]time.Time)
+		}
+	}()
+
+	for index := range ndb.dirty {
+		err = writeBucket(tx, index, ndb.table[index])
+
+		if err != nil {
+			return
+		}
+	}
+
+	for raw, seen := range ndb.seen {
+		addr := Address{Raw: []byte(raw)}
+		address, err := addr.String()
+
+		if err != nil {
+			continue
+		}
+
+		_, err = tx.Exec(sqlUpdateSeen, seen.Unix(), address)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+func writeBucket(tx *sql.Tx, index int, bucket *Bucket) error {
+	_, err := tx.Exec(sqlReplaceBucket, index, bucket.LastSeen.Unix(),
+		bucket.LastLookup.Unix(), bucket.Failures)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(sqlDeleteBucketContacts, index)
+
+	if err != nil {
+		return err
+	}
+
+	for n, i := range bucket.Contacts {
+		address, err := i.Address.String()
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sqlInsertContact, address, index, n, 0,
+			i.LastSeen.Unix(), i.Failures)
+
+		if err != nil {
+			return err
+		}
 	}
 
-	ioutil.WriteFile(path, data, 0644)
+	for n, i := range bucket.Replacements {
+		address, err := i.Address.String()
 
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sqlInsertContact, address, index, n, 1, 0, 0)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (ndb *NetDB) LoadTable(path string) {
-	raw, _ := ioutil.ReadFile(path)
+// Reads the routing table back out of the database.
+func (ndb *NetDB) loadTable() error {
+	ndb.tableMutex.Lock()
+	defer ndb.tableMutex.Unlock()
+
+	buckets, err := ndb.conn.Query(sqlQueryBuckets)
+
+	if err != nil {
+		return err
+	}
+
+	defer buckets.Close()
+
+	for buckets.Next() {
+		var index int
+		var lastSeen, lastLookup int64
+		var failures int
+
+		err = buckets.Scan(&index, &lastSeen, &lastLookup, &failures)
+
+		if err != nil {
+			return err
+		}
+
+		if index < 0 || index >= len(ndb.table) {
+			continue
+		}
+
+		bucket := ndb.table[index]
+		bucket.LastSeen = time.Unix(lastSeen, 0)
+		bucket.LastLookup = time.Unix(lastLookup, 0)
+		bucket.Failures = failures
+	}
+
+	contacts, err := ndb.conn.Query(sqlQueryContacts)
+
+	if err != nil {
+		return err
+	}
+
+	defer contacts.Close()
+
+	for contacts.Next() {
+		var index int
+		var address string
+		var replacement bool
+		var lastSeen int64
+		var failures int
+		var host string
+
+		err = contacts.Scan(&index, &address, &replacement, &lastSeen, &failures, &host)
+
+		if err != nil {
+			return err
+		}
+
+		addr, err := DecodeAddress(address)
+
+		if err != nil || index < 0 || index >= len(ndb.table) {
+			continue
+		}
+
+		bucket := ndb.table[index]
+		contact := Contact{
+			Address:  addr,
+			Host:     host,
+			LastSeen: time.Unix(lastSeen, 0),
+			Failures: failures,
+		}
+
+		if replacement {
+			bucket.Replacements = append(bucket.Replacements, contact)
+		} else {
+			bucket.Contacts = append(bucket.Contacts, contact)
+		}
+	}
 
-	json.Unmarshal(raw, &ndb.table)
+	return contacts.Err()
 }
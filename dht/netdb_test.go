@@ -25,8 +25,12 @@
 package dht_test
 
 import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -101,6 +105,11 @@ func dbWithRandomAddress(t testing.TB) *dht.NetDB {
 	return db
 }
 
+// Every entry gets its own host, or the per-host table limits get in the way.
+func randomIP() string {
+	return fmt.Sprintf("10.%d.%d.%d", rand.Intn(256), rand.Intn(256), rand.Intn(256))
+}
+
 func randomEntry(t testing.TB) dht.Entry {
 	name := randString(util.RandInt(5, 25))
 	desc := randString(util.RandInt(5, 144))
@@ -114,7 +123,7 @@ func randomEntry(t testing.TB) dht.Entry {
 		Desc:          desc,
 		Address:       addr,
 		PublicKey:     pub,
-		PublicAddress: "localhost",
+		PublicAddress: randomIP(),
 		Port:          5050,
 	}
 
@@ -177,7 +186,7 @@ func TestInsert(t *testing.T) {
 	_, err := db.Insert(entry)
 
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err.Error())
 	}
 
 	if l, _ := db.Len(); l != 1 {
@@ -185,6 +194,56 @@ func TestInsert(t *testing.T) {
 	}
 }
 
+func TestInsertRollback(t *testing.T) {
+	db := dbWithRandomAddress(t)
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	fatalErr(err, t)
+
+	signed := func(name string, updated uint64) dht.Entry {
+		entry := dht.Entry{
+			Name:          name,
+			PublicKey:     pub,
+			PublicAddress: randomIP(),
+			Port:          5050,
+			Updated:       updated,
+		}
+		entry.Address.Generate(pub)
+
+		dat, err := entry.Bytes()
+		fatalErr(err, t)
+		entry.Signature = ed25519.Sign(priv, dat)
+
+		return entry
+	}
+
+	now := uint64(time.Now().Unix())
+
+	_, err = db.Insert(signed("new", now))
+	fatalErr(err, t)
+
+	// the same timestamp again is fine, an older one is not
+	_, err = db.Insert(signed("new", now))
+	fatalErr(err, t)
+
+	old := signed("old", now-60)
+	if _, err = db.Insert(old); err != dht.ErrEntryRollback {
+		t.Fatalf("Expected rollback, got: %v", err)
+	}
+
+	stored, _, err := db.Query(old.Address)
+	fatalErr(err, t)
+
+	if stored.Name != "new" {
+		t.Fatalf("Entry was rolled back to %s", stored.Name)
+	}
+
+	future := uint64(time.Now().Add(dht.MaxClockSkew * 2).Unix())
+	if _, err = db.Insert(signed("future", future)); err != dht.ErrEntryFromFuture {
+		t.Fatalf("Expected future entry to be rejected, got: %v", err)
+	}
+}
+
 func TestInsertSeed(t *testing.T) {
 	db := dbWithRandomAddress(t)
 	entry := randomEntry(t)
@@ -256,3 +315,34 @@ func BenchmarkQuery(b *testing.B) {
 
 	removeTesting()
 }
+
+func TestMigrateUnversioned(t *testing.T) {
+	script, err := ioutil.ReadFile(filepath.Join("testdata", "peers-unversioned.sql"))
+	fatalErr(err, t)
+
+	path := ".testing/" + randString(16)
+	conn, err := sql.Open("sqlite3", path)
+	fatalErr(err, t)
+
+	_, err = conn.Exec(string(script))
+	conn.Close()
+	fatalErr(err, t)
+
+	db, err := dht.NewNetDB(*randomAddress(t), path)
+	fatalErr(err, t)
+
+	if l, _ := db.Len(); l != 1 {
+		t.Fatalf("Entries lost in migration, database len: %d", l)
+	}
+
+	conn, err = sql.Open("sqlite3", path)
+	fatalErr(err, t)
+	defer conn.Close()
+
+	version, err := util.SchemaVersion(conn)
+	fatalErr(err, t)
+
+	if version != util.LatestVersion(dht.Migrations) {
+		t.Fatalf("Database at version %d after migration", version)
+	}
+}
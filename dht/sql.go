@@ -43,7 +43,8 @@ const (
 		postCount      - the number of posts this node has
 		seedCount      - the number of seeds this node has
 		updated        - when this entry was last updated by the node, or another adding seeds
-		seen           - when this node was last seen online
+		seen           - when this node was last heard from directly, by us. What
+		                 other peers say is ignored.
 
 		DFI addresses are stored encoded mostly because it makes debugging *far*
 		easier, at the code of some extra encoding and decoding.
@@ -104,8 +105,8 @@ const (
 				seedCount=?,
 				seedingCount=?,
 				updated=?,
-				seen=?
-			WHERE address=?
+				work=?
+			WHERE address=? AND IFNULL(updated, 0) <= ?
 	`
 
 	sqlInsertEntry = `
@@ -122,9 +123,10 @@ const (
 				seedCount,
 				seedingCount,
 				updated,
-				seen
+				seen,
+				work
 			)
-			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	sqlInsertSeed = `
@@ -134,6 +136,21 @@ const (
 			) VALUES (?, ?)
 	`
 
+	// only replaces a link if the attestation is newer than the one stored
+	sqlInsertAttestation = `
+			INSERT OR REPLACE INTO seed (
+				seed,
+				for,
+				collectionHash,
+				updated,
+				signature
+			) SELECT ?, ?, ?, ?, ?
+				WHERE NOT EXISTS (
+					SELECT 1 FROM seed
+						WHERE seed.seed = ? AND seed.for = ? AND IFNULL(seed.updated, 0) >= ?
+				)
+	`
+
 	sqlInsertFtsEntry = `
 			INSERT OR IGNORE INTO ftsEntry (
 				docid,
@@ -166,6 +183,16 @@ const (
 			WHERE seed.for = ?
 	`
 
+	// The seeders for a given address that have a live attestation, along with
+	// what is needed to rebuild it
+	sqlQueryAttestations = `
+		SELECT entry.address, entry.publicKey, seed.collectionHash, seed.updated, seed.signature
+			FROM entry
+			JOIN seed
+				ON entry.id = seed.seed
+			WHERE seed.for = ? AND seed.signature IS NOT NULL AND seed.updated >= ?
+	`
+
 	// pretty much the opposite of the above, get a list of addresses that the
 	// peer is seeding
 	sqlQuerySeeding = `
@@ -179,8 +206,49 @@ const (
 		SELECT MAX(id) FROM entry
 	`
 
+	// the newest 20 entries that have not expired
 	sqlQueryLatest = `
-		SELECT * FROM entry ORDER BY id DESC LIMIT 20
+		SELECT * FROM entry WHERE seen >= ? OR updated >= ?
+			ORDER BY id DESC LIMIT 20
+	`
+
+	sqlUpdateSeen = `
+		UPDATE entry SET seen=MAX(IFNULL(seen, 0), ?) WHERE address=?
+	`
+
+	/*
+		Garbage collection. An entry has expired if we have not heard from the
+		node since the cutoff, and the node has not signed a new entry since
+		either. Our own entry never expires.
+	*/
+	sqlQueryExpired = `
+		SELECT address FROM entry
+			WHERE IFNULL(seen, 0) < ? AND IFNULL(updated, 0) < ? AND address != ?
+	`
+
+	sqlDeleteExpiredFts = `
+		DELETE FROM ftsEntry WHERE docid IN (
+			SELECT id FROM entry
+				WHERE IFNULL(seen, 0) < ? AND IFNULL(updated, 0) < ? AND address != ?
+		)
+	`
+
+	sqlDeleteExpired = `
+		DELETE FROM entry
+			WHERE IFNULL(seen, 0) < ? AND IFNULL(updated, 0) < ? AND address != ?
+	`
+
+	// seed links where either side no longer exists
+	sqlDeleteDeadSeeds = `
+		DELETE FROM seed
+			WHERE seed.seed NOT IN (SELECT id FROM entry)
+				OR seed.for NOT IN (SELECT id FROM entry)
+	`
+
+	// links only backed by an attestation that has since expired
+	sqlDeleteExpiredAttestations = `
+		DELETE FROM seed
+			WHERE seed.signature IS NOT NULL AND seed.updated < ?
 	`
 
 	sqlSearchEntries = `
@@ -190,4 +258,91 @@ const (
 			)
 		LIMIT ?,?
 	`
+
+	/*
+		The routing table, one row per bucket, and one per node in a bucket.
+
+		id         - the index of the bucket in the table
+		lastSeen   - when any node in the bucket was last heard from
+		lastLookup - when a lookup last targeted the bucket
+		failures   - failed pings and queries to nodes in the bucket
+
+		address     - the encoded dfi address of the node
+		bucket      - the bucket the node is in
+		position    - 0 is the most recently seen
+		replacement - 1 if the node is in the replacement cache instead
+	*/
+	sqlCreateBucketTable = `
+			CREATE TABLE IF NOT EXISTS
+				bucket(
+					id INTEGER PRIMARY KEY NOT NULL,
+					lastSeen INT,
+					lastLookup INT,
+					failures INT
+				)
+	`
+
+	sqlCreateContactTable = `
+			CREATE TABLE IF NOT EXISTS
+				contact(
+					address STRING(40) PRIMARY KEY NOT NULL,
+					bucket INT NOT NULL,
+					position INT NOT NULL,
+					replacement INT NOT NULL,
+					lastSeen INT,
+					failures INT
+				)
+	`
+
+	// the proof of work for the entry's identity, added after the rest
+	sqlAddEntryWork = `
+			ALTER TABLE entry ADD COLUMN work BLOB
+	`
+
+	// seed links gain the attestation that backs them, links from a seed's own
+	// Seeding list have none
+	sqlAddSeedHash = `
+			ALTER TABLE seed ADD COLUMN collectionHash BLOB
+	`
+
+	sqlAddSeedUpdated = `
+			ALTER TABLE seed ADD COLUMN updated INT
+	`
+
+	sqlAddSeedSignature = `
+			ALTER TABLE seed ADD COLUMN signature BLOB
+	`
+
+	sqlIndexContactBuckets = `
+			CREATE INDEX IF NOT EXISTS
+				contactBucketIndex ON contact(bucket)
+	`
+
+	sqlQueryBuckets = `
+		SELECT id, lastSeen, lastLookup, failures FROM bucket
+	`
+
+	// the host comes from the entry, for the per-host limits
+	sqlQueryContacts = `
+		SELECT contact.bucket, contact.address, contact.replacement,
+			contact.lastSeen, contact.failures, IFNULL(entry.publicAddress, '')
+			FROM contact
+			LEFT JOIN entry ON entry.address = contact.address
+			ORDER BY contact.bucket, contact.replacement, contact.position
+	`
+
+	sqlReplaceBucket = `
+		INSERT OR REPLACE INTO bucket (id, lastSeen, lastLookup, failures)
+			VALUES (?, ?, ?, ?)
+	`
+
+	sqlDeleteBucketContacts = `
+		DELETE FROM contact WHERE bucket=?
+	`
+
+	sqlInsertContact = `
+		INSERT OR REPLACE INTO contact (address, bucket, position, replacement,
+			lastSeen, failures)
+			VALUES (?, ?, ?, ?, ?, ?)
+	`
 )
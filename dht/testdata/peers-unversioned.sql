@@ -0,0 +1,35 @@
+-- peers.db as created before schema versioning.
+CREATE TABLE entry(
+	id INTEGER PRIMARY KEY NOT NULL,
+	address STRING(40) UNIQUE,
+	name STRING(64) NOT NULL,
+	desc STRING(256),
+	publicAddress STRING(256) NOT NULL,
+	port INT,
+	publicKey BLOB(32) NOT NULL,
+	signature BLOB(64),
+	collectionHash BLOB(32),
+	postCount INT,
+	seedCount INT,
+	seedingCount INT,
+	updated INT,
+	seen INT
+);
+
+CREATE TABLE seed(
+	id INTEGER PRIMARY KEY NOT NULL,
+	seed INTEGER NOT NULL,
+	for INTEGER NOT NULL,
+	UNIQUE(seed, for) ON CONFLICT REPLACE
+);
+
+CREATE VIRTUAL TABLE ftsEntry using fts4(
+	content="entry",
+	name,
+	desc
+);
+
+CREATE INDEX addressIndex ON entry(address);
+
+INSERT INTO entry VALUES(1, 'fixture', 'fixture', 'a peer from before versioning',
+	'localhost', 5050, x'00', x'00', x'00', 0, 0, 0, 0, 0);
@@ -0,0 +1,67 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// The number of leading zero bits an entry's proof of work must have, zero
+// accepts entries without any. The work is done once per identity, so minting
+// lots of addresses to surround a target gets expensive.
+var RequiredWork = 0
+
+// How much work a nonce proves for a public key, the number of leading zero
+// bits in SHA3-256(publicKey | work).
+func WorkDifficulty(publicKey, work []byte) int {
+	if len(work) == 0 {
+		return 0
+	}
+
+	buf := make([]byte, 0, len(publicKey)+len(work))
+	buf = append(buf, publicKey...)
+	buf = append(buf, work...)
+
+	hash := sha3.Sum256(buf)
+	addr := Address{Raw: hash[:]}
+
+	return addr.LeadingZeroes()
+}
+
+// Finds a nonce with at least the given difficulty for a public key. Each bit
+// of difficulty doubles how long this takes.
+func GenerateWork(publicKey []byte, difficulty int) []byte {
+	work := make([]byte, 8)
+
+	for i := uint64(0); ; i++ {
+		binary.BigEndian.PutUint64(work, i)
+
+		if WorkDifficulty(publicKey, work) >= difficulty {
+			return work
+		}
+	}
+}
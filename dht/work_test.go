@@ -0,0 +1,116 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dht_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dfindex/dfi/dht"
+	"golang.org/x/crypto/ed25519"
+)
+
+// A signed entry on the given host, with proof of work of at least difficulty.
+func entryWithWork(t *testing.T, host string, difficulty int) dht.Entry {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	fatalErr(err, t)
+
+	entry := dht.Entry{
+		Name:          randString(10),
+		PublicKey:     pub,
+		PublicAddress: host,
+		Port:          5050,
+	}
+	entry.Address.Generate(pub)
+
+	if difficulty > 0 {
+		entry.Work = dht.GenerateWork(pub, difficulty)
+	}
+
+	dat, err := entry.Bytes()
+	fatalErr(err, t)
+
+	entry.Signature = ed25519.Sign(priv, dat)
+
+	return entry
+}
+
+func TestEntryWork(t *testing.T) {
+	defer func() { dht.RequiredWork = 0 }()
+
+	entry := entryWithWork(t, "localhost", 8)
+
+	if dht.WorkDifficulty(entry.PublicKey, entry.Work) < 8 {
+		t.Fatal("Generated work is too easy")
+	}
+
+	none := entryWithWork(t, "localhost", 0)
+
+	// without a requirement anything goes
+	fatalErr(entry.Verify(), t)
+	fatalErr(none.Verify(), t)
+
+	dht.RequiredWork = 8
+
+	fatalErr(entry.Verify(), t)
+
+	if none.Verify() == nil {
+		t.Fatal("Entry without work verified")
+	}
+}
+
+func TestTableHostLimits(t *testing.T) {
+	db := dbWithRandomAddress(t)
+
+	for i := 0; i < dht.MaxContactsPerHost+2; i++ {
+		_, err := db.Insert(entryWithWork(t, "10.1.1.1", 0))
+		fatalErr(err, t)
+	}
+
+	if db.TableLen() != dht.MaxContactsPerHost {
+		t.Fatalf("Host given %d slots", db.TableLen())
+	}
+
+	db = dbWithRandomAddress(t)
+
+	for i := 0; i < dht.MaxContactsPerSubnet+5; i++ {
+		_, err := db.Insert(entryWithWork(t, fmt.Sprintf("10.2.2.%d", i), 0))
+		fatalErr(err, t)
+	}
+
+	if db.TableLen() != dht.MaxContactsPerSubnet {
+		t.Fatalf("Subnet given %d slots", db.TableLen())
+	}
+
+	// onion addresses and domains are only limited per host
+	for i := 0; i < 5; i++ {
+		_, err := db.Insert(entryWithWork(t, randString(16)+".onion", 0))
+		fatalErr(err, t)
+	}
+
+	if db.TableLen() != dht.MaxContactsPerSubnet+5 {
+		t.Fatalf("Table has %d nodes", db.TableLen())
+	}
+}
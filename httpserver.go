@@ -36,9 +36,14 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"github.com/dfindex/dfi/data"
+
 	log "github.com/sirupsen/logrus"
 )
 
+// Uploads larger than this are buffered to temporary files.
+const MaxImportMemory = 32 << 20
+
 type HttpServer struct {
 	CommandServer *CommandServer
 }
@@ -60,12 +65,20 @@ func (hs *HttpServer) ListenHttp(addr string) {
 	router.HandleFunc("/peer/{address}/mirror/", hs.Mirror)
 	router.HandleFunc("/peer/{address}/mirrorprogress/", hs.MirrorProgress)
 	router.HandleFunc("/peer/{address}/index/{since}/", hs.PeerFtsIndex)
+	router.HandleFunc("/peer/{address}/piece/{id}/", hs.PeerPiece)
+	router.HandleFunc("/peer/{address}/export/{format}/", hs.Export)
 
 	router.HandleFunc("/self/addpost/", hs.AddPost).Methods("POST")
+	router.HandleFunc("/self/import/", hs.Import).Methods("POST")
+	router.HandleFunc("/self/export/{format}/", hs.Export)
+	router.HandleFunc("/self/importsnapshot/", hs.ImportSnapshot).Methods("POST")
+	router.HandleFunc("/self/deletepost/{id}/", hs.DeletePost).Methods("POST")
+	router.HandleFunc("/self/amendpost/{id}/", hs.AmendPost).Methods("POST")
 	router.HandleFunc("/self/index/{since}/", hs.FtsIndex)
 	router.HandleFunc("/self/resolve/{address}/", hs.Resolve)
 	router.HandleFunc("/self/bootstrap/{address}/", hs.Bootstrap)
 	router.HandleFunc("/self/search/", hs.SelfSearch).Methods("POST")
+	router.HandleFunc("/search/", hs.Search).Methods("POST")
 	router.HandleFunc("/self/suggest/", hs.SelfSuggest).Methods("POST")
 	router.HandleFunc("/self/recent/{page}/", hs.SelfRecent)
 	router.HandleFunc("/self/popular/{page}/", hs.SelfPopular)
@@ -73,6 +86,7 @@ func (hs *HttpServer) ListenHttp(addr string) {
 	router.HandleFunc("/self/savecollection/", hs.SaveCollection)
 	router.HandleFunc("/self/rebuildcollection/", hs.RebuildCollection)
 	router.HandleFunc("/self/peers/", hs.Peers)
+	router.HandleFunc("/self/gc/", hs.CollectGarbage)
 	router.HandleFunc("/self/requestaddpeer/{remote}/{peer}/", hs.RequestAddPeer)
 	router.HandleFunc("/self/set/{key}/", hs.SelfSet).Methods("POST")
 	router.HandleFunc("/self/get/{key}/", hs.SelfGet)
@@ -86,6 +100,10 @@ func (hs *HttpServer) ListenHttp(addr string) {
 
 	router.HandleFunc("/self/seedleech/", hs.SetSeedLeech).Methods("POST")
 	router.HandleFunc("/self/map/", hs.NetMap)
+	router.HandleFunc("/self/reputation/", hs.Reputation)
+	router.HandleFunc("/self/bans/", hs.Bans)
+	router.HandleFunc("/self/ban/", hs.Ban).Methods("POST")
+	router.HandleFunc("/self/unban/", hs.Unban).Methods("POST")
 
 	log.WithField("address", addr).Info("Starting HTTP server")
 
@@ -213,6 +231,22 @@ func (hs *HttpServer) PeerFtsIndex(w http.ResponseWriter, r *http.Request) {
 		CommandPeerIndex{CommandPeer{addr}, sincei}))
 }
 
+func (hs *HttpServer) PeerPiece(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	addr := vars["address"]
+	id := vars["id"]
+
+	idi, err := strconv.Atoi(id)
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.PeerPiece(
+		CommandPeerPiece{CommandPeer{addr}, idi}))
+}
+
 func (hs *HttpServer) AddPost(w http.ResponseWriter, r *http.Request) {
 	pj := r.FormValue("data")
 	index := r.FormValue("index") == "true"
@@ -231,6 +265,114 @@ func (hs *HttpServer) AddPost(w http.ResponseWriter, r *http.Request) {
 
 	write_http_response(w, hs.CommandServer.AddPost(post))
 }
+func (hs *HttpServer) Import(w http.ResponseWriter, r *http.Request) {
+	var ci CommandImport
+
+	err := r.ParseMultipartForm(MaxImportMemory)
+
+	if err != nil && err != http.ErrNotMultipart {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	ci.Magnets = r.Form["magnet"]
+	ci.Index = r.FormValue("index") == "true"
+
+	if r.MultipartForm != nil {
+		for _, i := range r.MultipartForm.File["file"] {
+			f, err := i.Open()
+
+			if err != nil {
+				write_http_response(w, CommandResult{false, nil, err})
+				return
+			}
+
+			defer f.Close()
+
+			ci.Files = append(ci.Files, ImportFile{i.Filename, f})
+		}
+	}
+
+	write_http_response(w, hs.CommandServer.Import(ci))
+}
+
+// Used for both our own index and mirrors, the address is empty for our own.
+func (hs *HttpServer) Export(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	format := vars["format"]
+	name := vars["address"]
+
+	if name == "" {
+		name = hs.CommandServer.LocalPeer.Address().StringOr("index")
+	}
+
+	switch format {
+	case SnapshotFormat:
+		w.Header().Set("Content-Type", "application/gzip")
+		name += ".tar.gz"
+	case data.ExportCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+		name += ".csv"
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+		name += "." + format
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+
+	res := hs.CommandServer.Export(CommandExport{CommandPeer{vars["address"]}, format, w})
+
+	if !res.IsOK {
+		// if anything has been written already this just ends up in the log
+		w.Header().Del("Content-Disposition")
+		write_http_response(w, res)
+	}
+}
+func (hs *HttpServer) ImportSnapshot(w http.ResponseWriter, r *http.Request) {
+	f, _, err := r.FormFile("file")
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	defer f.Close()
+
+	write_http_response(w, hs.CommandServer.ImportSnapshot(CommandImportSnapshot{f}))
+}
+func (hs *HttpServer) DeletePost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	write_http_response(w, hs.CommandServer.DeletePost(CommandDeletePost{id}))
+}
+func (hs *HttpServer) AmendPost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	var post CommandAmendPost
+	err = json.Unmarshal([]byte(r.FormValue("data")), &post)
+
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	post.Id = id
+
+	write_http_response(w, hs.CommandServer.AmendPost(post))
+}
 func (hs *HttpServer) FtsIndex(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
@@ -255,6 +397,28 @@ func (hs *HttpServer) Bootstrap(w http.ResponseWriter, r *http.Request) {
 
 	write_http_response(w, hs.CommandServer.Bootstrap(CommandBootstrap{vars["address"]}))
 }
+func (hs *HttpServer) Search(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	peers := r.FormValue("peers") == "true"
+
+	pagei, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil {
+		write_http_response(w, CommandResult{false, nil, err})
+		return
+	}
+
+	timeout := 0
+	if r.FormValue("timeout") != "" {
+		timeout, err = strconv.Atoi(r.FormValue("timeout"))
+		if err != nil {
+			write_http_response(w, CommandResult{false, nil, err})
+			return
+		}
+	}
+
+	write_http_response(w, hs.CommandServer.Search(CommandSearch{
+		CommandSelfSearch{CommandSuggest{query}, pagei}, peers, timeout}))
+}
 func (hs *HttpServer) SelfSearch(w http.ResponseWriter, r *http.Request) {
 	query := r.FormValue("query")
 	page := r.FormValue("page")
@@ -329,6 +493,9 @@ func (hs *HttpServer) SaveCollection(w http.ResponseWriter, r *http.Request) {
 func (hs *HttpServer) RebuildCollection(w http.ResponseWriter, r *http.Request) {
 	write_http_response(w, hs.CommandServer.RebuildCollection(nil))
 }
+func (hs *HttpServer) CollectGarbage(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.CollectGarbage(nil))
+}
 func (hs *HttpServer) Peers(w http.ResponseWriter, r *http.Request) {
 	write_http_response(w, hs.CommandServer.Peers(nil))
 }
@@ -458,3 +625,39 @@ func (hs *HttpServer) NetMap(w http.ResponseWriter, r *http.Request) {
 	res := hs.CommandServer.NetMap(CommandNetMap{hs.CommandServer.LocalPeer.Entry.Address.StringOr("")})
 	write_http_response(w, res)
 }
+
+func (hs *HttpServer) Reputation(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Reputation(nil))
+}
+
+func (hs *HttpServer) Bans(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Bans(nil))
+}
+
+func (hs *HttpServer) Ban(w http.ResponseWriter, r *http.Request) {
+	var duration int64
+	var err error
+
+	if d := r.FormValue("duration"); d != "" {
+		duration, err = strconv.ParseInt(d, 10, 64)
+
+		if err != nil {
+			write_http_response(w, CommandResult{false, nil, err})
+			return
+		}
+	}
+
+	write_http_response(w, hs.CommandServer.Ban(CommandBan{
+		Address:  r.FormValue("address"),
+		Public:   r.FormValue("public"),
+		Reason:   r.FormValue("reason"),
+		Duration: duration,
+	}))
+}
+
+func (hs *HttpServer) Unban(w http.ResponseWriter, r *http.Request) {
+	write_http_response(w, hs.CommandServer.Unban(CommandUnban{
+		Address: r.FormValue("address"),
+		Public:  r.FormValue("public"),
+	}))
+}
@@ -0,0 +1,178 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dfindex/dfi/data"
+)
+
+// Posts are written in transactions of this many.
+const ImportBatchSize = 1000
+
+type ImportResult struct {
+	Added      int `json:"added"`
+	Duplicates int `json:"duplicates"`
+	Invalid    int `json:"invalid"`
+}
+
+// Adds posts in bulk. Unlike AddPost, which rehashes a piece and re-signs our
+// entry for every post, posts are added in batches and the collection and
+// entry are only updated once everything has been added, in Close.
+type Importer struct {
+	lp     *LocalPeer
+	batch  []data.Post
+	seen   map[string]bool
+	first  int64
+	last   int64
+	result ImportResult
+}
+
+func (lp *LocalPeer) NewImporter() *Importer {
+	return &Importer{
+		lp:    lp,
+		batch: make([]data.Post, 0, ImportBatchSize),
+		seen:  make(map[string]bool),
+	}
+}
+
+// Queues a post to be added. Invalid and duplicate posts are counted and
+// skipped rather than being an error, so one bad line does not stop a dump.
+func (im *Importer) Add(p data.Post) error {
+	if p.Valid() != nil || p.InfoHash == "" {
+		im.result.Invalid++
+		return nil
+	}
+
+	if im.seen[p.InfoHash] {
+		im.result.Duplicates++
+		return nil
+	}
+
+	im.seen[p.InfoHash] = true
+	im.batch = append(im.batch, p)
+
+	if len(im.batch) >= ImportBatchSize {
+		return im.flush()
+	}
+
+	return nil
+}
+
+// Writes the queued posts, and a signed add operation for each, in one
+// transaction.
+func (im *Importer) flush() error {
+	lp := im.lp
+
+	lp.postMutex.Lock()
+	defer lp.postMutex.Unlock()
+
+	next := int(lp.Database.PostCount()) + 1
+	opId := lp.Database.LastOperation() + 1
+	ops := make([]*data.Operation, 0, len(im.batch))
+
+	for _, p := range im.batch {
+		existing, err := lp.Database.QueryInfoHash(p.InfoHash)
+
+		if err != nil {
+			return err
+		}
+
+		if existing.Id != 0 {
+			im.result.Duplicates++
+			continue
+		}
+
+		p.Id = next
+
+		op := &data.Operation{
+			Id:      opId,
+			Type:    data.OpAdd,
+			PostId:  p.Id,
+			Post:    p,
+			Created: time.Now().Unix(),
+		}
+
+		op.Sign(lp)
+		ops = append(ops, op)
+
+		next++
+		opId++
+	}
+
+	im.batch = im.batch[:0]
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	err := lp.Database.ApplyOperations(ops)
+
+	if err != nil {
+		return err
+	}
+
+	if im.first == 0 {
+		im.first = int64(ops[0].PostId)
+	}
+
+	im.last = int64(ops[len(ops)-1].PostId)
+	im.result.Added += len(ops)
+
+	log.WithField("count", len(ops)).Info("Imported posts")
+
+	return nil
+}
+
+// Writes anything still queued, optionally indexes the new posts, then
+// rehashes the pieces they are in and signs our entry.
+func (im *Importer) Close(index bool) (ImportResult, error) {
+	err := im.flush()
+
+	if err != nil || im.result.Added == 0 {
+		return im.result, err
+	}
+
+	lp := im.lp
+
+	if index {
+		err = lp.Database.GenerateFts(im.first)
+
+		if err != nil {
+			return im.result, err
+		}
+	}
+
+	lp.postMutex.Lock()
+	defer lp.postMutex.Unlock()
+
+	lp.Entry.PostCount += im.result.Added
+
+	return im.result, lp.updateCollection(im.first, im.last)
+}
@@ -28,29 +28,32 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/dfindex/dfi/common"
 	"github.com/dfindex/dfi/dht"
 )
 
 const ExploreFrequency = time.Minute * 2
 const ExploreBufferSize = 100
 
+// Runs a FIND_NODE lookup for the target, starting from the seed as well as
+// our own routing table.
+type FindNode func(target dht.Address, seed dht.Entry) (dht.Entries, error)
+
 // This job runs every two minutes, and tries to build the netdb with as many
 // entries as it possibly can
 func ExploreJob(in chan dht.Entry, data ...interface{}) <-chan dht.Entry {
 	ret := make(chan dht.Entry, ExploreBufferSize)
 
-	connector := data[0].(func(dht.Address) (interface{}, error))
+	findNode := data[0].(func(dht.Address, dht.Entry) (dht.Entries, error))
 	me := data[1].(dht.Address)
 	seed := data[2].(func(ret chan dht.Entry))
 
 	ticker := time.NewTicker(ExploreFrequency)
 
-	go exploreTick(in, ret, me, connector, seed)
+	go exploreTick(in, ret, me, findNode, seed)
 
 	go func() {
 		for _ = range ticker.C {
-			go exploreTick(in, ret, me, connector, seed)
+			go exploreTick(in, ret, me, findNode, seed)
 		}
 
 	}()
@@ -58,7 +61,7 @@ func ExploreJob(in chan dht.Entry, data ...interface{}) <-chan dht.Entry {
 	return ret
 }
 
-func exploreTick(in chan dht.Entry, ret chan dht.Entry, me dht.Address, connector common.ConnectPeer, seed func(chan dht.Entry)) {
+func exploreTick(in chan dht.Entry, ret chan dht.Entry, me dht.Address, findNode FindNode, seed func(chan dht.Entry)) {
 	i := <-in
 	s, _ := i.Address.String()
 
@@ -68,7 +71,7 @@ func exploreTick(in chan dht.Entry, ret chan dht.Entry, me dht.Address, connecto
 
 	log.WithField("peer", s).Info("Exploring")
 
-	if err := explorePeer(i.Address, me, ret, connector); err != nil {
+	if err := explorePeer(i, me, ret, findNode); err != nil {
 		log.Error(err.Error())
 	}
 
@@ -78,14 +81,8 @@ func exploreTick(in chan dht.Entry, ret chan dht.Entry, me dht.Address, connecto
 	}
 }
 
-func explorePeer(addr dht.Address, me dht.Address, ret chan<- dht.Entry, connectPeer common.ConnectPeer) error {
-	peer, err := connectPeer(addr)
-	p := peer.(common.Peer)
-
-	if err != nil {
-		return err
-	}
-
+// Looks up a random address, then our own, starting from the given entry.
+func explorePeer(entry dht.Entry, me dht.Address, ret chan<- dht.Entry, findNode FindNode) error {
 	randAddr, err := dht.RandomAddress()
 
 	if err != nil {
@@ -93,20 +90,20 @@ func explorePeer(addr dht.Address, me dht.Address, ret chan<- dht.Entry, connect
 	}
 
 	log.Debug("Exploring random")
-	closest, err := p.FindClosest(*randAddr)
+	closest, err := findNode(*randAddr, entry)
 
 	if err != nil {
 		return err
 	}
 
 	for _, i := range closest {
-		if !i.(*dht.Entry).Address.Equals(&me) {
-			ret <- *(i.(*dht.Entry))
+		if !i.Address.Equals(&me) {
+			ret <- *i
 		}
 	}
 
 	log.Debug("Exploring closest to self")
-	closestToMe, err := p.FindClosest(me)
+	closestToMe, err := findNode(me, entry)
 
 	if err != nil {
 		return err
@@ -114,8 +111,8 @@ func explorePeer(addr dht.Address, me dht.Address, ret chan<- dht.Entry, connect
 	log.Debug("Explored closest")
 
 	for _, i := range closestToMe {
-		if !i.(*dht.Entry).Address.Equals(&me) {
-			ret <- *(i.(*dht.Entry))
+		if !i.Address.Equals(&me) {
+			ret <- *i
 		}
 	}
 
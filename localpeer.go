@@ -29,12 +29,14 @@
 package dfi
 
 import (
+	"context"
 	"errors"
+	"io"
 	"io/ioutil"
-	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -42,6 +44,7 @@ import (
 	"golang.org/x/crypto/ed25519"
 
 	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/data/sqlite"
 	"github.com/dfindex/dfi/dht"
 	"github.com/dfindex/dfi/jobs"
 	"github.com/dfindex/dfi/proto"
@@ -51,15 +54,22 @@ import (
 const ResolveListSize = 1
 const TimeBeforeReExplore = 60 * 60
 
+// Where everything is stored if no DataDir is set.
+const DefaultDataDir = "./data"
+
+// How often expired entries are removed from the DHT.
+const GCFrequency = time.Hour
+
 type LocalPeer struct {
 	Peer
 	Entry         *dht.Entry
 	DHT           *dht.DHT
 	Server        *proto.Server
 	Collection    *data.Collection
-	Database      *data.Database
+	Database      data.PostStore
 	PublicAddress string
-	// These are the databases of all of the peers that we have mirrored.
+	// These are the databases of all of the peers that we have mirrored, all
+	// values are a data.PostStore.
 	Databases   cmap.ConcurrentMap
 	Collections cmap.ConcurrentMap
 
@@ -68,6 +78,29 @@ type LocalPeer struct {
 	privateKey  ed25519.PrivateKey
 	peerManager *PeerManager
 	seedManager *SeedManager
+
+	// Held while posts are added or changed, so post ids and operation ids are
+	// handed out in order.
+	postMutex sync.Mutex
+
+	// The directory the identity, peers.db, collections and mirrors are kept
+	// in, DefaultDataDir if empty. Must be set before ReadKey is called.
+	DataDir string
+
+	// How long DHT entries are kept without being seen or updated,
+	// dht.DefaultEntryTTL if zero.
+	EntryTTL time.Duration
+}
+
+// A path within the data directory.
+func (lp *LocalPeer) DataPath(parts ...string) string {
+	dir := lp.DataDir
+
+	if dir == "" {
+		dir = DefaultDataDir
+	}
+
+	return filepath.Join(append([]string{dir}, parts...)...)
 }
 
 func (lp *LocalPeer) Setup() {
@@ -83,24 +116,35 @@ func (lp *LocalPeer) Setup() {
 
 	lp.Address().Generate(lp.PublicKey())
 
-	lp.DHT = dht.NewDHT(lp.address, "./data/peers.db")
-	lp.DHT.LoadTable("./data/table.dat")
+	if lp.EntryTTL == 0 {
+		lp.EntryTTL = dht.DefaultEntryTTL
+	}
+
+	lp.DHT = dht.NewDHT(lp.address, lp.DataPath("peers.db"), lp.EntryTTL)
+	lp.DHT.SetPinger(lp.peerManager.pingAddress)
 
 	if err != nil {
 		panic(err)
 	}
 
-	lp.Collection, err = data.LoadCollection("./data/collection.dat")
+	lp.Collection, err = data.LoadCollection(lp.DataPath("collection.dat"))
 
 	if err != nil {
 		lp.Collection = data.NewCollection()
 		log.Info("Created new collection")
 	}
 
-	// Loop through all the databases of other peers in ./data, load them.
+	// mirrors are kept in a directory named after the peer's address
+	mirrorPath := regexp.QuoteMeta(lp.DataPath()) + "/(\\w+)/.+"
+
+	// Loop through all the databases of other peers in the data directory, load them.
 	handler := func(path string, info os.FileInfo, err error) error {
-		if path != "data/posts.db" && info.Name() == "posts.db" {
-			r, err := regexp.Compile("data/(\\w+)/.+")
+		if err != nil {
+			return err
+		}
+
+		if path != lp.DataPath("posts.db") && info.Name() == "posts.db" {
+			r, err := regexp.Compile(mirrorPath)
 
 			if err != nil {
 				return err
@@ -108,7 +152,7 @@ func (lp *LocalPeer) Setup() {
 
 			addr := r.FindStringSubmatch(path)
 
-			db := data.NewDatabase(path)
+			db := sqlite.NewDatabase(path)
 
 			err = db.Connect()
 
@@ -122,8 +166,8 @@ func (lp *LocalPeer) Setup() {
 
 			lp.Databases.Set(addr[1], db)
 
-		} else if path != "data/collection.dat" && info.Name() == "collection.dat" {
-			r, err := regexp.Compile("data/(\\w+)/.+")
+		} else if path != lp.DataPath("collection.dat") && info.Name() == "collection.dat" {
+			r, err := regexp.Compile(mirrorPath)
 
 			if err != nil {
 				return err
@@ -142,17 +186,27 @@ func (lp *LocalPeer) Setup() {
 		return nil
 	}
 
-	filepath.Walk("./data", handler)
+	filepath.Walk(lp.DataPath(), handler)
 
 	lp.SearchProvider = data.NewSearchProvider()
 
 	lp.capabilities.Compression = append(lp.capabilities.Compression,
-		[]string{"gzip", "none"}...)
+		proto.Compressions...)
+	lp.capabilities.PieceFormats = append(lp.capabilities.PieceFormats,
+		proto.PieceFormats...)
+	lp.capabilities.Encryption = append(lp.capabilities.Encryption,
+		proto.Encryptions...)
 
 	lp.Server = proto.NewServer(&lp.capabilities)
 }
 
 func (lp *LocalPeer) SignEntry() {
+	// only ever done once, the work is saved along with the entry
+	if dht.WorkDifficulty(lp.PublicKey(), lp.Entry.Work) < dht.RequiredWork {
+		log.WithField("difficulty", dht.RequiredWork).Info("Generating proof of work for identity")
+		lp.Entry.Work = dht.GenerateWork(lp.PublicKey(), dht.RequiredWork)
+	}
+
 	lp.Entry.Updated = uint64(time.Now().Unix())
 	data, _ := lp.Entry.Bytes()
 	copy(lp.Entry.Signature, ed25519.Sign(lp.privateKey, data))
@@ -173,9 +227,18 @@ func (lp *LocalPeer) Listen(addr string) {
 	}
 
 	lp.SignEntry()
+
+	// before listening, so banned peers are refused from the start
+	if err = lp.peerManager.LoadBans(); err != nil {
+		log.Error(err.Error())
+	}
+
 	go lp.Server.Listen(addr, lp, lp.Entry)
 	go lp.QuerySelf()
 	go lp.peerManager.LoadSeeds()
+	go lp.peerManager.RefreshBuckets()
+	go lp.peerManager.CollectLimiters()
+	go lp.collectGarbage()
 
 	lp.seedManager.Start()
 }
@@ -200,7 +263,7 @@ func (lp *LocalPeer) WriteKey() error {
 			New("LocalPeer does not have a private key, please generate")
 	}
 
-	err := ioutil.WriteFile("./data/identity.dat", lp.privateKey, 0400)
+	err := ioutil.WriteFile(lp.DataPath("identity.dat"), lp.privateKey, 0400)
 
 	return err
 }
@@ -208,7 +271,7 @@ func (lp *LocalPeer) WriteKey() error {
 // Read the private key from file. This is the "identity.dat" file. The public
 // key is also then generated from the private key.
 func (lp *LocalPeer) ReadKey() error {
-	pk, err := ioutil.ReadFile("./data/identity.dat")
+	pk, err := ioutil.ReadFile(lp.DataPath("identity.dat"))
 
 	if err != nil {
 		return err
@@ -234,11 +297,11 @@ func (lp *LocalPeer) SaveEntry() error {
 		return err
 	}
 
-	return ioutil.WriteFile("./data/entry.json", []byte(dat), 0644)
+	return ioutil.WriteFile(lp.DataPath("entry.json"), []byte(dat), 0644)
 }
 
 func (lp *LocalPeer) LoadEntry() error {
-	dat, err := ioutil.ReadFile("./data/entry.json")
+	dat, err := ioutil.ReadFile(lp.DataPath("entry.json"))
 
 	if err != nil {
 		return err
@@ -257,7 +320,7 @@ func (lp *LocalPeer) LoadEntry() error {
 
 func (lp *LocalPeer) Close() {
 	lp.CloseStreams()
-	lp.DHT.SaveTable("./data/table.dat")
+	lp.DHT.Close()
 	lp.Server.Close()
 	lp.Database.Close()
 }
@@ -271,30 +334,273 @@ func (lp *LocalPeer) AddPost(p data.Post, store bool) (int64, error) {
 		return -1, valid
 	}
 
-	lp.Entry.PostCount += 1
+	lp.postMutex.Lock()
+	defer lp.postMutex.Unlock()
 
 	id, err := lp.Database.InsertPost(p)
 
-	pieceIndex := int(math.Floor(float64(id) / float64(data.PieceSize)))
-	piece, err := lp.Database.QueryPiece(uint(pieceIndex), false)
+	if err != nil {
+		return id, err
+	}
+
+	lp.Entry.PostCount += 1
+
+	p.Id = int(id)
+
+	err = lp.logOperation(data.OpAdd, p)
+
+	if err != nil {
+		return id, err
+	}
+
+	return id, lp.updateCollection(id, id)
+}
+
+// Retracts a post, the row is kept but cleared. See data.Post.Tombstone.
+func (lp *LocalPeer) DeletePost(id int) error {
+	log.WithField("id", id).Info("Deleting post")
+
+	lp.postMutex.Lock()
+	defer lp.postMutex.Unlock()
+
+	post, err := lp.Database.QueryPostId(uint(id))
+
+	if err != nil {
+		return err
+	}
+
+	if post.Id != id || post.IsTombstone() {
+		return errors.New("No post with that id")
+	}
+
+	post.Tombstone()
+
+	err = lp.logOperation(data.OpTombstone, post)
+
+	if err != nil {
+		return err
+	}
+
+	return lp.updateCollection(int64(id), int64(id))
+}
+
+// Replaces the content of a post, seeders and leechers are left as they are.
+func (lp *LocalPeer) AmendPost(id int, p data.Post) error {
+	log.WithField("id", id).Info("Amending post")
+
+	lp.postMutex.Lock()
+	defer lp.postMutex.Unlock()
+
+	current, err := lp.Database.QueryPostId(uint(id))
+
+	if err != nil {
+		return err
+	}
+
+	if current.Id != id || current.IsTombstone() {
+		return errors.New("No post with that id")
+	}
+
+	p.Id = id
+	p.Seeders = current.Seeders
+	p.Leechers = current.Leechers
+
+	err = p.Valid()
+
+	if err != nil {
+		return err
+	}
+
+	err = lp.logOperation(data.OpAmend, p)
+
+	if err != nil {
+		return err
+	}
+
+	return lp.updateCollection(int64(id), int64(id))
+}
+
+// Signs an operation on the given post, then applies it and adds it to the log.
+func (lp *LocalPeer) logOperation(opType string, p data.Post) error {
+	op := &data.Operation{
+		Id:      lp.Database.LastOperation() + 1,
+		Type:    opType,
+		PostId:  p.Id,
+		Created: time.Now().Unix(),
+	}
+
+	if opType != data.OpTombstone {
+		op.Post = p
+	}
+
+	op.Sign(lp)
+
+	return lp.Database.ApplyOperation(op)
+}
+
+// Rehashes the pieces containing the posts from first to last, then updates and
+// signs the collection hash in our entry.
+func (lp *LocalPeer) updateCollection(first, last int64) error {
+	// ids start at 1, pieces at 0
+	for i := (first - 1) / data.PieceSize; i <= (last-1)/data.PieceSize; i++ {
+		piece, err := lp.Database.QueryPiece(uint(i), false)
+
+		if err != nil {
+			return err
+		}
+
+		lp.Collection.Put(piece)
+	}
 
-	lp.Collection.Add(piece)
 	lp.Collection.Rehash()
-	lp.Collection.Save("./data/collection.dat")
+	lp.Collection.Save(lp.DataPath("collection.dat"))
 
 	hash := lp.Collection.Hash()
 
 	lp.Entry.CollectionHash = make([]byte, len(hash))
 	copy(lp.Entry.CollectionHash, hash)
 
+	lp.SignEntry()
+
+	return lp.SaveEntry()
+}
+
+// The database a mirror of the given address is kept in, created if we do not
+// have one yet.
+func (lp *LocalPeer) MirrorDatabase(address dht.Address) (data.PostStore, error) {
+	key := address.StringOr("")
+
+	if db, ok := lp.Databases.Get(key); ok {
+		return db.(data.PostStore), nil
+	}
+
+	d := lp.DataPath(key)
+
+	os.Mkdir(d, 0777)
+
+	db := sqlite.NewDatabase(filepath.Join(d, "posts.db"))
+
+	err := db.Connect()
+
 	if err != nil {
-		return id, err
+		return nil, err
 	}
 
-	lp.SignEntry()
-	err = lp.SaveEntry()
+	lp.Databases.Set(key, db)
+
+	return db, nil
+}
+
+// Throws away a mirror that could not be verified, so that it is neither
+// searched nor served to others, and the next mirror starts over.
+func (lp *LocalPeer) DiscardMirror(address dht.Address) error {
+	key := address.StringOr("")
+
+	if db, ok := lp.Databases.Get(key); ok {
+		db.(data.PostStore).Close()
+		lp.Databases.Remove(key)
+	}
+
+	lp.Collections.Remove(key)
+
+	return os.RemoveAll(lp.DataPath(key))
+}
+
+// Our own index, or the mirror of another peer's, with the entry that signs it.
+func (lp *LocalPeer) Index(address dht.Address) (data.PostStore, *dht.Entry, error) {
+	if address.Equals(lp.Address()) {
+		return lp.Database, lp.Entry, nil
+	}
+
+	db, ok := lp.Databases.Get(address.StringOr(""))
+
+	if !ok {
+		return nil, nil, errors.New("Index has not been mirrored")
+	}
+
+	entry, err := lp.DHT.Query(address)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if entry == nil {
+		return nil, nil, errors.New("No entry for the index")
+	}
 
-	return id, err
+	return db.(data.PostStore), entry, nil
+}
+
+// Writes a snapshot of our own index, or of one we have mirrored.
+func (lp *LocalPeer) ExportSnapshot(address dht.Address, w io.Writer) error {
+	db, entry, err := lp.Index(address)
+
+	if err != nil {
+		return err
+	}
+
+	// our own index must not change between hashing and writing
+	if address.Equals(lp.Address()) {
+		lp.postMutex.Lock()
+		defer lp.postMutex.Unlock()
+	}
+
+	return WriteSnapshot(w, entry, db)
+}
+
+// Verifies a snapshot, then stores it as a mirror of its origin. The operation
+// log is not part of a snapshot, it is fetched the next time the index is
+// mirrored over the network. If anything fails once the mirror has been opened,
+// it is discarded rather than left half filled.
+func (lp *LocalPeer) ImportSnapshot(r io.Reader) (entry *dht.Entry, err error) {
+	var mirror *dht.Address
+
+	defer func() {
+		if err != nil && mirror != nil {
+			if e := lp.DiscardMirror(*mirror); e != nil {
+				log.Error(e.Error())
+			}
+		}
+	}()
+
+	entry, col, err := ReadSnapshot(r, func(entry *dht.Entry) (data.PostStore, error) {
+		if entry.Address.Equals(lp.Address()) {
+			return nil, errors.New("Cannot import a snapshot of our own index")
+		}
+
+		current, err := lp.DHT.Query(entry.Address)
+
+		if err == nil && current != nil && current.Updated > entry.Updated {
+			return nil, errors.New("Snapshot is older than the entry we already have")
+		}
+
+		mirror = &entry.Address
+
+		return lp.MirrorDatabase(entry.Address)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = lp.DHT.Insert(*entry)
+
+	if err != nil {
+		return nil, err
+	}
+
+	address := entry.Address.StringOr("")
+	err = col.Save(lp.DataPath(address, "collection.dat"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	lp.Collections.Set(address, col.HashList)
+
+	log.WithField("peer", address).Info("Imported snapshot")
+
+	return entry, nil
 }
 
 func (lp *LocalPeer) StartExploring() error {
@@ -313,9 +619,8 @@ func (lp *LocalPeer) StartExploring() error {
 	}
 
 	ret := jobs.ExploreJob(in,
-		func(addr dht.Address) (interface{}, error) {
-			peer, _, err := lp.ConnectPeer(addr)
-			return peer, err
+		func(target dht.Address, seed dht.Entry) (dht.Entries, error) {
+			return lp.FindNode(target, &seed)
 		},
 		lp.address,
 		func(in chan dht.Entry) { lp.seedExplore(in, &seen) })
@@ -335,6 +640,10 @@ func (lp *LocalPeer) StartExploring() error {
 				continue
 			}
 
+			if lp.peerManager.BannedEntry(&i) {
+				continue
+			}
+
 			ps, err := i.Address.String()
 
 			if err != nil {
@@ -378,7 +687,7 @@ func (lp *LocalPeer) StartExploring() error {
 					// ours
 
 				} else if len(i.Seeds) > len(current.Seeds) {
-					current.Seeds = util.MergeSeeds(current.Seeds, i.Seeds)
+					current.Seeds = dht.MergeSeeds(current.Seeds, i.VerifiedSeeds())
 
 					_, err := lp.DHT.Insert(i)
 
@@ -440,7 +749,7 @@ func (lp *LocalPeer) seedExplore(in chan dht.Entry, seen *cmap.ConcurrentMap) er
 			}
 		}*/
 
-		if !i.Address.Equals(lp.Address()) {
+		if !i.Address.Equals(lp.Address()) && !lp.peerManager.BannedEntry(i) {
 			in <- *i
 		}
 	}
@@ -506,6 +815,14 @@ func (lp *LocalPeer) Resolve(addr dht.Address) (*dht.Entry, error) {
 	return lp.peerManager.Resolve(addr)
 }
 
+func (lp *LocalPeer) Banned(addr *dht.Address, public string) bool {
+	return lp.peerManager.Banned(addr, public)
+}
+
+func (lp *LocalPeer) FindNode(target dht.Address, seeds ...*dht.Entry) (dht.Entries, error) {
+	return lp.peerManager.FindNode(target, seeds...)
+}
+
 func (lp *LocalPeer) QueryEntry(addr dht.Address) (*dht.Entry, error) {
 	if addr.Equals(lp.Address()) {
 		return lp.Entry, nil
@@ -524,6 +841,26 @@ func (lp *LocalPeer) QueryEntry(addr dht.Address) (*dht.Entry, error) {
 	return kv, nil
 }
 
+// Removes expired entries from the DHT every GCFrequency.
+func (lp *LocalPeer) collectGarbage() {
+	ticker := time.NewTicker(GCFrequency)
+
+	for _ = range ticker.C {
+		result, err := lp.DHT.CollectGarbage()
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"entries":  result.Entries,
+			"seeds":    result.Seeds,
+			"contacts": result.Contacts,
+		}).Info("Collected DHT garbage")
+	}
+}
+
 func (lp *LocalPeer) QuerySelf() {
 	log.Info("Querying for seeds")
 	ticker := time.NewTicker(time.Minute * 5)
@@ -533,9 +870,7 @@ func (lp *LocalPeer) QuerySelf() {
 			continue
 		}
 
-		i := lp.Entry.Seeds[util.CryptoRandInt(0, int64(len(lp.Entry.Seeds)))]
-
-		addr := dht.Address{Raw: i}
+		addr := lp.Entry.Seeds[util.CryptoRandInt(0, int64(len(lp.Entry.Seeds)))].Seed
 
 		if addr.Equals(lp.Address()) {
 			continue
@@ -555,18 +890,23 @@ func (lp *LocalPeer) QuerySelf() {
 			continue
 		}
 
-		e, err := peer.Query(*lp.Address())
+		e, err := peer.Query(context.Background(), *lp.Address())
 
 		if err != nil {
 			continue
 		}
 		entry := e.(*dht.Entry)
 
-		if len(entry.Seeds) > len(lp.Entry.Seeds) {
+		// our own list is pruned at the same time, so seeds that stopped
+		// attesting drop off
+		seeds := dht.MergeSeeds(lp.Entry.VerifiedSeeds(), entry.VerifiedSeeds())
+
+		if len(seeds) > len(lp.Entry.Seeds) {
 			log.WithField("from", s).Info("Found new seeds for self")
-			lp.Entry.Seeds = util.MergeSeeds(lp.Entry.Seeds, entry.Seeds)
 		}
 
+		lp.Entry.Seeds = seeds
+
 		time.Sleep(time.Minute * 5)
 	}
 }
@@ -576,10 +916,19 @@ func (lp *LocalPeer) AddEntry(entry dht.Entry) error {
 	return err
 }
 
+// A signed attestation that this peer is seeding the entry, as of now.
+func (lp *LocalPeer) Attest(entry dht.Entry) dht.Attestation {
+	attestation := dht.NewAttestation(lp, entry)
+	data, _ := attestation.Bytes()
+	attestation.Signature = lp.Sign(data)
+
+	return attestation
+}
+
 func (lp *LocalPeer) AddSeeding(entry dht.Entry) error {
 	// save with the local entry, then the remote
 	lp.Entry.Seeding = append(lp.Entry.Seeding, entry.Address.Raw)
-	entry.Seeds = append(entry.Seeds, lp.Address().Raw)
+	entry.Seeds = dht.MergeSeeds(entry.Seeds, []dht.Attestation{lp.Attest(entry)})
 
 	lp.SignEntry()
 
@@ -0,0 +1,51 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dfi
+
+import (
+	"testing"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
+)
+
+// A duplicate is refused before it is counted or logged.
+func TestAddPostDuplicate(t *testing.T) {
+	db := data.NewMemoryStore()
+	db.InsertPost(data.Post{InfoHash: "a", Title: "ubuntu", Size: 1})
+	db.InsertPost(data.Post{InfoHash: "b", Title: "debian", Size: 1})
+
+	lp := &LocalPeer{Entry: &dht.Entry{PostCount: 2}, Database: db}
+
+	id, err := lp.AddPost(data.Post{InfoHash: "a", Title: "ubuntu again", Size: 1}, false)
+
+	if err != data.ErrDuplicatePost {
+		t.Fatal("Duplicate post was added as ", id)
+	}
+
+	if lp.Entry.PostCount != 2 || db.LastOperation() != 0 {
+		t.Fatal("Duplicate post was counted or logged")
+	}
+}
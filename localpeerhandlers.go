@@ -27,13 +27,13 @@ package dfi
 
 import (
 	"bufio"
-	"compress/gzip"
+	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"io/ioutil"
 
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/vmihailenco/msgpack.v2"
 
 	"github.com/dfindex/dfi/data"
 	"github.com/dfindex/dfi/dht"
@@ -156,12 +156,27 @@ func (lp *LocalPeer) HandleAnnounce(msg *proto.Message) error {
 		return err
 	}
 
+	// checked here as well as on insert, so the announcer can be held to it
+	if err = entry.Verify(); err != nil {
+		if msg.From != nil {
+			lp.peerManager.Report(*msg.From, EventBadEntry)
+		}
+
+		cl.WriteErr(err)
+		return err
+	}
+
 	affected, err := lp.DHT.Insert(entry)
 
 	if err == nil && affected > 0 {
 		cl.WriteMessage(&proto.Message{Header: proto.ProtoOk})
 		log.WithField("peer", entry.Address.StringOr("")).Info("Saved new peer")
 
+	} else if err != nil {
+		// let the announcer know why, a rollback or a bad clock is worth
+		// telling apart from anything else
+		cl.WriteErr(err)
+		return err
 	} else {
 		cl.WriteMessage(&proto.Message{Header: proto.ProtoNo})
 		return errors.New("Failed to save entry")
@@ -185,6 +200,7 @@ func (lp *LocalPeer) HandleSearch(msg *proto.Message) error {
 	posts, err := lp.Database.Search(sq.Query, sq.Page, 25)
 
 	if err != nil {
+		msg.Client.WriteErr(err)
 		return err
 	}
 	log.Info("Posts loaded")
@@ -270,6 +286,35 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 
 	log.WithField("address", address.StringOr("")).Info("Collection request recieved")
 
+	hashList, err := lp.hashListFor(address)
+
+	if err != nil {
+		return err
+	}
+
+	mhl := proto.MessageCollection{
+		HashList: hashList,
+		Size:     len(hashList) / data.HashSize,
+	}
+
+	resp := &proto.Message{
+		Header: proto.ProtoHashList,
+	}
+
+	resp.Write(mhl)
+
+	if err != nil {
+		return err
+	}
+
+	msg.Client.WriteMessage(resp)
+
+	return nil
+}
+
+// Returns the hash list for either the local peer, or for a peer that we have
+// mirrored.
+func (lp *LocalPeer) hashListFor(address dht.Address) ([]byte, error) {
 	var hashList []byte
 
 	entry, err := lp.DHT.Query(address)
@@ -281,7 +326,7 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if address.Equals(lp.Address()) {
@@ -291,37 +336,20 @@ func (lp *LocalPeer) HandleHashList(msg *proto.Message) error {
 	} else if entry != nil {
 		// load the hashlist from disk, if it exists. If not, err
 		// if not "err", then it'd probably read its own collection
-		hl, err := ioutil.ReadFile(fmt.Sprintf("./data/%s/collection.dat", address.StringOr("err")))
+		hl, err := ioutil.ReadFile(lp.DataPath(address.StringOr("err"), "collection.dat"))
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		hashList = make([]byte, len(hl))
 		copy(hashList, hl)
 
 	} else {
-		return errors.New("Cannot return collection hash list")
-	}
-
-	mhl := proto.MessageCollection{
-		HashList: hashList,
-		Size:     len(hashList) / 32,
-	}
-
-	resp := &proto.Message{
-		Header: proto.ProtoHashList,
-	}
-
-	resp.Write(mhl)
-
-	if err != nil {
-		return err
+		return nil, errors.New("Cannot return collection hash list")
 	}
 
-	msg.Client.WriteMessage(resp)
-
-	return nil
+	return hashList, nil
 }
 
 func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
@@ -338,19 +366,52 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 		return err
 	}
 
-	var posts chan *data.Post
+	// since ProtoVersionSlowDown the pieces follow a response, so that the
+	// request can be refused
+	respond := msg.Client.Version() >= proto.ProtoVersionSlowDown
+
+	refuse := func(err error) error {
+		if respond {
+			msg.Client.WriteErr(err)
+		}
+
+		return err
+	}
+
+	// older peers do not ask for a compression, and expect gzip
+	compression := mrp.Compression
+	if compression == "" {
+		compression = proto.CompressionGzip
+	}
+
+	// checked before the query starts, as it would be left blocking
+	if !proto.HasCompression(compression) {
+		return refuse(errors.New("Unknown compression: " + compression))
+	}
+
+	var db data.PostStore
 
 	if mrp.Address == lp.Address().StringOr("") {
-		posts = lp.Database.QueryPiecePosts(mrp.Id, mrp.Length, true)
+		db = lp.Database
 
 	} else if lp.Databases.Has(mrp.Address) {
-		db, _ := lp.Databases.Get(mrp.Address)
-		posts = db.(*data.Database).QueryPiecePosts(mrp.Id, mrp.Length, true)
+		d, _ := lp.Databases.Get(mrp.Address)
+		db = d.(data.PostStore)
 
 	} else {
-		return errors.New("Piece not found")
+		return refuse(errors.New("Piece not found"))
 	}
 
+	if respond {
+		err = msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoOk})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	posts := db.QueryPiecePosts(mrp.Id, mrp.Length, true)
+
 	// Buffered writer -> gzip -> net
 	// or
 	// gzip -> buffered writer -> net
@@ -358,15 +419,39 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 	// The former may allow for database reads to occur a little faster though.
 	// buffer both?
 	bw := bufio.NewWriter(msg.Stream)
-	gzw := gzip.NewWriter(bw)
+	cw, err := proto.NewCompressWriter(compression, bw)
 
-	for i := range posts {
-		i.Write("|", "", true, gzw)
+	if err != nil {
+		return err
 	}
 
-	(&data.Post{Id: -1}).Write("|", "", true, gzw)
+	if mrp.Format == proto.PieceFormatMsgpack {
+		encoder := msgpack.NewEncoder(cw)
 
-	gzw.Flush()
+		// keep reading on failure, so the query is not left blocking
+		for i := range posts {
+			if err == nil {
+				err = encoder.Encode(i)
+			}
+		}
+
+		if err == nil {
+			err = encoder.Encode(&data.Post{Id: -1})
+		}
+
+		if err != nil {
+			return err
+		}
+
+	} else {
+		for i := range posts {
+			i.Write("|", "", true, cw)
+		}
+
+		(&data.Post{Id: -1}).Write("|", "", true, cw)
+	}
+
+	cw.Close()
 	bw.Flush()
 
 	log.Info("Sent all")
@@ -374,35 +459,159 @@ func (lp *LocalPeer) HandlePiece(msg *proto.Message) error {
 	return nil
 }
 
+// Sends a single piece, with the audit path needed to verify it against the
+// collection hash in the entry.
+func (lp *LocalPeer) HandlePieceProof(msg *proto.Message) error {
+	mrp := proto.MessageRequestPieceProof{}
+	err := msg.Read(&mrp)
+
+	if err != nil {
+		return err
+	}
+
+	log.WithField("id", mrp.Id).Info("Recieved piece proof request")
+
+	address, err := dht.DecodeAddress(mrp.Address)
+
+	if err != nil {
+		msg.Client.WriteErr(err)
+		return err
+	}
+
+	var db data.PostStore
+
+	if address.Equals(lp.Address()) {
+		db = lp.Database
+
+	} else if lp.Databases.Has(mrp.Address) {
+		d, _ := lp.Databases.Get(mrp.Address)
+		db = d.(data.PostStore)
+
+	} else {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return errors.New("Piece not found")
+	}
+
+	hashList, err := lp.hashListFor(address)
+
+	if err != nil {
+		msg.Client.WriteErr(err)
+		return err
+	}
+
+	proof, err := data.MerkleProof(hashList, mrp.Id)
+
+	if err != nil {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return err
+	}
+
+	piece, err := db.QueryPiece(uint(mrp.Id), true)
+
+	if err != nil {
+		msg.Client.WriteErr(err)
+		return err
+	}
+
+	resp := &proto.Message{
+		Header: proto.ProtoPieceProof,
+	}
+
+	err = resp.Write(proto.MessagePieceProof{
+		Id:    mrp.Id,
+		Size:  len(hashList) / data.HashSize,
+		Proof: proof,
+		Posts: piece.Posts,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return msg.Client.WriteMessage(resp)
+}
+
+// Sends part of the operation log for either the local peer, or a peer we
+// mirror.
+func (lp *LocalPeer) HandleOperations(msg *proto.Message) error {
+	mro := proto.MessageRequestOperations{}
+	err := msg.Read(&mro)
+
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"address": mro.Address,
+		"since":   mro.Since,
+	}).Info("Recieved operations request")
+
+	var db data.PostStore
+
+	if mro.Address == lp.Address().StringOr("") {
+		db = lp.Database
+
+	} else if lp.Databases.Has(mro.Address) {
+		d, _ := lp.Databases.Get(mro.Address)
+		db = d.(data.PostStore)
+
+	} else {
+		msg.Client.WriteMessage(&proto.Message{Header: proto.ProtoNo})
+		return errors.New("Operations not found")
+	}
+
+	ops, err := db.QueryOperations(mro.Since, proto.MaxOperations)
+
+	if err != nil {
+		return err
+	}
+
+	resp := &proto.Message{
+		Header: proto.ProtoOperations,
+	}
+
+	err = resp.Write(ops)
+
+	if err != nil {
+		return err
+	}
+
+	return msg.Client.WriteMessage(resp)
+}
+
 func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
-	// The AddPeer message contains the address of the peer that the client
-	// wishes to be registered for.
+	// The AddPeer message contains the attestation of the peer that the client
+	// wishes to be registered for, signed by the client.
 
-	address := dht.Address{}
-	err := msg.Read(&address)
+	attestation := dht.Attestation{}
+	err := msg.Read(&attestation)
 
 	if err != nil {
 		return err
 	}
 
 	from, _ := msg.From.String()
-	pfor, _ := address.String()
+	pfor, _ := attestation.For.String()
 	log.WithFields(log.Fields{"from": from, "for": pfor}).Info("Handling add peer request")
 
-	if address.Equals(lp.Address()) {
+	err = attestation.Verify()
 
-		add := true
+	if err == nil && !attestation.Seed.Equals(msg.From) {
+		err = errors.New("Attestation is not from the requesting peer")
+	} else if err == nil && attestation.Expired() {
+		err = errors.New("Attestation has expired")
+	}
 
-		for _, i := range lp.Entry.Seeds {
-			if msg.From.Equals(&dht.Address{Raw: i}) {
-				add = false
-			}
-		}
+	if err != nil {
+		msg.Client.WriteErr(err)
+		return err
+	}
 
-		if add {
-			b, _ := msg.From.Bytes()
-			lp.Entry.Seeds = append(lp.Entry.Seeds, b)
-		}
+	address := attestation.For
+	attestations := []dht.Attestation{attestation}
+
+	if address.Equals(lp.Address()) {
+		lp.Entry.Seeds = dht.MergeSeeds(lp.Entry.Seeds, attestations)
 
 		err := lp.SaveEntry()
 		if err != nil {
@@ -423,9 +632,7 @@ func (lp *LocalPeer) HandleAddPeer(msg *proto.Message) error {
 			return errors.New("Cannot add peer, do not have entry")
 		}
 
-		// read the address of the peer as raw bytes, and add it to the seed list
-		b, _ := msg.From.Bytes()
-		entry.Seeds = append(entry.Seeds, b)
+		entry.Seeds = dht.MergeSeeds(entry.Seeds, attestations)
 
 		log.WithFields(
 			log.Fields{
@@ -452,7 +659,7 @@ func (lp *LocalPeer) HandleHandshake(header proto.ConnHeader) (proto.NetworkPeer
 	lp.peerManager.SetPeer(peer)
 
 	// we have a "free" entry, insert it! Just in case :D
-	entry, err := peer.Entry()
+	entry, err := peer.Entry(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,102 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dfi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/proto"
+)
+
+// A peer connected to one whose own index is db.
+func testIndexSource(t *testing.T, db data.PostStore) (*Peer, func()) {
+	return testSource(t, "", data.NewMemoryStore(), func(lp *LocalPeer) proto.ProtocolHandler {
+		lp.Database = db
+		return lp
+	})
+}
+
+func TestHandleSearch(t *testing.T) {
+	db := data.NewMemoryStore()
+
+	for i, title := range []string{"ubuntu 16.04", "debian 9", "ubuntu 18.04"} {
+		db.InsertPost(data.Post{InfoHash: string(rune('a' + i)), Title: title, Size: 1})
+	}
+
+	peer, cleanup := testIndexSource(t, db)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	res, err := peer.Search(ctx, "ubuntu", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Posts) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(res.Posts))
+	}
+
+	for _, i := range res.Posts {
+		if i.Title != "ubuntu 16.04" && i.Title != "ubuntu 18.04" {
+			t.Fatal("Unexpected result ", i.Title)
+		}
+	}
+
+	// a bad filter is refused, rather than left to time out
+	if _, err = peer.Search(ctx, "ubuntu size:", 0); err == nil {
+		t.Fatal("Accepted an invalid search")
+	}
+
+	if ctx.Err() != nil {
+		t.Fatal("Invalid search was not answered")
+	}
+}
+
+func TestHandleRecent(t *testing.T) {
+	db := data.NewMemoryStore()
+
+	for i := 0; i < 30; i++ {
+		db.InsertPost(data.Post{InfoHash: string(rune('a' + i)), Title: "post", Size: 1, UploadDate: i})
+	}
+
+	peer, cleanup := testIndexSource(t, db)
+	defer cleanup()
+
+	posts, err := peer.Recent(context.Background(), 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(posts) != 25 || posts[0].Id != 30 {
+		t.Fatal("Unexpected first page of recent posts")
+	}
+}
@@ -32,10 +32,10 @@ package dfi
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"fmt"
-	"math"
 	"net"
+	"os"
 	"time"
 
 	"github.com/hashicorp/yamux"
@@ -50,13 +50,21 @@ import (
 	"github.com/dfindex/dfi/common"
 )
 
+// Returned by Mirror when the posts, once the operation log has been applied,
+// do not hash to the collection hash signed in the entry.
+var ErrMirrorMismatch = errors.New("Mirror does not match the collection hash")
+
 type Peer struct {
 	address dht.Address
 
 	publicKey ed25519.PublicKey
 	streams   proto.StreamManager
 
-	limiter *util.PeerLimiter
+	// the limits are kept by PeerManager, so reconnecting does not reset them
+	limiter func() *util.PeerLimiter
+
+	// the public address we connected to, empty if it connected to us
+	dialed string
 
 	entry *dht.Entry
 
@@ -65,12 +73,14 @@ type Peer struct {
 	seedFor *dht.Entry
 
 	capabilities proto.MessageCapabilities
-	compression  string
 
 	addSeedManager func(dht.Address) error
 	addSeeding     func(dht.Entry) error
+	attest         func(dht.Entry) dht.Attestation
 	addEntry       func(dht.Entry) error
 	updateSeen     func()
+	report         func(ReputationEvent)
+	dataPath       func(...string) string
 }
 
 func (p *Peer) UpdateSeen() {
@@ -79,6 +89,25 @@ func (p *Peer) UpdateSeen() {
 	}
 }
 
+// Records something this peer did against its reputation.
+func (p *Peer) Report(event ReputationEvent) {
+	if p.report != nil {
+		p.report(event)
+	}
+}
+
+// Called when the peer sends a message that is broken, unknown or over its
+// rate limit.
+func (p *Peer) InvalidMessage(err error) {
+	log.WithField("peer", p.Address().StringOr("")).Debug("Invalid message: ", err.Error())
+
+	if _, ok := err.(*proto.SlowDownError); ok {
+		p.Report(EventOverLimit)
+	} else {
+		p.Report(EventBadMessage)
+	}
+}
+
 func (p *Peer) EAddress() common.Encoder {
 	return &p.address
 }
@@ -95,7 +124,8 @@ func (p *Peer) Streams() *proto.StreamManager {
 	return &p.streams
 }
 
-func (p *Peer) Ping(timeOut time.Duration) (time.Duration, error) {
+// Pings the peer over its session, giving up once ctx is done.
+func (p *Peer) Ping(ctx context.Context) (time.Duration, error) {
 	type timeErr struct {
 		t   time.Duration
 		err error
@@ -111,9 +141,7 @@ func (p *Peer) Ping(timeOut time.Duration) (time.Duration, error) {
 		return -1, errors.New("Session closed")
 	}
 
-	timer := time.NewTimer(timeOut)
-
-	ret := make(chan timeErr)
+	ret := make(chan timeErr, 1)
 
 	go func() {
 		t, err := session.Ping()
@@ -124,17 +152,12 @@ func (p *Peer) Ping(timeOut time.Duration) (time.Duration, error) {
 	case ping := <-ret:
 		return ping.t, ping.err
 
-	case _ = <-timer.C:
-		return -1, errors.New("Timeout")
+	case <-ctx.Done():
+		return -1, ctx.Err()
 	}
 }
 
-func (p *Peer) Announce(lp *LocalPeer) error {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return err
-	}
-
+func (p *Peer) Announce(ctx context.Context, lp *LocalPeer) error {
 	log.WithField("peer", p.Address().StringOr("")).Debug("Sending announce")
 
 	if lp.Entry.PublicAddress == "" {
@@ -145,7 +168,7 @@ func (p *Peer) Announce(lp *LocalPeer) error {
 	}
 	lp.SignEntry()
 
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return err
@@ -153,7 +176,7 @@ func (p *Peer) Announce(lp *LocalPeer) error {
 
 	defer stream.Close()
 
-	err = stream.Announce(lp.Entry)
+	err = stream.Announce(ctx, lp.Entry)
 
 	return err
 }
@@ -170,9 +193,7 @@ func (p *Peer) Connect(addr string, lp *LocalPeer) error {
 	p.SetCapabilities(pair.Capabilities)
 	p.publicKey = pair.Entry.PublicKey
 	p.address = pair.Entry.Address
-
-	p.limiter = &util.PeerLimiter{}
-	p.limiter.Setup()
+	p.dialed = addr
 
 	lp.DHT.Insert(pair.Entry)
 
@@ -184,9 +205,37 @@ func (p *Peer) SetTCP(header proto.ConnHeader) {
 
 	p.publicKey = header.Entry.PublicKey
 	p.address = header.Entry.Address
+}
 
-	p.limiter = &util.PeerLimiter{}
-	p.limiter.Setup()
+// Limits the requests this peer makes of us. nil, allowing everything, until
+// PeerManager has set the peer up.
+// The host this peer can be banned by, empty if there is none. That is the one
+// we connected to, otherwise the one it connected from. Connections over Tor
+// come from the local proxy, banning it would ban every peer using Tor.
+func (p *Peer) PublicHost() string {
+	if p.dialed != "" {
+		return publicHost(p.dialed)
+	}
+
+	host := publicHost(p.streams.RemoteAddr())
+
+	if ip := net.ParseIP(host); ip == nil || ip.IsLoopback() {
+		return ""
+	}
+
+	return host
+}
+
+func (p *Peer) Limiter() *util.PeerLimiter {
+	if p.limiter == nil {
+		return nil
+	}
+
+	return p.limiter()
+}
+
+func (p *Peer) ProtocolVersion() int16 {
+	return p.streams.Version()
 }
 
 func (p *Peer) ConnectServer() (*yamux.Session, error) {
@@ -213,16 +262,23 @@ func (p *Peer) Terminate() {
 	p.streams.Close()
 }
 
-func (p *Peer) OpenStream() (*proto.Client, error) {
-	_, err := p.Ping(time.Second * 10)
+// Opens a stream for a request. A dead peer is noticed by the request itself,
+// which is bounded by ctx and the timeout for its header, see Client.Call.
+func (p *Peer) OpenStream(ctx context.Context) (*proto.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s, err := p.streams.OpenStream()
+
 	if err != nil {
 		return nil, err
 	}
 
-	p.UpdateSeen()
+	s.SetCompression(p.Compression())
+	s.SetVersion(p.ProtocolVersion())
 
-	s, err := p.streams.OpenStream()
-	return s, err
+	return s, nil
 }
 
 func (p *Peer) AddStream(conn net.Conn) {
@@ -241,21 +297,16 @@ func (p *Peer) CloseStreams() {
 	p.streams.Close()
 }
 
-func (p *Peer) Entry() (*dht.Entry, error) {
+func (p *Peer) Entry(ctx context.Context) (*dht.Entry, error) {
 	if p.entry != nil {
 		return p.entry, nil
 	}
 
-	return p.GetEntry()
+	return p.GetEntry(ctx)
 }
 
-func (p *Peer) GetEntry() (*dht.Entry, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
-	e, err := p.Query(*p.Address())
+func (p *Peer) GetEntry(ctx context.Context) (*dht.Entry, error) {
+	e, err := p.Query(ctx, *p.Address())
 
 	if err != nil {
 		return nil, err
@@ -274,13 +325,8 @@ func (p *Peer) GetEntry() (*dht.Entry, error) {
 	return p.entry, nil
 }
 
-func (p *Peer) Bootstrap(d *dht.DHT) error {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return err
-	}
-
-	stream, err := p.OpenStream()
+func (p *Peer) Bootstrap(ctx context.Context, d *dht.DHT) error {
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return err
@@ -288,19 +334,14 @@ func (p *Peer) Bootstrap(d *dht.DHT) error {
 
 	defer stream.Close()
 
-	return stream.Bootstrap(d, d.Address())
+	return stream.Bootstrap(ctx, d, d.Address())
 }
 
-func (p *Peer) Query(address dht.Address) (common.Verifier, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
+func (p *Peer) Query(ctx context.Context, address dht.Address) (common.Verifier, error) {
 	addressString, _ := address.String()
 	log.WithField("target", addressString).Info("Querying")
 
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return nil, err
@@ -308,21 +349,20 @@ func (p *Peer) Query(address dht.Address) (common.Verifier, error) {
 
 	defer stream.Close()
 
-	entry, err := stream.Query(address)
+	entry, err := stream.Query(ctx, address)
+
+	if _, ok := err.(*proto.InvalidEntryError); ok {
+		p.Report(EventBadEntry)
+	}
 
 	return entry, err
 }
 
-func (p *Peer) FindClosest(address dht.Address) ([]common.Verifier, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
+func (p *Peer) FindClosest(ctx context.Context, address dht.Address) ([]common.Verifier, error) {
 	addressString, _ := address.String()
 	log.WithField("target", addressString).Info("Finding closest")
 
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return nil, err
@@ -330,7 +370,7 @@ func (p *Peer) FindClosest(address dht.Address) ([]common.Verifier, error) {
 
 	defer stream.Close()
 
-	res, err := stream.FindClosest(address)
+	res, err := stream.FindClosest(ctx, address)
 
 	ret := make([]common.Verifier, 0, len(res))
 
@@ -342,14 +382,9 @@ func (p *Peer) FindClosest(address dht.Address) ([]common.Verifier, error) {
 }
 
 // asks a peer to query its database and return the results
-func (p *Peer) Search(search string, page int) (*data.SearchResult, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
+func (p *Peer) Search(ctx context.Context, search string, page int) (*data.SearchResult, error) {
 	log.WithField("peer", p.Address().StringOr("")).Info("Searching")
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return nil, err
@@ -357,7 +392,7 @@ func (p *Peer) Search(search string, page int) (*data.SearchResult, error) {
 
 	defer stream.Close()
 
-	posts, err := stream.Search(search, page)
+	posts, err := stream.Search(ctx, search, page)
 	res := &data.SearchResult{
 		Posts:  posts,
 		Source: p.Address().StringOr(""),
@@ -370,13 +405,8 @@ func (p *Peer) Search(search string, page int) (*data.SearchResult, error) {
 	return res, nil
 }
 
-func (p *Peer) Recent(page int) ([]*data.Post, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
-	stream, err := p.OpenStream()
+func (p *Peer) Recent(ctx context.Context, page int) ([]*data.Post, error) {
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return nil, err
@@ -384,19 +414,14 @@ func (p *Peer) Recent(page int) ([]*data.Post, error) {
 
 	defer stream.Close()
 
-	posts, err := stream.Recent(page)
+	posts, err := stream.Recent(ctx, page)
 
 	return posts, err
 
 }
 
-func (p *Peer) Popular(page int) ([]*data.Post, error) {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return nil, err
-	}
-
-	stream, err := p.OpenStream()
+func (p *Peer) Popular(ctx context.Context, page int) ([]*data.Post, error) {
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return nil, err
@@ -404,26 +429,20 @@ func (p *Peer) Popular(page int) ([]*data.Post, error) {
 
 	defer stream.Close()
 
-	posts, err := stream.Popular(page)
+	posts, err := stream.Popular(ctx, page)
 
 	return posts, err
 
 }
 
-func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error {
-	_, err := p.Ping(time.Second * 10)
-	if err != nil {
-		return err
-	}
-
-	pieces := make(chan *data.Piece, data.PieceSize)
+// Mirrors the index this peer has into db. Pieces are downloaded from this peer
+// and any seeds given in parallel.
+func (p *Peer) Mirror(ctx context.Context, db data.PostStore, lp dht.Address, seeds []*Peer, onPiece chan PieceProgress) error {
 	defer close(onPiece)
 
-	go db.InsertPieces(pieces, true)
-
 	var entry *dht.Entry
 	if p.seed {
-		e, err := p.Query(p.seedFor.Address)
+		e, err := p.Query(ctx, p.seedFor.Address)
 
 		if err != nil {
 			return err
@@ -431,13 +450,13 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 
 		entry = e.(*dht.Entry)
 	} else {
-		_, err = p.GetEntry()
+		_, err := p.GetEntry(ctx)
 
 		if err != nil {
 			return err
 		}
 
-		entry, err = p.Entry()
+		entry, err = p.Entry(ctx)
 
 		if err != nil {
 			return err
@@ -448,10 +467,7 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 
 	log.WithField("peer", entry.Address.StringOr("")).Info("Mirroring")
 
-	if err != nil {
-		return err
-	}
-	stream, err := p.OpenStream()
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return err
@@ -459,69 +475,67 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 
 	defer stream.Close()
 
-	mcol, err := stream.Collection(entry.Address, *entry)
+	mcol, err := stream.Collection(ctx, entry.Address, *entry)
 
 	if err != nil {
 		return err
 	}
 
-	collection := data.Collection{HashList: mcol.HashList}
+	path := p.dataPath(entry.Address.StringOr("err"), "collection.dat")
 
-	err = collection.Save(fmt.Sprintf("./data/%s/collection.dat", entry.Address.StringOr("err")))
+	// what we had last time we mirrored, if anything
+	local, err := data.LoadCollection(path)
 
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	if int(db.PostCount()) == entry.PostCount {
-		return nil
-	}
+	changed := make([]int, 0)
 
-	currentStore := int(math.Ceil(float64(db.PostCount()) / float64(data.PieceSize)))
+	for i := 0; i < mcol.Size; i++ {
+		remote := mcol.HashList[data.HashSize*i : data.HashSize*i+data.HashSize]
 
-	since := 0
-	if currentStore != 0 {
-		since = currentStore - 1
+		if i >= local.Size() ||
+			!bytes.Equal(local.HashList[data.HashSize*i:data.HashSize*i+data.HashSize], remote) {
+			changed = append(changed, i)
+		}
 	}
 
-	log.WithField("size", mcol.Size).Info("Downloading collection")
+	log.WithFields(log.Fields{
+		"size":    mcol.Size,
+		"changed": len(changed),
+	}).Info("Downloading collection")
+
+	sources := append([]*Peer{p}, seeds...)
+	scheduler := NewPieceScheduler(entry.Address, mcol.HashList, db, sources)
 
-	pieceStream, err := p.OpenStream()
+	err = scheduler.Run(ctx, changed, onPiece)
 
 	if err != nil {
 		return err
 	}
 
-	defer pieceStream.Close()
-
-	piece_chan := pieceStream.Pieces(entry.Address, since, mcol.Size)
-
-	i := 0
-	for piece := range piece_chan {
-		log.Info(len(mcol.HashList))
-		hash := piece.Hash()
-
-		if !bytes.Equal(mcol.HashList[32*i:32*i+32], hash) {
-			return errors.New("Piece hash mismatch")
-		}
-
-		onPiece <- i
+	// only saved once everything has been applied, so that an interrupted
+	// mirror picks up where it left off
+	collection := data.Collection{HashList: mcol.HashList}
 
-		if len(pieces) == 100 {
-			log.Info("Piece buffer full, io is blocking")
-		}
-		pieces <- piece
+	err = collection.Save(path)
 
-		i++
+	if err != nil {
+		return err
 	}
 
-	log.Info("Mirror complete, generating index")
+	log.Info("Mirror complete")
+
+	// the pieces already contain the current state of each post, but the log
+	// is kept so that seeds can pass it on
+	err = p.syncOperations(ctx, db, entry)
 
 	if err != nil {
 		return err
 	}
 
-	err = p.RequestAddPeer(*entry)
+	err = p.RequestAddPeer(ctx, *entry)
 
 	// we're done mirroring, so now we need to switch OFF the fact that this is
 	// a seed. If it becomes a seed again, it will be properly set by the
@@ -529,18 +543,95 @@ func (p *Peer) Mirror(db *data.Database, lp dht.Address, onPiece chan int) error
 	p.seed = false
 	p.seedFor = nil
 
-	pieces <- nil
-
 	return err
 }
 
-func (p *Peer) RequestAddPeer(entry dht.Entry) error {
-	_, err := p.Ping(time.Second * 10)
+// Downloads and applies any operations (tombstones, amendments) that we do not
+// have yet. Each is checked against the public key in the entry, so seeds
+// cannot forge them. Once done the mirror should hash to the collection hash in
+// the entry again.
+func (p *Peer) syncOperations(ctx context.Context, db data.PostStore, entry *dht.Entry) error {
+	for {
+		stream, err := p.OpenStream(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		ops, err := stream.Operations(ctx, entry.Address, db.LastOperation())
+		stream.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if len(ops) == 0 {
+			break
+		}
+
+		last := db.LastOperation()
+
+		for _, op := range ops {
+			// already applied, a seed may send more than was asked for
+			if op.Id <= db.LastOperation() {
+				continue
+			}
+
+			if op.Id != db.LastOperation()+1 {
+				return errors.New("Operation log is not contiguous")
+			}
+
+			err = op.Verify(entry.PublicKey)
+
+			if err != nil {
+				return err
+			}
+
+			err = db.ApplyOperation(op)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		// a seed that only ever sends operations we have would keep us here
+		if db.LastOperation() <= last {
+			p.Report(EventBadMessage)
+			return errors.New("Peer sent no new operations")
+		}
+
+		log.WithField("count", db.LastOperation()-last).Info("Applied operations")
+	}
+
+	col, err := data.CreateCollection(db, 0, data.PieceSize)
+
 	if err != nil {
 		return err
 	}
 
-	stream, err := p.OpenStream()
+	if !bytes.Equal(col.Hash(), entry.CollectionHash) {
+		return ErrMirrorMismatch
+	}
+
+	return nil
+}
+
+// Fetch a single piece of the given entry's collection. The piece is verified
+// against the entry's signed collection hash, so this works with seeds too.
+func (p *Peer) Piece(ctx context.Context, entry dht.Entry, id int) (*data.Piece, error) {
+	stream, err := p.OpenStream(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stream.Close()
+
+	return stream.PieceProof(ctx, entry.Address, id, entry.CollectionHash)
+}
+
+func (p *Peer) RequestAddPeer(ctx context.Context, entry dht.Entry) error {
+	stream, err := p.OpenStream(ctx)
 
 	if err != nil {
 		return err
@@ -548,7 +639,7 @@ func (p *Peer) RequestAddPeer(entry dht.Entry) error {
 
 	defer stream.Close()
 
-	err = stream.RequestAddPeer(entry.Address)
+	err = stream.RequestAddPeer(ctx, p.attest(entry))
 	if err != nil {
 		return err
 	}
@@ -561,9 +652,7 @@ func (p *Peer) RequestAddPeer(entry dht.Entry) error {
 
 	// first register the peer as a seed for the entry given
 	for _, i := range entry.Seeds {
-		seedAddr := &dht.Address{Raw: i}
-
-		if seedAddr.Equals(&entry.Address) {
+		if i.Seed.Equals(&entry.Address) {
 			return nil
 		}
 	}
@@ -575,14 +664,31 @@ func (p *Peer) GetCapabilities() *proto.MessageCapabilities {
 	return &p.capabilities
 }
 
+// The piece format to request from this peer.
+func (p *Peer) PieceFormat() string {
+	return proto.ChoosePieceFormat(
+		proto.MessageCapabilities{PieceFormats: proto.PieceFormats}, p.capabilities)
+}
+
 func (p *Peer) SetCapabilities(caps proto.MessageCapabilities) {
 	p.capabilities = caps
 }
 
+// The compression to use for messages to this peer, empty if it predates
+// compression even if it claims to support some.
+func (p *Peer) Compression() string {
+	if p.ProtocolVersion() < proto.ProtoVersionCompression {
+		return ""
+	}
+
+	return proto.ChooseCompression(
+		p.capabilities, proto.MessageCapabilities{Compression: proto.Compressions})
+}
+
 func (p *Peer) NewMessage(header string) *proto.Message {
 	ret := &proto.Message{
 		Header:      header,
-		Compression: p.compression,
+		Compression: p.Compression(),
 	}
 
 	return ret
@@ -0,0 +1,132 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dfi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/proto"
+)
+
+// Never answers requests for recent posts.
+type silentHandler struct {
+	*LocalPeer
+	done chan bool
+}
+
+func (h silentHandler) HandleRecent(msg *proto.Message) error {
+	<-h.done
+	return nil
+}
+
+// Without a ping first, a peer that stops answering is noticed by the request
+// itself.
+func TestRequestUnanswered(t *testing.T) {
+	done := make(chan bool)
+	defer close(done)
+
+	peer, cleanup := testSource(t, "", data.NewMemoryStore(), func(lp *LocalPeer) proto.ProtocolHandler {
+		return silentHandler{lp, done}
+	})
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+
+	start := time.Now()
+	_, err := peer.Recent(ctx, 0)
+
+	if err == nil {
+		t.Fatal("Request to a silent peer succeeded")
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatal("Request outlived its context")
+	}
+}
+
+// Answers every operations request with the same, already applied, operations.
+type staleOpsHandler struct {
+	*LocalPeer
+	ops []*data.Operation
+}
+
+func (h staleOpsHandler) HandleOperations(msg *proto.Message) error {
+	resp := &proto.Message{Header: proto.ProtoOperations}
+
+	if err := resp.Write(h.ops); err != nil {
+		return err
+	}
+
+	return msg.Client.WriteMessage(resp)
+}
+
+type testSigner ed25519.PrivateKey
+
+func (s testSigner) Sign(msg []byte) []byte {
+	return ed25519.Sign(ed25519.PrivateKey(s), msg)
+}
+
+// A seed that keeps sending operations we already have must not keep the sync
+// going forever.
+func TestSyncOperationsStale(t *testing.T) {
+	db, entry, private := testIndex(t, 2)
+
+	op := &data.Operation{Id: 1, Type: data.OpTombstone, PostId: 1}
+	op.Sign(testSigner(private))
+
+	if err := db.ApplyOperation(op); err != nil {
+		t.Fatal(err)
+	}
+
+	reported := false
+
+	peer, cleanup := testSource(t, entry.Address.StringOr(""), db, func(lp *LocalPeer) proto.ProtocolHandler {
+		return staleOpsHandler{lp, []*data.Operation{op}}
+	})
+	defer cleanup()
+
+	peer.report = func(ReputationEvent) { reported = true }
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err := peer.syncOperations(ctx, db, entry); err == nil {
+		t.Fatal("Sync accepted a batch of operations it already had")
+	}
+
+	if ctx.Err() != nil {
+		t.Fatal("Sync only stopped at the deadline")
+	}
+
+	if !reported {
+		t.Fatal("Peer was not reported")
+	}
+}
@@ -25,6 +25,7 @@
 package dfi
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -34,6 +35,8 @@ import (
 
 	"github.com/dfindex/dfi/data"
 	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/proto"
+	"github.com/dfindex/dfi/util"
 	"github.com/spf13/viper"
 	"github.com/streamrail/concurrent-map"
 
@@ -43,12 +46,17 @@ import (
 const HeartbeatFrequency = time.Second * 30
 const AnnounceFrequency = time.Minute * 30
 
+// How often the routing table is checked for buckets that need refreshing.
+const RefreshFrequency = time.Minute * 10
+
+// How often rate limiters are dropped for peers that have gone.
+const LimiterGCFrequency = time.Minute * 10
+
 // errors
 
 var (
 	PeerUnreachable  = errors.New("Peer could not be reached")
 	PeerDisconnected = errors.New("Peer has disconnected")
-	RecursionLimit   = errors.New("Recursion limit reached, peer cannot be resolved")
 )
 
 // handles peer connections
@@ -62,6 +70,12 @@ type PeerManager struct {
 	publicToDFI  cmap.ConcurrentMap
 	seedManagers cmap.ConcurrentMap
 
+	// scores peers, and refuses those that are banned
+	reputation *ReputationManager
+
+	// rate limits by peer address, kept across reconnects
+	limiters cmap.ConcurrentMap
+
 	socks     bool
 	socksPort int
 	localPeer *LocalPeer
@@ -74,7 +88,9 @@ func NewPeerManager(lp *LocalPeer) *PeerManager {
 	ret.publicToDFI = cmap.New()
 	ret.seedManagers = cmap.New()
 	ret.peerSeen = cmap.New()
+	ret.limiters = cmap.New()
 	ret.localPeer = lp
+	ret.reputation = NewReputationManager(lp.DataPath("bans.json"))
 
 	return ret
 }
@@ -100,6 +116,10 @@ func (pm *PeerManager) ConnectPeerDirect(addr string) (*Peer, error) {
 	var peer *Peer
 	var err error
 
+	if pm.reputation.Banned(nil, addr) {
+		return nil, PeerBanned
+	}
+
 	dfiAddr, ok := pm.publicToDFI.Get(addr)
 	if ok {
 		if peer = pm.GetPeer(*dfiAddr.(*dht.Address)); peer != nil {
@@ -120,6 +140,14 @@ func (pm *PeerManager) ConnectPeerDirect(addr string) (*Peer, error) {
 		return nil, PeerUnreachable
 	}
 
+	// only now do we know who is at the address
+	if pm.reputation.Banned(peer.Address(), "") {
+		peer.Terminate()
+		return nil, PeerBanned
+	}
+
+	// it may make requests as soon as it is listened to
+	pm.limit(peer)
 	peer.ConnectClient(pm.localPeer)
 
 	pm.SetPeer(peer)
@@ -182,12 +210,13 @@ func (pm *PeerManager) GetPeer(addr dht.Address) *Peer {
 }
 
 func (pm *PeerManager) SetPeer(p *Peer) {
+	pm.limit(p)
 
 	if pm.peers.Has(string(p.Address().Raw)) {
 		return
 	}
 
-	e, err := p.Entry()
+	e, err := p.Entry(context.Background())
 
 	if err != nil {
 		log.Error(err.Error())
@@ -199,13 +228,21 @@ func (pm *PeerManager) SetPeer(p *Peer) {
 	p.addSeedManager = pm.AddSeedManager
 	p.addEntry = pm.localPeer.AddEntry
 	p.addSeeding = pm.localPeer.AddSeeding
+	p.attest = pm.localPeer.Attest
+	p.dataPath = pm.localPeer.DataPath
+
+	p.report = func(event ReputationEvent) {
+		pm.Report(*p.Address(), event)
+	}
 
 	p.updateSeen = func() {
 		pm.peerSeen.Set(string(p.Address().Raw), time.Now().UnixNano())
+		pm.localPeer.DHT.MarkSeen(*p.Address())
 	}
 
 	pm.peers.Set(string(p.Address().Raw), p)
 	pm.peerSeen.Set(string(p.Address().Raw), time.Now().UnixNano())
+	pm.reputation.Connected(*p.Address())
 
 	// if we need to clear space for another, remove the least recently used one
 	for pm.peers.Count() > viper.GetInt("net.maxPeers") {
@@ -250,6 +287,10 @@ func (pm *PeerManager) SetPeer(p *Peer) {
 }
 
 func (pm *PeerManager) HandleCloseConnection(addr *dht.Address) {
+	if pm.peers.Has(string(addr.Raw)) {
+		pm.reputation.Disconnected(*addr)
+	}
+
 	pm.peers.Remove(string(addr.Raw))
 	pm.peerSeen.Remove(string(addr.Raw))
 
@@ -260,6 +301,56 @@ func (pm *PeerManager) HandleCloseConnection(addr *dht.Address) {
 	}
 }
 
+// The rate limiter for the peer at addr, a new one if it has none.
+func (pm *PeerManager) Limiter(addr dht.Address) *util.PeerLimiter {
+	key := string(addr.Raw)
+
+	if limiter, ok := pm.limiters.Get(key); ok {
+		return limiter.(*util.PeerLimiter)
+	}
+
+	limiter := &util.PeerLimiter{}
+	limiter.Setup(proto.RateLimits)
+
+	if !pm.limiters.SetIfAbsent(key, limiter) {
+		// another connection from the same peer got there first
+		limiter.Stop()
+	}
+
+	ret, _ := pm.limiters.Get(key)
+
+	return ret.(*util.PeerLimiter)
+}
+
+// Limits the requests p makes by its address, rather than by connection.
+func (pm *PeerManager) limit(p *Peer) {
+	addr := *p.Address()
+	p.limiter = func() *util.PeerLimiter { return pm.Limiter(addr) }
+}
+
+// Drops the limiters of peers that are no longer connected, once they have
+// refilled. A new limiter is then no different, so reconnecting gains nothing.
+func (pm *PeerManager) CollectLimiters() {
+	ticker := time.NewTicker(LimiterGCFrequency)
+
+	for _ = range ticker.C {
+		pm.collectLimiters()
+	}
+}
+
+func (pm *PeerManager) collectLimiters() {
+	for _, key := range pm.limiters.Keys() {
+		limiter, ok := pm.limiters.Get(key)
+
+		if !ok || pm.peers.Has(key) || !limiter.(*util.PeerLimiter).Full() {
+			continue
+		}
+
+		pm.limiters.Remove(key)
+		limiter.(*util.PeerLimiter).Stop()
+	}
+}
+
 // Pings the peer regularly to check the connection
 func (pm *PeerManager) heartbeatPeer(p *Peer) {
 	ticker := time.NewTicker(HeartbeatFrequency)
@@ -278,7 +369,9 @@ func (pm *PeerManager) heartbeatPeer(p *Peer) {
 
 		log.WithField("peer", p.Address().StringOr("")).Debug("Sending heartbeat")
 		// allows for a suddenly slower connection, most requests have a lower timeout
-		_, err := p.Ping(HeartbeatFrequency)
+		ctx, cancel := context.WithTimeout(context.Background(), HeartbeatFrequency)
+		latency, err := p.Ping(ctx)
+		cancel()
 
 		if err != nil {
 			log.WithField("peer", p.Address().StringOr("")).Info("Peer has no heartbeat, terminating")
@@ -287,7 +380,100 @@ func (pm *PeerManager) heartbeatPeer(p *Peer) {
 
 			return
 		}
+
+		p.UpdateSeen()
+
+		if pm.reputation.RecordHeartbeat(*p.Address(), latency) {
+			pm.autoBan(*p.Address())
+		}
+	}
+}
+
+// Records something a peer did, banning it if its reputation falls too low.
+func (pm *PeerManager) Report(addr dht.Address, event ReputationEvent) {
+	if pm.reputation.Record(addr, event) {
+		pm.autoBan(addr)
+	}
+}
+
+// Bans the peer by its address and, if it is connected, its host as well.
+// Addresses cost nothing to make unless dht.RequiredWork is set, so a ban on
+// the address alone is easily dodged.
+func (pm *PeerManager) autoBan(addr dht.Address) {
+	ban := Ban{
+		Address: addr.StringOr(""),
+		Reason:  "Reputation too low",
+		Until:   time.Now().Add(AutoBanDuration).Unix(),
+	}
+
+	if p := pm.GetPeer(addr); p != nil {
+		ban.PublicAddress = p.PublicHost()
+	}
+
+	log.WithFields(log.Fields{
+		"peer":   ban.Address,
+		"public": ban.PublicAddress,
+	}).Warn("Peer reputation is too low, banning")
+
+	err := pm.Ban(ban)
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// Bans a peer, disconnecting it if it is connected.
+func (pm *PeerManager) Ban(ban Ban) error {
+	err := pm.reputation.Ban(ban)
+
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pm.Peers() {
+		public := ""
+
+		if p.entry != nil {
+			public = p.entry.PublicAddress
+		}
+
+		if pm.reputation.Banned(p.Address(), public) || pm.reputation.Banned(nil, p.PublicHost()) {
+			log.WithField("peer", p.Address().StringOr("")).Info("Disconnecting banned peer")
+
+			p.Terminate()
+			pm.HandleCloseConnection(p.Address())
+		}
 	}
+
+	return nil
+}
+
+func (pm *PeerManager) Unban(address, public string) error {
+	return pm.reputation.Unban(address, public)
+}
+
+// Whether a peer is banned, by either its DFI or public address.
+func (pm *PeerManager) Banned(addr *dht.Address, public string) bool {
+	return pm.reputation.Banned(addr, public)
+}
+
+// Whether the peer an entry is for is banned.
+func (pm *PeerManager) BannedEntry(entry *dht.Entry) bool {
+	return pm.reputation.Banned(&entry.Address, entry.PublicAddress)
+}
+
+func (pm *PeerManager) Bans() []Ban {
+	return pm.reputation.Bans()
+}
+
+func (pm *PeerManager) Reputations() []Reputation {
+	return pm.reputation.Reputations()
+}
+
+func (pm *PeerManager) LoadBans() error {
+	log.Info("Loading ban list")
+
+	return pm.reputation.Load()
 }
 
 func (pm *PeerManager) announcePeer(p *Peer) {
@@ -305,7 +491,7 @@ func (pm *PeerManager) announcePeer(p *Peer) {
 		}
 
 		log.WithField("peer", p.Address().StringOr("")).Info("Announcing to peer")
-		err := p.Announce(pm.localPeer)
+		err := p.Announce(context.Background(), pm.localPeer)
 
 		if err != nil {
 			return err
@@ -350,7 +536,7 @@ func (pm *PeerManager) AddSeedManager(addr dht.Address) error {
 
 func (pm *PeerManager) LoadSeeds() error {
 	log.Info("Loading seed list")
-	file, err := ioutil.ReadFile("./data/seeding.dat")
+	file, err := ioutil.ReadFile(pm.localPeer.DataPath("seeding.dat"))
 
 	if err != nil {
 		return err
@@ -373,8 +559,8 @@ func (pm *PeerManager) LoadSeeds() error {
 }
 
 // Resolves a DFI address into an entry. Hopefully we already have the entry,
-// in which case it's just loaded from disk. Otherwise, recursive network
-// queries are made to try and find it.
+// in which case it's just loaded from disk. Otherwise, an iterative lookup is
+// made to try and find it.
 func (pm *PeerManager) Resolve(addr dht.Address) (*dht.Entry, error) {
 	log.WithField("address", addr.StringOr("")).Debug("Resolving")
 
@@ -393,6 +579,10 @@ func (pm *PeerManager) Resolve(addr dht.Address) (*dht.Entry, error) {
 	}
 
 	if kv != nil {
+		if pm.BannedEntry(kv) {
+			return nil, PeerBanned
+		}
+
 		return kv, nil
 	}
 
@@ -403,87 +593,174 @@ func (pm *PeerManager) Resolve(addr dht.Address) (*dht.Entry, error) {
 		return nil, err
 	}
 
-	depth := 6
-	for _, i := range closest {
-		// TODO: Goroutine this.
-		entry, err := pm.resolveStep(i, addr, &depth)
+	pm.localPeer.DHT.RecordLookup(addr)
+	entry, err := dht.NewLookup(*pm.localPeer.Address(), addr, pm.lookupQuery).FindValue(closest)
 
-		if err != nil {
-			if err == RecursionLimit {
-				return nil, err
-			}
+	if err != nil {
+		return nil, err
+	}
 
-			log.Error(err.Error())
-			continue
-		}
+	if pm.BannedEntry(entry) {
+		return nil, PeerBanned
+	}
 
-		if entry == nil {
-			continue
-		}
+	pm.localPeer.DHT.Insert(*entry)
 
-		if entry.Address.Equals(&addr) {
-			pm.localPeer.DHT.Insert(*entry)
+	return entry, nil
+}
 
-			return entry, nil
-		}
+// Runs a FIND_NODE lookup for the target, starting from the closest entries in
+// our routing table as well as any seeds given. Returns the closest entries
+// that responded, it is up to the caller whether they are inserted.
+func (pm *PeerManager) FindNode(target dht.Address, seeds ...*dht.Entry) (dht.Entries, error) {
+	closest, err := pm.localPeer.DHT.FindClosest(target)
+
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("Address could not be resolved")
+	closest = append(closest, seeds...)
+
+	pm.localPeer.DHT.RecordLookup(target)
+	return dht.NewLookup(*pm.localPeer.Address(), target, pm.lookupQuery).FindNode(closest)
 }
 
-// Will return the entry itself, or an error.
-func (pm *PeerManager) resolveStep(e *dht.Entry, addr dht.Address, depth *int) (*dht.Entry, error) {
-	// connect to the peer
-	var peer *Peer
-	var err error
+// Asks a single peer during a lookup, see dht.QueryFunc. Whether it responded
+// is recorded in the routing table. Banned peers are never asked.
+func (pm *PeerManager) lookupQuery(contact *dht.Entry, target dht.Address, findValue bool) (*dht.Entry, dht.Entries, error) {
+	if pm.BannedEntry(contact) {
+		return nil, nil, PeerBanned
+	}
+
+	value, closer, err := pm.queryContact(contact, target, findValue)
 
-	if *depth == 0 {
-		return nil, RecursionLimit
+	if err != nil {
+		pm.localPeer.DHT.MarkFailed(contact.Address)
+	} else {
+		pm.localPeer.DHT.MarkSeen(contact.Address)
 	}
-	*depth -= 1
 
-	log.WithField("peer", e.Address.StringOr("")).Info("Querying for resolve")
+	return value, closer, err
+}
 
-	peer = pm.GetPeer(e.Address)
+func (pm *PeerManager) queryContact(contact *dht.Entry, target dht.Address, findValue bool) (*dht.Entry, dht.Entries, error) {
+	log.WithField("peer", contact.Address.StringOr("")).Debug("Querying for lookup")
 
-	if peer == nil {
-		peer, err = pm.ConnectPeerDirect(fmt.Sprintf("%s:%d", e.PublicAddress, e.Port))
+	peer, err := pm.connectEntry(contact)
 
-		if err != nil {
-			return nil, err
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if findValue {
+		// an error here just means the peer does not have it
+		kv, err := peer.Query(context.Background(), target)
+
+		if entry, ok := kv.(*dht.Entry); err == nil && ok && entry != nil {
+			return entry, nil, nil
 		}
 	}
 
-	kv, err := peer.Query(addr)
+	closest, err := peer.FindClosest(context.Background(), target)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if kv != nil {
-		entry := kv
-		return entry.(*dht.Entry), err
+	ret := make(dht.Entries, 0, len(closest))
+	invalid := false
+
+	for _, i := range closest {
+		entry, ok := i.(*dht.Entry)
+
+		if !ok || entry == nil {
+			continue
+		}
+
+		if entry.Verify() != nil {
+			invalid = true
+			continue
+		}
+
+		if !pm.BannedEntry(entry) {
+			ret = append(ret, entry)
+		}
+	}
+
+	// once per response, the rest are likely just as bad
+	if invalid {
+		peer.Report(EventBadEntry)
 	}
 
-	closest, err := peer.FindClosest(addr)
+	return nil, ret, nil
+}
+
+// Connects to the peer an entry points to, if we are not connected already.
+func (pm *PeerManager) connectEntry(entry *dht.Entry) (*Peer, error) {
+	if peer := pm.GetPeer(entry.Address); peer != nil {
+		return peer, nil
+	}
+
+	return pm.ConnectPeerDirect(fmt.Sprintf("%s:%d", entry.PublicAddress, entry.Port))
+}
+
+// Pings a node in the routing table, see dht.PingFunc.
+func (pm *PeerManager) pingAddress(addr dht.Address) error {
+	entry, err := pm.localPeer.DHT.Query(addr)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for _, i := range closest {
-		entry := i.(*dht.Entry)
+	if entry == nil {
+		return errors.New("No entry with address")
+	}
+
+	peer, err := pm.connectEntry(entry)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), proto.DefaultTimeout)
+	defer cancel()
+
+	_, err = peer.Ping(ctx)
+
+	return err
+}
+
+// Looks up a random address in every bucket that has not had a lookup in
+// dht.BucketRefreshAge, this keeps the whole routing table fresh and not just
+// the parts we happen to query.
+func (pm *PeerManager) RefreshBuckets() {
+	ticker := time.NewTicker(RefreshFrequency)
+
+	for _ = range ticker.C {
+		pm.refreshBuckets()
+	}
+}
+
+func (pm *PeerManager) refreshBuckets() {
+	for _, i := range pm.localPeer.DHT.StaleBuckets() {
+		target, err := dht.RandomAddressInBucket(*pm.localPeer.Address(), i)
+
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
 
-		result, err := pm.resolveStep(entry, addr, depth)
+		found, err := pm.FindNode(*target)
 
 		if err != nil {
-			return nil, err
+			log.WithField("bucket", i).Error(err.Error())
+			continue
 		}
 
-		if result != nil {
-			return result, nil
+		for _, j := range found {
+			pm.localPeer.DHT.Insert(*j)
 		}
-	}
 
-	return nil, errors.New("No entries could be found")
+		log.WithFields(log.Fields{"bucket": i, "found": len(found)}).Debug("Refreshed bucket")
+	}
 }
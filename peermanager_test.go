@@ -0,0 +1,69 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+package dfi
+
+import (
+	"testing"
+
+	"github.com/dfindex/dfi/proto"
+)
+
+// A peer gets nothing back by reconnecting, the limits are kept by address.
+func TestLimiterKeptAcrossReconnect(t *testing.T) {
+	pm := NewPeerManager(&LocalPeer{})
+	addr := testAddress(t)
+	burst := proto.RateLimits[proto.ProtoDhtAnnounce].Burst
+
+	first := &Peer{address: addr}
+	pm.limit(first)
+
+	for i := 0; i < burst; i++ {
+		if allowed, _ := first.Limiter().Allow(proto.ProtoDhtAnnounce); !allowed {
+			t.Fatal("Refused a request within the burst")
+		}
+	}
+
+	first.Terminate()
+	pm.HandleCloseConnection(&addr)
+
+	// not yet refilled, so it is kept while the peer is away
+	pm.collectLimiters()
+
+	second := &Peer{address: addr}
+	pm.limit(second)
+
+	if allowed, _ := second.Limiter().Allow(proto.ProtoDhtAnnounce); allowed {
+		t.Fatal("Reconnecting reset the limits")
+	}
+
+	// a full limiter is no different to a new one
+	other := testAddress(t)
+	pm.Limiter(other)
+	pm.collectLimiters()
+
+	if pm.limiters.Has(string(other.Raw)) || !pm.limiters.Has(string(addr.Raw)) {
+		t.Fatal("Collected the wrong limiters")
+	}
+}
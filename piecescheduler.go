@@ -0,0 +1,283 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
+)
+
+const (
+	// Pieces are requested in runs of at most this many, so that a single slow
+	// source cannot hold on to a large part of the collection.
+	MaxPieceRun = 16
+
+	// Sources that fail this many runs are no longer used.
+	MaxSourceFailures = 3
+)
+
+// How far along a mirror is, and how many pieces each source has provided.
+type PieceProgress struct {
+	Total   int            `json:"total"`
+	Done    int            `json:"done"`
+	Sources map[string]int `json:"sources"`
+}
+
+// A contiguous set of pieces, and the sources that have failed to provide it.
+type pieceRun struct {
+	start  int
+	length int
+	failed map[*Peer]bool
+}
+
+// Spreads piece requests across the origin of an index and all of its seeds,
+// much like a torrent client. Every piece is checked against the verified hash
+// list before being stored, and runs that fail are retried on other sources.
+type PieceScheduler struct {
+	address  dht.Address
+	hashList []byte
+	db       data.PostStore
+	sources  []*Peer
+
+	queue    []*pieceRun
+	inFlight int
+	progress PieceProgress
+	onPiece  chan PieceProgress
+
+	// cancels every download in flight when done
+	ctx context.Context
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	// sqlite does not like concurrent writers
+	writeMutex sync.Mutex
+}
+
+func NewPieceScheduler(address dht.Address, hashList []byte, db data.PostStore, sources []*Peer) *PieceScheduler {
+	ret := PieceScheduler{
+		address:  address,
+		hashList: hashList,
+		db:       db,
+		sources:  sources,
+		progress: PieceProgress{Sources: make(map[string]int)},
+	}
+
+	ret.cond = sync.NewCond(&ret.mutex)
+
+	return &ret
+}
+
+// Downloads the given pieces, which must be in ascending order. Blocks until
+// every piece has been stored, there are no sources left that can provide the
+// rest, or ctx is done.
+func (ps *PieceScheduler) Run(ctx context.Context, pieces []int, onPiece chan PieceProgress) error {
+	ps.ctx = ctx
+	ps.onPiece = onPiece
+	ps.progress.Total = len(pieces)
+
+	for i := 0; i < len(pieces); {
+		run := &pieceRun{start: pieces[i], length: 1, failed: make(map[*Peer]bool)}
+
+		for i+run.length < len(pieces) && run.length < MaxPieceRun &&
+			pieces[i+run.length] == run.start+run.length {
+			run.length++
+		}
+
+		ps.queue = append(ps.queue, run)
+		i += run.length
+	}
+
+	var wg sync.WaitGroup
+
+	for _, i := range ps.sources {
+		wg.Add(1)
+
+		go func(source *Peer) {
+			defer wg.Done()
+			ps.work(source)
+		}(i)
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if ps.progress.Done != ps.progress.Total {
+		return errors.New("No sources left for the remaining pieces")
+	}
+
+	return nil
+}
+
+// Takes runs from the queue and downloads them from the given source, until
+// there is nothing left that this source can help with.
+func (ps *PieceScheduler) work(source *Peer) {
+	failures := 0
+
+	for failures < MaxSourceFailures && ps.ctx.Err() == nil {
+		run := ps.next(source)
+
+		if run == nil {
+			return
+		}
+
+		n, err := ps.download(source, run)
+
+		ps.mutex.Lock()
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"source": source.Address().StringOr(""),
+				"piece":  run.start + n,
+			}).Warn("Piece download failed: ", err.Error())
+
+			failures++
+			run.failed[source] = true
+			run.start += n
+			run.length -= n
+			ps.queue = append(ps.queue, run)
+		}
+
+		ps.inFlight--
+		ps.cond.Broadcast()
+		ps.mutex.Unlock()
+	}
+
+	log.WithField("source", source.Address().StringOr("")).Warn("Dropping source")
+}
+
+// Returns the next run this source has not already failed, waiting for runs in
+// flight elsewhere if need be. Returns nil when there is nothing left to do.
+func (ps *PieceScheduler) next(source *Peer) *pieceRun {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for {
+		for n, i := range ps.queue {
+			if !i.failed[source] {
+				ps.queue = append(ps.queue[:n], ps.queue[n+1:]...)
+				ps.inFlight++
+
+				return i
+			}
+		}
+
+		// runs in flight might fail, and need retrying here
+		if ps.inFlight == 0 {
+			return nil
+		}
+
+		ps.cond.Wait()
+	}
+}
+
+// Requests a run from a source, storing pieces as they pass verification.
+// Returns how many pieces were stored.
+func (ps *PieceScheduler) download(source *Peer, run *pieceRun) (int, error) {
+	// stops the stream of pieces if we give up on the run early
+	ctx, cancel := context.WithCancel(ps.ctx)
+	defer cancel()
+
+	stream, err := source.OpenStream(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer stream.Close()
+
+	pieces := stream.Pieces(ctx, ps.address, run.start, run.length, source.PieceFormat())
+
+	if pieces == nil {
+		return 0, errors.New("Failed to request pieces")
+	}
+
+	n := 0
+	for piece := range pieces {
+		if n >= run.length {
+			return n, errors.New("Peer sent more pieces than requested")
+		}
+
+		i := run.start + n
+
+		if !bytes.Equal(ps.hashList[data.HashSize*i:data.HashSize*i+data.HashSize], piece.Hash()) {
+			source.Report(EventBadPiece)
+			return n, errors.New("Piece hash mismatch")
+		}
+
+		piece.Id = uint(i)
+
+		ps.writeMutex.Lock()
+		err = ps.db.ReplacePiece(piece)
+		ps.writeMutex.Unlock()
+
+		if err != nil {
+			return n, err
+		}
+
+		ps.stored(source)
+		n++
+	}
+
+	if n != run.length {
+		return n, errors.New("Peer sent fewer pieces than requested")
+	}
+
+	return n, nil
+}
+
+func (ps *PieceScheduler) stored(source *Peer) {
+	ps.mutex.Lock()
+
+	ps.progress.Done++
+	ps.progress.Sources[source.Address().StringOr("")]++
+
+	progress := PieceProgress{
+		Total:   ps.progress.Total,
+		Done:    ps.progress.Done,
+		Sources: make(map[string]int, len(ps.progress.Sources)),
+	}
+
+	for k, v := range ps.progress.Sources {
+		progress.Sources[k] = v
+	}
+
+	ps.mutex.Unlock()
+
+	if ps.onPiece != nil {
+		ps.onPiece <- progress
+	}
+}
@@ -0,0 +1,178 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/streamrail/concurrent-map"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/proto"
+)
+
+// Delays every piece request, so that other sources get there first.
+type slowHandler struct {
+	*LocalPeer
+	delay time.Duration
+}
+
+func (h slowHandler) HandlePiece(msg *proto.Message) error {
+	time.Sleep(h.delay)
+	return h.LocalPeer.HandlePiece(msg)
+}
+
+// A peer connected over a pipe to one serving the given index, under the given
+// address, through handler.
+func testSource(t *testing.T, address string, db data.PostStore, wrap func(*LocalPeer) proto.ProtocolHandler) (*Peer, func()) {
+	lp := &LocalPeer{Databases: cmap.New()}
+	lp.Databases.Set(address, db)
+
+	a, b := net.Pipe()
+
+	local, _ := proto.NewClient(a)
+	source := &Peer{address: testAddress(t)}
+	source.streams.SetConnection(proto.ConnHeader{Client: *local, Version: proto.ProtoVersion})
+	source.SetCapabilities(proto.MessageCapabilities{PieceFormats: proto.PieceFormats})
+
+	remote, _ := proto.NewClient(b)
+	serving := &Peer{}
+	serving.streams.SetConnection(proto.ConnHeader{Client: *remote, Version: proto.ProtoVersion})
+
+	if _, err := source.streams.ConnectClient(); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := serving.ConnectServer()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handler proto.ProtocolHandler = lp
+
+	if wrap != nil {
+		handler = wrap(lp)
+	}
+
+	go func() {
+		server := proto.Server{}
+
+		for {
+			stream, err := session.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go server.HandleStream(serving, handler, stream)
+		}
+	}()
+
+	return source, func() {
+		source.Terminate()
+		serving.Terminate()
+	}
+}
+
+func TestPieceSchedulerRetry(t *testing.T) {
+	origin, entry, _ := testIndex(t, data.PieceSize*5)
+	address := entry.Address.StringOr("")
+
+	col, err := data.CreateCollection(origin, 0, data.PieceSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same posts, with different titles
+	forged := data.NewMemoryStore()
+
+	for i := 1; i <= data.PieceSize*5; i++ {
+		forged.InsertPost(data.Post{InfoHash: string(rune(i)), Title: "forged", Size: i})
+	}
+
+	bad, closeBad := testSource(t, address, forged, nil)
+	defer closeBad()
+
+	good, closeGood := testSource(t, address, origin, func(lp *LocalPeer) proto.ProtocolHandler {
+		return slowHandler{lp, time.Millisecond * 100}
+	})
+	defer closeGood()
+
+	reports := 0
+	bad.report = func(event ReputationEvent) {
+		if event == EventBadPiece {
+			reports++
+		}
+	}
+
+	mirror := data.NewMemoryStore()
+	onPiece := make(chan PieceProgress, 10)
+
+	scheduler := NewPieceScheduler(entry.Address, col.HashList, mirror, []*Peer{bad, good})
+
+	// three runs, as the pieces are not contiguous
+	if err := scheduler.Run(context.Background(), []int{0, 2, 4}, onPiece); err != nil {
+		t.Fatal(err)
+	}
+
+	close(onPiece)
+
+	var last PieceProgress
+	for i := range onPiece {
+		last = i
+	}
+
+	if last.Total != 3 || last.Done != 3 {
+		t.Fatalf("Progress is %d of %d, expected 3 of 3", last.Done, last.Total)
+	}
+
+	// every piece failed on the bad source, and was retried on the good one
+	if reports == 0 {
+		t.Fatal("Bad source was never tried")
+	}
+
+	if last.Sources[good.Address().StringOr("")] != 3 || len(last.Sources) != 1 {
+		t.Fatalf("Unexpected progress by source: %v", last.Sources)
+	}
+
+	for _, i := range []int{0, 2, 4} {
+		piece, err := mirror.QueryPiece(uint(i), false)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(piece.Hash(), col.HashList[data.HashSize*i:data.HashSize*(i+1)]) {
+			t.Fatalf("Piece %d does not match the hash list", i)
+		}
+	}
+}
@@ -18,3 +18,31 @@ func ChooseCompression(client MessageCapabilities, server MessageCapabilities) s
 
 	return compression
 }
+
+// Picks the piece format to use, the server has preference. Falls back to text
+// when nothing is shared, as peers that predate piece formats only send text.
+func ChoosePieceFormat(client MessageCapabilities, server MessageCapabilities) string {
+	for _, i := range server.PieceFormats {
+		for _, j := range client.PieceFormats {
+			if i == j {
+				return i
+			}
+		}
+	}
+
+	return PieceFormatText
+}
+
+// Picks the transport encryption to use, the server has preference. Empty if
+// nothing is shared, in which case the connection stays plaintext.
+func ChooseEncryption(client MessageCapabilities, server MessageCapabilities) string {
+	for _, i := range server.Encryption {
+		for _, j := range client.Encryption {
+			if i == j {
+				return i
+			}
+		}
+	}
+
+	return ""
+}
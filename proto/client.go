@@ -1,7 +1,8 @@
 package proto
 
 import (
-	"compress/gzip"
+	"bufio"
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -23,22 +24,88 @@ const (
 type Client struct {
 	conn net.Conn
 
-	limiter *io.LimitedReader
+	// Applied to the content of messages written, see Message.Compress.
+	compression string
+
+	// The request being made or responded to, see Call.
+	requestId uint64
+
+	// The protocol version negotiated with the peer.
+	version int16
+
+	reader  *bufio.Reader
+	limiter *limitedReader
 	decoder *msgpack.Decoder
 	encoder *msgpack.Encoder
 }
 
+// Limits the size of a message like io.LimitedReader. It also implements
+// ReadByte and UnreadByte, so msgpack does not buffer past the end of a message
+// and anything after can still be read from Client.reader.
+type limitedReader struct {
+	R *bufio.Reader
+	N int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.N <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > l.N {
+		p = p[:l.N]
+	}
+
+	n, err := l.R.Read(p)
+	l.N -= int64(n)
+
+	return n, err
+}
+
+func (l *limitedReader) ReadByte() (byte, error) {
+	if l.N <= 0 {
+		return 0, io.EOF
+	}
+
+	b, err := l.R.ReadByte()
+
+	if err == nil {
+		l.N--
+	}
+
+	return b, err
+}
+
+func (l *limitedReader) UnreadByte() error {
+	err := l.R.UnreadByte()
+
+	if err == nil {
+		l.N++
+	}
+
+	return err
+}
+
 // Creates a new client, automatically setting up the json encoder/decoder.
 func NewClient(conn net.Conn) (*Client, error) {
 	c := &Client{conn: conn}
 
-	c.limiter = &io.LimitedReader{R: c.conn, N: common.MaxMessageSize}
-	c.decoder = msgpack.NewDecoder(c.limiter)
+	c.setupReader()
 	c.encoder = msgpack.NewEncoder(c.conn)
 
 	return c, nil
 }
 
+func (c *Client) setupReader() {
+	if c.decoder != nil {
+		return
+	}
+
+	c.reader = bufio.NewReader(c.conn)
+	c.limiter = &limitedReader{R: c.reader, N: common.MaxMessageSize}
+	c.decoder = msgpack.NewDecoder(c.limiter)
+}
+
 func (c *Client) Terminate() {
 	//c.conn.Write(proto_terminate)
 }
@@ -51,12 +118,38 @@ func (c *Client) Close() (err error) {
 	return
 }
 
+func (c *Client) SetCompression(compression string) {
+	c.compression = compression
+}
+
+func (c *Client) SetVersion(version int16) {
+	c.version = version
+}
+
+func (c *Client) Version() int16 {
+	return c.version
+}
+
 // Encodes v as json and writes it to c.conn.
 func (c *Client) WriteMessage(v interface{}) error {
 	if c == nil {
 		return errors.New("Client nil")
 	}
 
+	switch msg := v.(type) {
+	case Message:
+		return c.WriteMessage(&msg)
+
+	case *Message:
+		if msg.Id == 0 {
+			msg.Id = c.requestId
+		}
+
+		if err := msg.Compress(c.compression); err != nil {
+			return err
+		}
+	}
+
 	if c.encoder == nil {
 		c.encoder = msgpack.NewEncoder(c.conn)
 	}
@@ -82,13 +175,7 @@ func (c *Client) WriteErr(toSend error) error {
 func (c *Client) ReadMessage() (*Message, error) {
 	var msg Message
 
-	if c.limiter == nil {
-		c.limiter = &io.LimitedReader{R: c.conn, N: common.MaxMessageSize}
-	}
-
-	if c.decoder == nil {
-		c.decoder = msgpack.NewDecoder(c.limiter)
-	}
+	c.setupReader()
 
 	if err := c.decoder.Decode(&msg); err != nil {
 		c.limiter.N = common.MaxMessageSize
@@ -122,59 +209,35 @@ func (c *Client) SendStruct(e common.Encoder) error {
 
 // Announce the given DHT entry to a peer, passes on this peers details,
 // meaning that it can be reached by other peers on the network.
-func (c *Client) Announce(e common.Encoder) error {
-	msg := &Message{
-		Header: ProtoDhtAnnounce,
-	}
-
-	err := msg.Write(e)
+func (c *Client) Announce(ctx context.Context, e common.Encoder) error {
+	ok, err := c.Call(ctx, ProtoDhtAnnounce, e)
 
 	if err != nil {
 		return err
 	}
 
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return err
-	}
-
-	ok, err := c.ReadMessage()
+	if !ok.Ok() {
+		var reason string
+		if ok.Read(&reason) != nil || reason == "" {
+			return errors.New("Peer did not respond with ok")
+		}
 
-	if err != nil {
-		return err
-	}
+		switch reason {
+		case dht.ErrEntryRollback.Error():
+			return dht.ErrEntryRollback
+		case dht.ErrEntryFromFuture.Error():
+			return dht.ErrEntryFromFuture
+		}
 
-	if !ok.Ok() {
-		return errors.New("Peer did not respond with ok")
+		return errors.New(reason)
 	}
 
 	return nil
 }
 
-func (c *Client) FindClosest(address dht.Address) ([]*dht.Entry, error) {
-	// TODO: LimitReader
-
-	msg := &Message{
-		Header: ProtoDhtFindClosest,
-	}
-
-	err := msg.Write(address)
-
-	if err != nil {
-		return nil, err
-	}
-
+func (c *Client) FindClosest(ctx context.Context, address dht.Address) ([]*dht.Entry, error) {
 	// Tell the peer the address we are looking for
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return nil, err
-	}
-
-	log.Debug("Send FindClosest request")
-
-	closest, err := c.ReadMessage()
+	closest, err := c.Call(ctx, ProtoDhtFindClosest, address)
 
 	if err != nil {
 		return nil, err
@@ -192,29 +255,19 @@ func (c *Client) FindClosest(address dht.Address) ([]*dht.Entry, error) {
 	return ret, err
 }
 
-func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
-	// TODO: LimitReader
-
-	msg := &Message{
-		Header: ProtoDhtQuery,
-	}
-
-	err := msg.Write(address)
+// Returned when a peer sends an entry that fails dht.Entry.Verify.
+type InvalidEntryError struct {
+	Err error
+}
 
-	if err != nil {
-		return nil, err
-	}
+func (e *InvalidEntryError) Error() string {
+	return "Peer sent an invalid entry: " + e.Err.Error()
+}
 
+func (c *Client) Query(ctx context.Context, address dht.Address) (*dht.Entry, error) {
 	// Tell the peer the address we are looking for
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return nil, err
-	}
-	log.Debug("Written address")
-
 	var entry dht.Entry
-	er, err := c.ReadMessage()
+	er, err := c.Call(ctx, ProtoDhtQuery, address)
 
 	if err != nil {
 		return nil, err
@@ -236,7 +289,7 @@ func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
 	err = entry.Verify()
 
 	if err != nil {
-		return nil, err
+		return nil, &InvalidEntryError{err}
 	}
 
 	log.Debug("Verified entry")
@@ -247,9 +300,9 @@ func (c *Client) Query(address dht.Address) (*dht.Entry, error) {
 // Adds the initial entries into the given routing table. Essentially queries for
 // both it's own and the peers address, storing the result. This means that after
 // a bootstrap, it should be possible to connect to *any* peer!
-func (c *Client) Bootstrap(d *dht.DHT, address dht.Address) error {
+func (c *Client) Bootstrap(ctx context.Context, d *dht.DHT, address dht.Address) error {
 	defer c.Close()
-	peers, err := c.FindClosest(address)
+	peers, err := c.FindClosest(ctx, address)
 
 	if err != nil {
 		return err
@@ -289,29 +342,22 @@ func (c *Client) Bootstrap(d *dht.DHT, address dht.Address) error {
 }
 
 // TODO: Paginate searches
-func (c *Client) Search(search string, page int) ([]*data.Post, error) {
+func (c *Client) Search(ctx context.Context, search string, page int) ([]*data.Post, error) {
 	log.WithField("Query", search).Info("Querying")
 
 	sq := MessageSearchQuery{search, page}
 
-	msg := &Message{
-		Header: ProtoSearch,
-	}
+	var posts []*data.Post
 
-	err := msg.Write(sq)
+	recv, err := c.Call(ctx, ProtoSearch, sq)
 
 	if err != nil {
 		return nil, err
 	}
 
-	c.WriteMessage(msg)
-
-	var posts []*data.Post
-
-	recv, err := c.ReadMessage()
-
-	if err != nil {
-		return nil, err
+	// for instance an invalid filter
+	if recv.Header == ProtoNo {
+		return nil, refusal(recv)
 	}
 
 	err = recv.Read(&posts)
@@ -323,26 +369,10 @@ func (c *Client) Search(search string, page int) ([]*data.Post, error) {
 	return posts, nil
 }
 
-func (c *Client) Recent(page int) ([]*data.Post, error) {
+func (c *Client) Recent(ctx context.Context, page int) ([]*data.Post, error) {
 	log.Info("Fetching recent posts from peer")
 
-	msg := &Message{
-		Header: ProtoRecent,
-	}
-
-	err := msg.Write(page)
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return nil, err
-	}
-
-	posts_msg, err := c.ReadMessage()
+	posts_msg, err := c.Call(ctx, ProtoRecent, page)
 
 	if err != nil {
 		return nil, err
@@ -360,26 +390,10 @@ func (c *Client) Recent(page int) ([]*data.Post, error) {
 	return posts, nil
 }
 
-func (c *Client) Popular(page int) ([]*data.Post, error) {
+func (c *Client) Popular(ctx context.Context, page int) ([]*data.Post, error) {
 	log.Info("Fetching popular posts from peer")
 
-	msg := &Message{
-		Header: ProtoPopular,
-	}
-
-	err := msg.Write(page)
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return nil, err
-	}
-
-	posts_msg, err := c.ReadMessage()
+	posts_msg, err := c.Call(ctx, ProtoPopular, page)
 
 	if err != nil {
 		return nil, err
@@ -399,28 +413,10 @@ func (c *Client) Popular(page int) ([]*data.Post, error) {
 
 // Download a hash list for a peer. Expects said hash list to be valid and
 // signed.
-func (c *Client) Collection(address dht.Address, entry dht.Entry) (*MessageCollection, error) {
+func (c *Client) Collection(ctx context.Context, address dht.Address, entry dht.Entry) (*MessageCollection, error) {
 	log.WithField("for", address.StringOr("")).Info("Sending request for a collection")
 
-	msg := &Message{
-		Header: ProtoRequestHashList,
-	}
-
-	err := msg.Write(address)
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = c.WriteMessage(msg)
-
-	if err != nil {
-		return nil, err
-	}
-
-	log.Debug("Sent hash list request")
-
-	hl, err := c.ReadMessage()
+	hl, err := c.Call(ctx, ProtoRequestHashList, address)
 
 	if err != nil {
 		return nil, err
@@ -449,16 +445,25 @@ func (c *Client) Collection(address dht.Address, entry dht.Entry) (*MessageColle
 }
 
 // Download a piece from a peer, given the address and id of the piece we want.
-func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
+// The format should be one both peers support, see ChoosePieceFormat. The
+// channel is closed without the remaining pieces if ctx is done.
+func (c *Client) Pieces(ctx context.Context, address dht.Address, id, length int, format string) chan *data.Piece {
 	log.WithFields(log.Fields{
 		"address": address.StringOr(""),
 		"id":      id,
 		"length":  length,
+		"format":  format,
 	}).Info("Sending request for piece")
 
 	ret := make(chan *data.Piece, 100)
 
-	mrp := MessageRequestPiece{address.StringOr(""), id, length}
+	// peers that predate negotiated compression always gzip
+	compression := c.compression
+	mrp := MessageRequestPiece{address.StringOr(""), id, length, format, compression}
+
+	if compression == "" {
+		compression = CompressionGzip
+	}
 
 	msg := &Message{
 		Header: ProtoRequestPiece,
@@ -471,117 +476,217 @@ func (c *Client) Pieces(address dht.Address, id, length int) chan *data.Piece {
 		return nil
 	}
 
-	err = c.WriteMessage(msg)
+	end, err := c.begin(ctx, msg)
 
 	if err != nil {
 		log.Error(err.Error())
 		return nil
 	}
 
-	// Convert a string to an int, prevents endless error checks below.
-	convert := func(val string) int {
-		ret, err := strconv.Atoi(val)
-
-		if err != nil {
-			log.Error(err.Error())
-			return 0
-		}
+	err = c.WriteMessage(msg)
 
-		return ret
+	if err != nil {
+		end()
+		log.Error(contextErr(ctx, err).Error())
+		return nil
 	}
 
 	go func() {
+		defer end()
 		defer close(ret)
 		log.Info("Recieving pieces")
 
-		gzr, err := gzip.NewReader(c.conn)
+		// since ProtoVersionSlowDown the pieces follow a response, as the
+		// request may be refused
+		if c.version >= ProtoVersionSlowDown {
+			resp, err := c.ReadMessage()
+
+			if err == nil {
+				err = refusal(resp)
+			}
+
+			if err != nil {
+				log.Error(contextErr(ctx, err).Error())
+				return
+			}
+		}
+
+		reader, err := NewDecompressReader(compression, c.reader, common.MaxMessageContentSize)
 
 		if err != nil {
 			log.Error(err.Error())
 			return
 		}
 
-		errReader := data.NewErrorReader(gzr)
+		var next func() (*data.Post, error)
+
+		if format == PieceFormatMsgpack {
+			next = msgpackPostReader(reader)
+		} else {
+			next = textPostReader(reader)
+		}
 
 		for i := 0; i < length; i++ {
 			piece := data.Piece{}
 			piece.Setup()
 
-			count := 0
-			for {
-				if count >= data.PieceSize {
-					break
-				}
+			// each piece may decompress to at most this
+			reader.N = common.MaxMessageContentSize
 
-				id_s := errReader.ReadString('|')
-				id := convert(id_s)
+			for count := 0; count < data.PieceSize; count++ {
+				post, err := next()
 
-				if id == -1 {
+				if err != nil {
+					log.Error("Failed to read post: ", contextErr(ctx, err).Error())
 					break
 				}
 
-				ih := errReader.ReadString('|')
-				title := errReader.ReadString('|')
-				size := convert(errReader.ReadString('|'))
-				filecount := convert(errReader.ReadString('|'))
-				seeders := convert(errReader.ReadString('|'))
-				leechers := convert(errReader.ReadString('|'))
-				uploaddate := convert(errReader.ReadString('|'))
-				tags := errReader.ReadString('|')
-				meta := errReader.ReadString('|')
-
-				if errReader.Err != nil {
-					log.Error("Failed to read post: ", errReader.Err.Error())
+				if post.Id == -1 {
 					break
 				}
 
-				if err != nil {
-					log.Error(err.Error())
-				}
-
-				post := data.Post{
-					Id:         id,
-					InfoHash:   ih,
-					Title:      title,
-					Size:       size,
-					FileCount:  filecount,
-					Seeders:    seeders,
-					Leechers:   leechers,
-					UploadDate: uploaddate,
-					Tags:       tags,
-					Meta:       meta,
-				}
+				piece.Add(*post, true)
+			}
 
-				piece.Add(post, true)
-				count++
+			select {
+			case ret <- &piece:
+			case <-ctx.Done():
+				return
 			}
-			ret <- &piece
 		}
 	}()
 
 	return ret
 }
 
-func (c *Client) RequestAddPeer(addr dht.Address) error {
-	log.WithField("for", addr.StringOr("")).Info("Registering as seed")
+// Reads posts in the pipe separated format, which is what peers that predate
+// piece formats send.
+func textPostReader(r io.Reader) func() (*data.Post, error) {
+	errReader := data.NewErrorReader(r)
 
-	msg := &Message{
-		Header: ProtoRequestAddPeer,
+	// Convert a string to an int, prevents endless error checks below.
+	convert := func(val string) int {
+		ret, err := strconv.Atoi(val)
+
+		if err != nil {
+			log.Error(err.Error())
+			return 0
+		}
+
+		return ret
+	}
+
+	return func() (*data.Post, error) {
+		id := convert(errReader.ReadString('|'))
+
+		if id == -1 {
+			return &data.Post{Id: -1}, nil
+		}
+
+		post := &data.Post{
+			Id:         id,
+			InfoHash:   errReader.ReadString('|'),
+			Title:      errReader.ReadString('|'),
+			Size:       convert(errReader.ReadString('|')),
+			FileCount:  convert(errReader.ReadString('|')),
+			Seeders:    convert(errReader.ReadString('|')),
+			Leechers:   convert(errReader.ReadString('|')),
+			UploadDate: convert(errReader.ReadString('|')),
+			Tags:       errReader.ReadString('|'),
+			Meta:       errReader.ReadString('|'),
+		}
+
+		return post, errReader.Err
+	}
+}
+
+// Reads msgpack encoded posts, each is length prefixed so any field may
+// contain anything.
+func msgpackPostReader(r io.Reader) func() (*data.Post, error) {
+	decoder := msgpack.NewDecoder(r)
+
+	return func() (*data.Post, error) {
+		post := &data.Post{}
+		err := decoder.Decode(post)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(post.Title) > data.MaxPostSize || len(post.Tags) > data.MaxPostSize ||
+			len(post.Meta) > data.MaxPostSize {
+			return nil, errors.New("Post too large")
+		}
+
+		return post, nil
+	}
+}
+
+// Download a single piece along with its audit path, the piece is checked
+// against the given collection root before it is returned.
+func (c *Client) PieceProof(ctx context.Context, address dht.Address, id int, root []byte) (*data.Piece, error) {
+	log.WithFields(log.Fields{
+		"address": address.StringOr(""),
+		"id":      id,
+	}).Info("Sending request for piece proof")
+
+	resp, err := c.Call(ctx, ProtoRequestPieceProof,
+		MessageRequestPieceProof{address.StringOr(""), id})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header == ProtoNo {
+		return nil, errors.New("Peer returned no")
 	}
 
-	err := msg.Write(addr)
+	mpp := MessagePieceProof{}
+	err = resp.Read(&mpp)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = c.WriteMessage(msg)
+	if mpp.Id != id {
+		return nil, errors.New("Peer returned the wrong piece")
+	}
+
+	return mpp.Verify(root)
+}
+
+// Fetch operations from the log of the given address, after since. Signatures
+// are not checked here, the caller needs the public key from the entry.
+func (c *Client) Operations(ctx context.Context, address dht.Address, since int) ([]*data.Operation, error) {
+	resp, err := c.Call(ctx, ProtoRequestOperations,
+		MessageRequestOperations{address.StringOr(""), since})
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if resp.Header == ProtoNo {
+		return nil, errors.New("Peer returned no")
 	}
 
-	rep, err := c.ReadMessage()
+	var ops []*data.Operation
+	err = resp.Read(&ops)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ops) > MaxOperations {
+		return nil, errors.New("Peer sent too many operations")
+	}
+
+	return ops, nil
+}
+
+func (c *Client) RequestAddPeer(ctx context.Context, attestation dht.Attestation) error {
+	log.WithField("for", attestation.For.StringOr("")).Info("Registering as seed")
+
+	rep, err := c.Call(ctx, ProtoRequestAddPeer, attestation)
 
 	if err != nil {
 		return err
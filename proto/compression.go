@@ -0,0 +1,139 @@
+// Compression of message content and piece streams. Which is used is
+// negotiated through MessageCapabilities, see ChooseCompression.
+
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Message content smaller than this is not worth compressing.
+const MinCompressSize = 256
+
+// Frames declaring a bigger window are refused, otherwise a peer could make us
+// allocate far more than the content limit before reading anything.
+const zstdMaxWindow = 8 << 20
+
+type compressor struct {
+	writer func(io.Writer) io.WriteCloser
+	reader func(io.Reader) (io.Reader, error)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Every compression in Compressions needs to be here.
+var compressors = map[string]compressor{
+	CompressionGzip: {
+		writer: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		reader: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	},
+	// both sides are kept to a single goroutine, so nothing is left running
+	// when a reader is abandoned part way
+	CompressionZstd: {
+		writer: func(w io.Writer) io.WriteCloser {
+			// only fails on bad options
+			enc, _ := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+			return enc
+		},
+		reader: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r, zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		},
+	},
+	CompressionSnappy: {
+		writer: func(w io.Writer) io.WriteCloser { return snappy.NewBufferedWriter(w) },
+		reader: func(r io.Reader) (io.Reader, error) { return snappy.NewReader(r), nil },
+	},
+	CompressionNone: {
+		writer: func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} },
+		reader: func(r io.Reader) (io.Reader, error) { return r, nil },
+	},
+}
+
+func getCompressor(compression string) (compressor, error) {
+	if compression == "" {
+		compression = CompressionNone
+	}
+
+	c, ok := compressors[compression]
+
+	if !ok {
+		return c, errors.New("Unknown compression: " + compression)
+	}
+
+	return c, nil
+}
+
+// True if the compression is one we can read and write.
+func HasCompression(compression string) bool {
+	_, err := getCompressor(compression)
+	return err == nil
+}
+
+// Wraps w so that everything written to it is compressed, it must be closed
+// to flush everything. An empty compression is none.
+func NewCompressWriter(compression string, w io.Writer) (io.WriteCloser, error) {
+	c, err := getCompressor(compression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c.writer(w), nil
+}
+
+// Wraps r so that everything read from it is decompressed, stopping after
+// limit bytes of decompressed data so a small message cannot inflate without
+// end. N can be reset to read more.
+func NewDecompressReader(compression string, r io.Reader, limit int64) (*io.LimitedReader, error) {
+	c, err := getCompressor(compression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := c.reader(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &io.LimitedReader{R: reader, N: limit}, nil
+}
+
+// Compresses content, unless it is too small to be worth it. Returns the
+// compression actually used.
+func compress(compression string, content []byte) ([]byte, string, error) {
+	if compression == "" || compression == CompressionNone || len(content) < MinCompressSize {
+		return content, "", nil
+	}
+
+	buf := bytes.Buffer{}
+	w, err := NewCompressWriter(compression, &buf)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = w.Write(content)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = w.Close()
+
+	return buf.Bytes(), compression, err
+}
@@ -0,0 +1,72 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dfindex/dfi/common"
+)
+
+func TestMessageCompression(t *testing.T) {
+	sent := bytes.Repeat([]byte("dfi"), 1000)
+
+	for _, compression := range Compressions {
+		if compression == CompressionNone {
+			continue
+		}
+
+		msg := Message{Header: ProtoPosts, Compression: compression}
+
+		if err := msg.Write(sent); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Compression != compression || len(msg.Content) >= len(sent) {
+			t.Fatal("Content was not compressed with ", compression)
+		}
+
+		var recieved []byte
+
+		if err := msg.Read(&recieved); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(sent, recieved) {
+			t.Fatal("Recieved content differs from that sent with ", compression)
+		}
+	}
+
+	// not worth it
+	small := Message{Header: ProtoOk}
+	small.Write(1)
+
+	if small.Compress(CompressionGzip); small.Compression != "" {
+		t.Fatal("Small content was compressed")
+	}
+}
+
+func TestDecompressionBounded(t *testing.T) {
+	// compresses to almost nothing
+	bomb := make([]byte, common.MaxMessageContentSize+1)
+
+	var msg Message
+	var recieved []byte
+
+	for _, compression := range Compressions {
+		msg = Message{Header: ProtoPosts, Compression: compression}
+
+		if err := msg.Write(bomb); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Read(&recieved) == nil {
+			t.Fatal("Decompressed past the content limit with ", compression)
+		}
+	}
+
+	msg.Compression = "nope"
+
+	if msg.Read(&recieved) == nil {
+		t.Fatal("Read content with an unknown compression")
+	}
+}
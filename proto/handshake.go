@@ -12,31 +12,33 @@ import (
 )
 
 // Perform a handshake operation given a peer. server.go does the other end of this.
-func handshake(cl Client, lp common.Signer, data common.Encoder) (*dht.Entry, *MessageCapabilities, error) {
-	header, caps, err := handshake_recieve(cl)
+func handshake(cl Client, lp common.Signer, data common.Encoder) (*dht.Entry, *MessageCapabilities, Transcript, Transcript, error) {
+	header, caps, recieved, err := handshake_recieve(cl)
 
 	if err != nil {
 		cl.WriteErr(err)
-		return header, nil, err
+		return header, nil, recieved, Transcript{}, err
 	}
 
 	if lp == nil {
 		cl.WriteErr(errors.New("Nil localpeer"))
-		return header, nil, errors.New("Handshake passed nil LocalPeer")
+		return header, nil, recieved, Transcript{}, errors.New("Handshake passed nil LocalPeer")
 	}
 
 	cl.WriteMessage(Message{Header: ProtoOk})
-	err = handshake_send(cl, lp, data)
+	sent, err := handshake_send(cl, lp, data)
 
 	if err != nil {
-		return header, nil, err
+		return header, nil, recieved, sent, err
 	}
 
-	return header, caps, nil
+	return header, caps, recieved, sent, nil
 }
 
 // Just recieves a handshake from a peer.
-func handshake_recieve(cl Client) (*dht.Entry, *MessageCapabilities, error) {
+func handshake_recieve(cl Client) (*dht.Entry, *MessageCapabilities, Transcript, error) {
+	var transcript Transcript
+
 	check := func(e error) bool {
 		if e != nil {
 			log.Error(e.Error())
@@ -54,7 +56,7 @@ func handshake_recieve(cl Client) (*dht.Entry, *MessageCapabilities, error) {
 
 	if check(err) {
 		cl.WriteMessage(Message{Header: ProtoNo})
-		return nil, nil, err
+		return nil, nil, transcript, err
 	}
 
 	log.Debug("Header recieved")
@@ -64,14 +66,14 @@ func handshake_recieve(cl Client) (*dht.Entry, *MessageCapabilities, error) {
 
 	if check(err) {
 		cl.WriteMessage(Message{Header: ProtoNo})
-		return nil, nil, err
+		return nil, nil, transcript, err
 	}
 
 	err = entry.Verify()
 
 	if check(err) {
 		cl.WriteMessage(Message{Header: ProtoNo})
-		return nil, nil, err
+		return nil, nil, transcript, err
 	}
 
 	log.WithFields(log.Fields{"peer": entry.Address.StringOr("")}).Info("Incoming connection")
@@ -79,44 +81,47 @@ func handshake_recieve(cl Client) (*dht.Entry, *MessageCapabilities, error) {
 	err = cl.WriteMessage(Message{Header: ProtoOk})
 
 	if check(err) {
-		return nil, nil, err
+		return nil, nil, transcript, err
 	}
 
 	// read the caps from the peer
 	peerCapsMsg, err := cl.ReadMessage()
 
 	if check(err) {
-		return nil, nil, err
+		return nil, nil, transcript, err
 	}
 
 	peerCaps := &MessageCapabilities{}
 	peerCapsMsg.Read(peerCaps)
 
+	transcript.Entry = header.Content
+	transcript.Capabilities = peerCapsMsg.Content
+
 	// Send the client a cookie for them to sign, this proves they have the
 	// private key, and it is highly unlikely an attacker has a signed cookie
 	// cached.
 	cookie, err := util.CryptoRandBytes(20)
 
 	if check(err) {
-		return nil, nil, err
+		return nil, nil, transcript, err
 	}
 	msg := Message{Header: ProtoCookie}
 	err = msg.Write(cookie)
 
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, transcript, err
 	}
 
 	err = cl.WriteMessage(msg)
 
 	if check(err) {
-		return nil, nil, err
+		return nil, nil, transcript, err
 	}
 
 	sig, err := cl.ReadMessage()
 
 	if check(err) {
-		return nil, nil, err
+		return nil, nil, transcript, err
 	}
 
 	// need to decompress the signature before verifying
@@ -128,18 +133,20 @@ func handshake_recieve(cl Client) (*dht.Entry, *MessageCapabilities, error) {
 		log.Error("Failed to verify peer ", entry.Address.StringOr(""))
 		cl.WriteMessage(Message{Header: ProtoNo})
 		cl.Close()
-		return nil, nil, errors.New("Signature not verified")
+		return nil, nil, transcript, errors.New("Signature not verified")
 	}
 
 	cl.WriteMessage(Message{Header: ProtoOk})
 
 	log.WithFields(log.Fields{"peer": entry.Address.StringOr("")}).Info("Verified")
 
-	return &entry, peerCaps, nil
+	return &entry, peerCaps, transcript, nil
 }
 
 // Sends a handshake to a peer.
-func handshake_send(cl Client, lp common.Signer, data common.Encoder) error {
+func handshake_send(cl Client, lp common.Signer, data common.Encoder) (Transcript, error) {
+	var transcript Transcript
+
 	log.Debug("Handshaking with ", cl.conn.RemoteAddr().String())
 
 	header := Message{
@@ -149,23 +156,23 @@ func handshake_send(cl Client, lp common.Signer, data common.Encoder) error {
 	err := header.Write(data)
 
 	if err != nil {
-		return err
+		return transcript, err
 	}
 
 	err = cl.WriteMessage(header)
 
 	if err != nil {
-		return err
+		return transcript, err
 	}
 
 	msg, err := cl.ReadMessage()
 
 	if err != nil {
-		return err
+		return transcript, err
 	}
 
 	if !msg.Ok() {
-		return errors.New("Peer refused header")
+		return transcript, errors.New("Peer refused header")
 	}
 
 	log.Debug("Header sent, sending cap")
@@ -176,10 +183,13 @@ func handshake_send(cl Client, lp common.Signer, data common.Encoder) error {
 
 	msgCaps.Write(lp.(ProtocolHandler).GetCapabilities())
 
+	transcript.Entry = header.Content
+	transcript.Capabilities = msgCaps.Content
+
 	err = cl.WriteMessage(msgCaps)
 
 	if err != nil {
-		return err
+		return transcript, err
 	}
 
 	msg, err = cl.ReadMessage()
@@ -187,7 +197,7 @@ func handshake_send(cl Client, lp common.Signer, data common.Encoder) error {
 
 	if err != nil {
 		log.Error(err.Error())
-		return err
+		return transcript, err
 	}
 
 	log.Info("Cookie recieved, signing")
@@ -204,27 +214,27 @@ func handshake_send(cl Client, lp common.Signer, data common.Encoder) error {
 	err = msg.Write(sig)
 
 	if err != nil {
-		return err
+		return transcript, err
 	}
 
 	err = cl.WriteMessage(msg)
 
 	if err != nil {
-		return err
+		return transcript, err
 	}
 
 	msg, err = cl.ReadMessage()
 	log.Debug("Written cookie")
 
 	if err != nil {
-		return err
+		return transcript, err
 	}
 
 	if !msg.Ok() {
-		return errors.New("Peer refused signature")
+		return transcript, errors.New("Peer refused signature")
 	}
 
 	log.Info("Handshake sent ok")
 
-	return nil
+	return transcript, nil
 }
@@ -25,10 +25,12 @@
 package proto
 
 import (
+	"context"
 	"net"
 
 	"github.com/dfindex/dfi/common"
 	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/util"
 	"github.com/hashicorp/yamux"
 )
 
@@ -44,11 +46,17 @@ type ProtocolHandler interface {
 	HandlePopular(*Message) error
 	HandleHashList(*Message) error
 	HandlePiece(*Message) error
+	HandlePieceProof(*Message) error
+	HandleOperations(*Message) error
 	HandleAddPeer(*Message) error
 
 	HandleHandshake(ConnHeader) (NetworkPeer, error)
 	HandleCloseConnection(*dht.Address)
 
+	// Whether a peer is banned, by either address. The DFI address may be nil
+	// and the public address empty when not yet known.
+	Banned(*dht.Address, string) bool
+
 	GetNetworkPeer(dht.Address) NetworkPeer
 	SetNetworkPeer(NetworkPeer)
 	GetCapabilities() *MessageCapabilities
@@ -61,8 +69,14 @@ type NetworkPeer interface {
 	AddStream(net.Conn)
 
 	Address() *dht.Address
-	Query(dht.Address) (common.Verifier, error)
-	FindClosest(dht.Address) ([]common.Verifier, error)
+	Query(context.Context, dht.Address) (common.Verifier, error)
+	FindClosest(context.Context, dht.Address) ([]common.Verifier, error)
 	SetCapabilities(MessageCapabilities)
+	ProtocolVersion() int16
+	Compression() string
+	Limiter() *util.PeerLimiter
 	UpdateSeen()
+
+	// Called when the peer sends something broken, unknown or over its limits.
+	InvalidMessage(error)
 }
@@ -0,0 +1,64 @@
+// How often a peer may make each type of request. Requests over the limit are
+// refused with ProtoSlowDown, see Server.RouteMessage.
+
+package proto
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dfindex/dfi/util"
+)
+
+// Limits on each type of request from a single peer, by header. A token is
+// added to the bucket every Rate, up to Burst. Requests without a limit are
+// always allowed.
+var RateLimits = map[string]util.Limit{
+	// the burst allows for "mistakes" with titles or descriptions
+	ProtoDhtAnnounce: {Rate: time.Minute * 10, Burst: 3},
+
+	ProtoDhtQuery:       {Rate: time.Second / 4, Burst: 10},
+	ProtoDhtFindClosest: {Rate: time.Second / 4, Burst: 10},
+	ProtoSearch:         {Rate: time.Second / 2, Burst: 5},
+	ProtoRequestPiece:   {Rate: time.Second / 4, Burst: 8},
+	ProtoRequestAddPeer: {Rate: time.Minute, Burst: 3},
+}
+
+// Returned when a peer refused a request as we made too many of its type.
+// Retry is how long until it allows another.
+type SlowDownError struct {
+	Header string
+	Retry  time.Duration
+}
+
+func (e *SlowDownError) Error() string {
+	return fmt.Sprintf("Too many %s requests, retry in %s", e.Header, e.Retry)
+}
+
+// Refuses a request with the given header, as the peer has made too many. Peers
+// from before ProtoVersionSlowDown get a no with the reason instead.
+func (c *Client) WriteSlowDown(header string, retry time.Duration) error {
+	if c.version < ProtoVersionSlowDown {
+		return c.WriteErr(&SlowDownError{header, retry})
+	}
+
+	msg := &Message{Header: ProtoSlowDown}
+	err := msg.Write(MessageSlowDown{header, int64(retry / time.Millisecond)})
+
+	if err != nil {
+		return err
+	}
+
+	return c.WriteMessage(msg)
+}
+
+func readSlowDown(msg *Message) error {
+	var msd MessageSlowDown
+	err := msg.Read(&msd)
+
+	if err != nil {
+		return err
+	}
+
+	return &SlowDownError{msd.Header, time.Duration(msd.Retry) * time.Millisecond}
+}
@@ -0,0 +1,99 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi/dht"
+	"github.com/dfindex/dfi/util"
+)
+
+type limitedPeer struct {
+	NetworkPeer
+	limiter *util.PeerLimiter
+	invalid []error
+}
+
+func (p *limitedPeer) Address() *dht.Address      { return &dht.Address{} }
+func (p *limitedPeer) ProtocolVersion() int16     { return ProtoVersion }
+func (p *limitedPeer) Limiter() *util.PeerLimiter { return p.limiter }
+func (p *limitedPeer) InvalidMessage(err error)   { p.invalid = append(p.invalid, err) }
+
+type queryHandler struct {
+	ProtocolHandler
+	handled int
+}
+
+func (h *queryHandler) HandleQuery(msg *Message) error {
+	h.handled++
+	return msg.Client.WriteMessage(&Message{Header: ProtoOk})
+}
+
+func TestRouteSlowDown(t *testing.T) {
+	limiter := &util.PeerLimiter{}
+	limiter.Setup(map[string]util.Limit{ProtoDhtQuery: {Rate: time.Hour, Burst: 2}})
+	defer limiter.Stop()
+
+	peer := &limitedPeer{limiter: limiter}
+	handler := &queryHandler{}
+	server := Server{}
+
+	var err error
+
+	for i := 0; i < 3; i++ {
+		a, b := net.Pipe()
+
+		go serve(b, func(cl *Client, msg *Message) {
+			msg.Client = cl
+			cl.SetVersion(ProtoVersion)
+			server.RouteMessage(peer, msg, handler)
+		})
+
+		cl, _ := NewClient(a)
+		_, err = cl.Call(context.Background(), ProtoDhtQuery, "address")
+		a.Close()
+	}
+
+	if handler.handled != 2 {
+		t.Fatalf("Handled %d requests, expected the burst of 2", handler.handled)
+	}
+
+	slowDown, ok := err.(*SlowDownError)
+
+	if !ok {
+		t.Fatalf("Expected a slow down, got: %v", err)
+	}
+
+	if slowDown.Header != ProtoDhtQuery || slowDown.Retry != time.Hour {
+		t.Fatalf("Slow down for %s, retry in %s", slowDown.Header, slowDown.Retry)
+	}
+
+	// counts against the peer's reputation
+	if len(peer.invalid) != 1 {
+		t.Fatalf("Reported %d invalid messages, expected 1", len(peer.invalid))
+	}
+}
+
+func TestLegacySlowDown(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// peers that predate slow downs are refused with a reason
+	go serve(b, func(cl *Client, msg *Message) {
+		cl.WriteSlowDown(msg.Header, time.Second)
+	})
+
+	cl, _ := NewClient(a)
+	resp, err := cl.Call(context.Background(), ProtoSearch, "query")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Header != ProtoNo || refusal(resp) == nil {
+		t.Fatal("Legacy peer was not refused")
+	}
+}
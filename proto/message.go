@@ -3,7 +3,6 @@ package proto
 import (
 	"bytes"
 	"errors"
-	"io"
 	"net"
 
 	msgpack "gopkg.in/vmihailenco/msgpack.v2"
@@ -14,6 +13,7 @@ import (
 
 type Message struct {
 	Header      string
+	Id          uint64
 	Stream      net.Conn
 	Client      *Client
 	From        *dht.Address
@@ -22,6 +22,7 @@ type Message struct {
 	Content []byte
 }
 
+// Encodes iface as the content, compressed with m.Compression if set.
 func (m *Message) Write(iface interface{}) error {
 	writer := bytes.Buffer{}
 	encoder := msgpack.NewEncoder(&writer)
@@ -32,9 +33,22 @@ func (m *Message) Write(iface interface{}) error {
 		return err
 	}
 
-	m.Content = writer.Bytes()
+	m.Content, m.Compression, err = compress(m.Compression, writer.Bytes())
 
-	return nil
+	return err
+}
+
+// Compresses content that has already been written, unless it already is.
+// Used by Client.WriteMessage to apply the negotiated compression.
+func (m *Message) Compress(compression string) error {
+	if m.Compression != "" || m.Content == nil {
+		return nil
+	}
+
+	var err error
+	m.Content, m.Compression, err = compress(compression, m.Content)
+
+	return err
 }
 
 func (m *Message) Read(iface interface{}) error {
@@ -42,12 +56,17 @@ func (m *Message) Read(iface interface{}) error {
 		return errors.New("Message has no content")
 	}
 
-	reader := bytes.NewReader(m.Content)
-	limiter := &io.LimitedReader{R: reader, N: common.MaxMessageContentSize}
+	// the limit is on the decompressed size
+	reader, err := NewDecompressReader(m.Compression, bytes.NewReader(m.Content),
+		common.MaxMessageContentSize)
+
+	if err != nil {
+		return err
+	}
 
-	decoder := msgpack.NewDecoder(limiter)
+	decoder := msgpack.NewDecoder(reader)
 
-	err := decoder.Decode(iface)
+	err = decoder.Decode(iface)
 
 	return err
 }
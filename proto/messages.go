@@ -7,6 +7,8 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/sha3"
+
+	"github.com/dfindex/dfi/data"
 )
 
 // This contains the more "complex" structures that will be sent in message
@@ -28,6 +30,42 @@ type MessageRequestPiece struct {
 	Address string
 	Id      int
 	Length  int
+	// One of the piece formats, older peers leave this empty and will always
+	// send text.
+	Format string
+
+	// The compression of the piece stream, gzip when empty as older peers
+	// always gzip.
+	Compression string
+}
+
+// Sent instead of a response when a peer makes requests of one type faster than
+// allowed. Retry is how long until another is allowed, in milliseconds.
+type MessageSlowDown struct {
+	Header string
+	Retry  int64
+}
+
+type MessageRequestPieceProof struct {
+	Address string
+	Id      int
+}
+
+// A single piece, along with the audit path needed to check it against the
+// collection root. Size is the number of pieces in the collection.
+type MessagePieceProof struct {
+	Id    int
+	Size  int
+	Proof [][]byte
+	Posts []data.Post
+}
+
+// The maximum number of operations sent in response to a single request.
+const MaxOperations = 1000
+
+type MessageRequestOperations struct {
+	Address string
+	Since   int
 }
 
 // Allows us to decode a pieces without also decoding all of the posts within it.
@@ -40,6 +78,12 @@ type MessageCapabilities struct {
 	// Index 0 is the preferred method. The method used is the shared method
 	// with the lowest index.
 	Compression []string
+
+	// The piece wire formats supported, again in order of preference.
+	PieceFormats []string
+
+	// The transport encryptions supported, again in order of preference.
+	Encryption []string
 }
 
 func (mp *MessagePiece) Hash() ([]byte, error) {
@@ -56,19 +100,38 @@ func (mp *MessagePiece) Hash() ([]byte, error) {
 }
 
 func (mhl *MessageCollection) Verify(root []byte) error {
-	hash := sha3.New256()
-
-	for i := 0; i < mhl.Size; i++ {
-		hash.Write(mhl.HashList[32*i : (32*i)+32])
+	if mhl.Size < 0 || len(mhl.HashList) != mhl.Size*data.HashSize {
+		return errors.New("Hash list size mismatch")
 	}
 
-	if !bytes.Equal(hash.Sum(nil), root) {
+	if !bytes.Equal(data.MerkleRoot(mhl.HashList), root) {
 		return errors.New("Invalid hash list")
 	}
 
 	return nil
 }
 
+// Rebuilds the piece from the posts sent, then checks it's hash against the
+// collection root using the audit path.
+func (mpp *MessagePieceProof) Verify(root []byte) (*data.Piece, error) {
+	if len(mpp.Posts) > data.PieceSize {
+		return nil, errors.New("Piece has too many posts")
+	}
+
+	piece := &data.Piece{Id: uint(mpp.Id)}
+	piece.Setup()
+
+	for _, i := range mpp.Posts {
+		piece.Add(i, true)
+	}
+
+	if !data.VerifyMerkleProof(root, piece.Hash(), mpp.Id, mpp.Size, mpp.Proof) {
+		return nil, errors.New("Invalid piece proof")
+	}
+
+	return piece, nil
+}
+
 func (mhl *MessageCollection) Encode() ([]byte, error) {
 	data, err := json.Marshal(mhl)
 	return data, err
@@ -83,3 +146,8 @@ func (mrp *MessageRequestPiece) Encode() ([]byte, error) {
 	data, err := json.Marshal(mrp)
 	return data, err
 }
+
+func (mrp *MessageRequestPieceProof) Encode() ([]byte, error) {
+	data, err := json.Marshal(mrp)
+	return data, err
+}
@@ -7,4 +7,7 @@ type ConnHeader struct {
 	Client       Client
 	Entry        dht.Entry
 	Capabilities MessageCapabilities
+
+	// The protocol version negotiated for the connection.
+	Version int16
 }
@@ -0,0 +1,549 @@
+// An encrypted transport for peer connections, following
+// Noise_XX_25519_AESGCM_SHA256 (http://noiseprotocol.org/noise.html).
+// Both sides sign the handshake hash with their ed25519 identity once their
+// static key has been sent, binding the channel to the entries exchanged in the
+// handshake. The static keys are made for each connection, so only the
+// signatures identify a peer.
+
+package proto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/dfindex/dfi/common"
+	"github.com/dfindex/dfi/dht"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	noiseProtocolName = "Noise_XX_25519_AESGCM_SHA256"
+	noiseKeySize      = 32
+	noiseTagSize      = 16
+
+	// Every noise message, handshake or transport, is at most this long.
+	noiseMaxMessage = 65535
+)
+
+var (
+	// Refuse peers that do not negotiate EncryptionNoiseXX, rather than falling
+	// back to plaintext.
+	RequireEncryption = false
+
+	ErrNotEncrypted = errors.New("Peer did not negotiate encryption")
+)
+
+// What one side sent during the plaintext handshake, the raw content of its
+// entry and capabilities messages.
+type Transcript struct {
+	Entry        []byte
+	Capabilities []byte
+}
+
+// Wraps conn in an encrypted channel if both peers support one, otherwise it
+// is returned as is, or refused if RequireEncryption is set. dialed is true for
+// the peer that opened the connection, the other starts the noise handshake as
+// it was the last to read during the plaintext handshake. peer is the entry the
+// remote sent in that handshake, sent and recieved are what each side said.
+func Secure(conn net.Conn, dialed bool, signer common.Signer, local, remote *MessageCapabilities, peer *dht.Entry, sent, recieved Transcript) (net.Conn, error) {
+	var encryption string
+
+	if dialed {
+		encryption = ChooseEncryption(*local, *remote)
+	} else {
+		encryption = ChooseEncryption(*remote, *local)
+	}
+
+	if encryption != EncryptionNoiseXX {
+		if RequireEncryption {
+			return nil, ErrNotEncrypted
+		}
+
+		log.WithField("peer", peer.Address.StringOr("")).Warn("Connection is not encrypted")
+		return conn, nil
+	}
+
+	// the capabilities were sent in plaintext, so the whole handshake goes into
+	// the prologue, otherwise encryption could be stripped from them unnoticed
+	prologue := noisePrologue(signer.PublicKey(), peer.PublicKey, sent, recieved)
+
+	if dialed {
+		prologue = noisePrologue(peer.PublicKey, signer.PublicKey(), recieved, sent)
+	}
+
+	hs := &noiseHandshake{
+		conn:      conn,
+		initiator: !dialed,
+		signer:    signer,
+		remoteKey: peer.PublicKey,
+		ss:        newSymmetricState(prologue),
+	}
+
+	ret, err := hs.run()
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithField("peer", peer.Address.StringOr("")).Debug("Connection encrypted")
+
+	return ret, nil
+}
+
+// Both identities and everything sent in the plaintext handshake, initiator
+// first. Each part is length prefixed, so none can be moved into another.
+func noisePrologue(initiatorKey, responderKey []byte, initiator, responder Transcript) []byte {
+	ret := []byte{}
+	parts := [][]byte{
+		initiatorKey, responderKey,
+		initiator.Entry, initiator.Capabilities,
+		responder.Entry, responder.Capabilities,
+	}
+
+	for _, i := range parts {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(i)))
+
+		ret = append(ret, length[:]...)
+		ret = append(ret, i...)
+	}
+
+	return ret
+}
+
+// An AEAD key and the nonce to use with it next.
+type cipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newCipherState(key []byte) (*cipherState, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &cipherState{aead: aead}, nil
+}
+
+// 32 bits of zeros followed by the big endian counter, as the noise spec has it
+// for AESGCM.
+func (cs *cipherState) nonce() []byte {
+	nonce := make([]byte, cs.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[4:], cs.n)
+	cs.n++
+
+	return nonce
+}
+
+func (cs *cipherState) encrypt(ad, plaintext []byte) []byte {
+	return cs.aead.Seal(nil, cs.nonce(), plaintext, ad)
+}
+
+func (cs *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	return cs.aead.Open(nil, cs.nonce(), ciphertext, ad)
+}
+
+// The chaining key and handshake hash, along with the key once there is one.
+type symmetricState struct {
+	ck []byte
+	h  []byte
+	cs *cipherState
+}
+
+func newSymmetricState(prologue []byte) *symmetricState {
+	// the name fits in a hash, so it is just padded
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocolName)
+
+	ss := &symmetricState{ck: h, h: h}
+	ss.mixHash(prologue)
+
+	return ss
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(ss.h)
+	hash.Write(data)
+	ss.h = hash.Sum(nil)
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) error {
+	var key []byte
+	var err error
+
+	ss.ck, key = noiseHkdf(ss.ck, ikm)
+	ss.cs, err = newCipherState(key)
+
+	return err
+}
+
+func (ss *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := plaintext
+
+	if ss.cs != nil {
+		ciphertext = ss.cs.encrypt(ss.h, plaintext)
+	}
+
+	ss.mixHash(ciphertext)
+
+	return ciphertext
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+
+	if ss.cs != nil {
+		var err error
+		plaintext, err = ss.cs.decrypt(ss.h, ciphertext)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ss.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// The initiator sends with the first, the responder with the second.
+func (ss *symmetricState) split() (*cipherState, *cipherState, error) {
+	k1, k2 := noiseHkdf(ss.ck, nil)
+
+	c1, err := newCipherState(k1)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c2, err := newCipherState(k2)
+
+	return c1, c2, err
+}
+
+// HKDF with two outputs, as the noise spec defines it.
+func noiseHkdf(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{0x01})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
+
+type noiseKeyPair struct {
+	private [noiseKeySize]byte
+	public  [noiseKeySize]byte
+}
+
+func newNoiseKeyPair() (*noiseKeyPair, error) {
+	kp := &noiseKeyPair{}
+
+	if _, err := io.ReadFull(rand.Reader, kp.private[:]); err != nil {
+		return nil, err
+	}
+
+	curve25519.ScalarBaseMult(&kp.public, &kp.private)
+
+	return kp, nil
+}
+
+func (kp *noiseKeyPair) dh(public []byte) []byte {
+	var pub, ret [noiseKeySize]byte
+	copy(pub[:], public)
+	curve25519.ScalarMult(&ret, &kp.private, &pub)
+
+	return ret[:]
+}
+
+// Runs the XX pattern:
+//
+//	-> e
+//	<- e, ee, s, es, signature
+//	-> s, se, signature
+type noiseHandshake struct {
+	conn      net.Conn
+	initiator bool
+	signer    common.Signer
+	remoteKey []byte
+	ss        *symmetricState
+
+	s, e   *noiseKeyPair
+	rs, re []byte
+}
+
+func (hs *noiseHandshake) run() (*SecureConn, error) {
+	var err error
+
+	hs.s, err = newNoiseKeyPair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	hs.e, err = newNoiseKeyPair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if hs.initiator {
+		err = hs.writeEphemeral()
+
+		if err == nil {
+			err = hs.readIdentity(true)
+		}
+
+		if err == nil {
+			err = hs.writeIdentity(false)
+		}
+	} else {
+		err = hs.readEphemeral()
+
+		if err == nil {
+			err = hs.writeIdentity(true)
+		}
+
+		if err == nil {
+			err = hs.readIdentity(false)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c1, c2, err := hs.ss.split()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if hs.initiator {
+		return &SecureConn{Conn: hs.conn, send: c1, recv: c2}, nil
+	}
+
+	return &SecureConn{Conn: hs.conn, send: c2, recv: c1}, nil
+}
+
+// -> e
+func (hs *noiseHandshake) writeEphemeral() error {
+	hs.ss.mixHash(hs.e.public[:])
+	msg := append(hs.e.public[:], hs.ss.encryptAndHash(nil)...)
+
+	return writeNoiseMessage(hs.conn, msg)
+}
+
+func (hs *noiseHandshake) readEphemeral() error {
+	msg, err := readNoiseMessage(hs.conn)
+
+	if err != nil {
+		return err
+	}
+
+	if len(msg) < noiseKeySize {
+		return errors.New("Noise message too short")
+	}
+
+	hs.re = msg[:noiseKeySize]
+	hs.ss.mixHash(hs.re)
+
+	_, err = hs.ss.decryptAndHash(msg[noiseKeySize:])
+
+	return err
+}
+
+// <- e, ee, s, es, signature when first, -> s, se, signature otherwise.
+func (hs *noiseHandshake) writeIdentity(first bool) error {
+	msg := make([]byte, 0, noiseKeySize*2+noiseTagSize*2+ed25519.SignatureSize)
+
+	if first {
+		hs.ss.mixHash(hs.e.public[:])
+		msg = append(msg, hs.e.public[:]...)
+
+		if err := hs.ss.mixKey(hs.e.dh(hs.re)); err != nil {
+			return err
+		}
+	}
+
+	msg = append(msg, hs.ss.encryptAndHash(hs.s.public[:])...)
+
+	if err := hs.ss.mixKey(hs.s.dh(hs.re)); err != nil {
+		return err
+	}
+
+	msg = append(msg, hs.ss.encryptAndHash(hs.signer.Sign(hs.ss.h))...)
+
+	return writeNoiseMessage(hs.conn, msg)
+}
+
+func (hs *noiseHandshake) readIdentity(first bool) error {
+	msg, err := readNoiseMessage(hs.conn)
+
+	if err != nil {
+		return err
+	}
+
+	size := noiseKeySize + noiseTagSize
+	if first {
+		size += noiseKeySize
+	}
+
+	if len(msg) < size {
+		return errors.New("Noise message too short")
+	}
+
+	if first {
+		hs.re = msg[:noiseKeySize]
+		msg = msg[noiseKeySize:]
+		hs.ss.mixHash(hs.re)
+
+		if err = hs.ss.mixKey(hs.e.dh(hs.re)); err != nil {
+			return err
+		}
+	}
+
+	hs.rs, err = hs.ss.decryptAndHash(msg[:noiseKeySize+noiseTagSize])
+
+	if err != nil {
+		return err
+	}
+
+	if err = hs.ss.mixKey(hs.e.dh(hs.rs)); err != nil {
+		return err
+	}
+
+	// the signature covers everything up to here
+	signed := hs.ss.h
+	signature, err := hs.ss.decryptAndHash(msg[noiseKeySize+noiseTagSize:])
+
+	if err != nil {
+		return err
+	}
+
+	if len(signature) != ed25519.SignatureSize || !ed25519.Verify(hs.remoteKey, signed, signature) {
+		return errors.New("Noise handshake not signed by peer")
+	}
+
+	return nil
+}
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	if len(msg) > noiseMaxMessage {
+		return errors.New("Noise message too long")
+	}
+
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+
+	err := binary.Read(r, binary.BigEndian, &length)
+
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, length)
+	_, err = io.ReadFull(r, msg)
+
+	return msg, err
+}
+
+// A net.Conn that encrypts everything written to it, and decrypts everything
+// read, once the noise handshake is done. Deadlines and addresses are those of
+// the underlying connection.
+type SecureConn struct {
+	net.Conn
+
+	send, recv *cipherState
+
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+	readBuf    []byte
+}
+
+func (sc *SecureConn) Read(b []byte) (int, error) {
+	sc.readMutex.Lock()
+	defer sc.readMutex.Unlock()
+
+	for len(sc.readBuf) == 0 {
+		msg, err := readNoiseMessage(sc.Conn)
+
+		if err != nil {
+			return 0, err
+		}
+
+		sc.readBuf, err = sc.recv.decrypt(nil, msg)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, sc.readBuf)
+	sc.readBuf = sc.readBuf[n:]
+
+	return n, nil
+}
+
+func (sc *SecureConn) Write(b []byte) (int, error) {
+	sc.writeMutex.Lock()
+	defer sc.writeMutex.Unlock()
+
+	written := 0
+
+	for len(b) > 0 {
+		size := len(b)
+
+		if size > noiseMaxMessage-noiseTagSize {
+			size = noiseMaxMessage - noiseTagSize
+		}
+
+		err := writeNoiseMessage(sc.Conn, sc.send.encrypt(nil, b[:size]))
+
+		if err != nil {
+			return written, err
+		}
+
+		written += size
+		b = b[size:]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,183 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/dfindex/dfi/dht"
+)
+
+type testSigner struct {
+	public  ed25519.PublicKey
+	private ed25519.PrivateKey
+	entry   *dht.Entry
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	public, private, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := &dht.Entry{PublicKey: public}
+	entry.Address.Generate(public)
+
+	return &testSigner{public, private, entry}
+}
+
+func (ts *testSigner) Sign(msg []byte) []byte {
+	return ed25519.Sign(ts.private, msg)
+}
+
+func (ts *testSigner) PublicKey() []byte {
+	return ts.public
+}
+
+// What signer would send in the plaintext handshake.
+func testTranscript(t *testing.T, signer *testSigner, caps *MessageCapabilities) Transcript {
+	entry, capabilities := Message{}, Message{}
+
+	if err := entry.Write(signer.entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := capabilities.Write(caps); err != nil {
+		t.Fatal(err)
+	}
+
+	return Transcript{entry.Content, capabilities.Content}
+}
+
+// Secures both ends of a pipe, the dialer expecting to talk to expect. If
+// tamper is not nil it changes what the listener recieved from the dialer.
+func securePipe(t *testing.T, dialer, listener, expect *testSigner, caps *MessageCapabilities, tamper func(*Transcript)) (net.Conn, net.Conn, error, error) {
+	a, b := net.Pipe()
+
+	dialed := testTranscript(t, dialer, caps)
+	listened := testTranscript(t, listener, caps)
+	recieved := dialed
+
+	if tamper != nil {
+		tamper(&recieved)
+	}
+
+	var secureA, secureB net.Conn
+	var errA, errB error
+	done := make(chan bool)
+
+	go func() {
+		secureB, errB = Secure(b, false, listener, caps, caps, dialer.entry, listened, recieved)
+		if errB != nil {
+			b.Close()
+		}
+		done <- true
+	}()
+
+	secureA, errA = Secure(a, true, dialer, caps, caps, expect.entry, dialed, listened)
+	if errA != nil {
+		a.Close()
+	}
+	<-done
+
+	return secureA, secureB, errA, errB
+}
+
+func TestSecureConn(t *testing.T) {
+	dialer := newTestSigner(t)
+	listener := newTestSigner(t)
+	caps := &MessageCapabilities{Encryption: Encryptions}
+
+	a, b, errA, errB := securePipe(t, dialer, listener, listener, caps, nil)
+
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+
+	if _, ok := a.(*SecureConn); !ok {
+		t.Fatal("Connection was not encrypted")
+	}
+
+	// bigger than a single noise message
+	sent := bytes.Repeat([]byte("dfi"), noiseMaxMessage)
+	go func() {
+		a.Write(sent)
+		a.Close()
+	}()
+
+	recieved, err := io.ReadAll(b)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(sent, recieved) {
+		t.Fatal("Recieved data differs from that sent")
+	}
+}
+
+func TestSecureConnWrongPeer(t *testing.T) {
+	dialer := newTestSigner(t)
+	listener := newTestSigner(t)
+	mallory := newTestSigner(t)
+	caps := &MessageCapabilities{Encryption: Encryptions}
+
+	_, _, errA, _ := securePipe(t, dialer, listener, mallory, caps, nil)
+
+	if errA == nil {
+		t.Fatal("Handshake with the wrong peer succeeded")
+	}
+}
+
+func TestSecureConnPlaintext(t *testing.T) {
+	a, _ := net.Pipe()
+	signer := newTestSigner(t)
+
+	conn, err := Secure(a, true, signer, &MessageCapabilities{Encryption: Encryptions},
+		&MessageCapabilities{}, signer.entry, Transcript{}, Transcript{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conn != a {
+		t.Fatal("Connection to a peer without encryption was wrapped")
+	}
+}
+
+// Capabilities are sent in plaintext, anything changed on the way must fail the
+// noise handshake.
+func TestSecureConnTampered(t *testing.T) {
+	dialer := newTestSigner(t)
+	listener := newTestSigner(t)
+	caps := &MessageCapabilities{Encryption: Encryptions}
+
+	_, _, errA, errB := securePipe(t, dialer, listener, listener, caps, func(tr *Transcript) {
+		stripped := Message{}
+		stripped.Write(&MessageCapabilities{Encryption: Encryptions, PieceFormats: PieceFormats})
+		tr.Capabilities = stripped.Content
+	})
+
+	if errA == nil || errB == nil {
+		t.Fatal("Handshake succeeded with tampered capabilities")
+	}
+}
+
+func TestSecureConnRequired(t *testing.T) {
+	RequireEncryption = true
+	defer func() { RequireEncryption = false }()
+
+	a, _ := net.Pipe()
+	signer := newTestSigner(t)
+
+	_, err := Secure(a, true, signer, &MessageCapabilities{Encryption: Encryptions},
+		&MessageCapabilities{}, signer.entry, Transcript{}, Transcript{})
+
+	if err != ErrNotEncrypted {
+		t.Fatal("Accepted a peer without encryption")
+	}
+}
@@ -4,9 +4,23 @@ package proto
 
 var (
 	// Protocol header, so we know this is a dfi client.
-	// Version should follow.
-	ProtoDFI     int16 = 0x7a66
-	ProtoVersion int16 = 0x0000
+	// Version should follow, see OfferVersion.
+	ProtoDFI int16 = 0x7a66
+
+	// The highest protocol version we speak, and the lowest we still accept.
+	ProtoVersion    int16 = 0x0003
+	ProtoMinVersion int16 = 0x0000
+
+	// The first version to compress message content, earlier peers advertise
+	// compression but ignore it.
+	ProtoVersionCompression int16 = 0x0002
+
+	// The first version that may refuse requests with ProtoSlowDown, and so
+	// precedes piece streams with ProtoOk.
+	ProtoVersionSlowDown int16 = 0x0003
+
+	// Spoken by peers from before versions were negotiated.
+	ProtoVersionLegacy int16 = 0x0000
 
 	ProtoHeader = "header"
 	ProtoCap    = ":ap"
@@ -19,6 +33,9 @@ var (
 	ProtoSig       = "sig"
 	ProtoDone      = "done"
 
+	// Too many requests of one type, see MessageSlowDown and RateLimits.
+	ProtoSlowDown = "slowdown"
+
 	ProtoSearch  = "search"  // Request a search
 	ProtoRecent  = "recent"  // Request recent posts
 	ProtoPopular = "popular" // Request popular posts
@@ -28,14 +45,49 @@ var (
 	// This is the peer we are requesting a hash list for.
 	ProtoRequestHashList = "req.hashlist"
 	ProtoRequestPiece    = "req.piece"
+	// Request a single piece along with its Merkle audit path, allowing it to
+	// be verified against the signed collection hash without the hash list.
+	ProtoRequestPieceProof = "req.pieceproof"
+	// Request the signed operation log (tombstones, amendments) for an address,
+	// starting after a given operation id.
+	ProtoRequestOperations = "req.ops"
 	// Requests that this peer be added to the remotes Peers slice for a given
 	// entry. This must be called at least once every hour to ensure that the peer
 	// stays registered as a seed, otherwise it is culled.
 	// TODO: Look into how Bittorrent trackers keep peer lists up to date properly.
 	ProtoRequestAddPeer = "req.addpeer"
 
-	ProtoPosts    = "posts" // A list of posts in Content
-	ProtoHashList = "hashlist"
+	ProtoPosts      = "posts" // A list of posts in Content
+	ProtoHashList   = "hashlist"
+	ProtoPieceProof = "pieceproof"
+	ProtoOperations = "ops"
+
+	// Piece wire formats. Text is the original pipe separated format, which
+	// peers without any PieceFormats capability expect. The version is part of
+	// the name, so the format can change without breaking older peers.
+	PieceFormatText    = "text"
+	PieceFormatMsgpack = "msgpack.1"
+
+	// Piece formats we support, in order of preference.
+	PieceFormats = []string{PieceFormatMsgpack, PieceFormatText}
+
+	// Compressions, for message content and piece streams. Pieces are always
+	// gzipped for peers that do not ask for anything else.
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+	CompressionNone   = "none"
+
+	// Compressions we support, in order of preference.
+	Compressions = []string{CompressionZstd, CompressionGzip, CompressionSnappy,
+		CompressionNone}
+
+	// Transport encryptions, none is used when peers share nothing. See
+	// Secure.
+	EncryptionNoiseXX = "noise.xx.25519.aesgcm.sha256"
+
+	// Encryptions we support, in order of preference.
+	Encryptions = []string{EncryptionNoiseXX}
 
 	ProtoDhtEntry       = "dht.entry" // An individual DHT entry in Content
 	ProtoDhtEntries     = "dht.entries"
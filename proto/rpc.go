@@ -0,0 +1,145 @@
+// Requests made over a stream. Each carries an id that the response echoes, and
+// is bounded by both a context and the timeout for its header.
+
+package proto
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// How long a request may take if its header is not in Timeouts.
+	DefaultTimeout = time.Second * 10
+
+	// How long each type of request may take, from sending it to reading the
+	// last of the response. Collections and piece streams can be large.
+	Timeouts = map[string]time.Duration{
+		ProtoRequestHashList: time.Minute,
+		ProtoRequestPiece:    time.Minute * 5,
+	}
+)
+
+var ErrWrongResponse = errors.New("Peer responded to a different request")
+
+// The last request id handed out, ids are unique to this process.
+var lastRequestId uint64
+
+// How long a request with the given header may take.
+func Timeout(header string) time.Duration {
+	if timeout, ok := Timeouts[header]; ok {
+		return timeout
+	}
+
+	return DefaultTimeout
+}
+
+// Starts a request on this stream. msg gets a new id, and the stream a deadline
+// of whichever comes first out of ctx's and the timeout for the header. If ctx
+// is done before the returned func is called the stream is closed, stopping
+// anything blocked on it, as a half read response leaves it unusable anyway.
+func (c *Client) begin(ctx context.Context, msg *Message) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.requestId = atomic.AddUint64(&lastRequestId, 1)
+	msg.Id = c.requestId
+
+	deadline := time.Now().Add(Timeout(msg.Header))
+
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	err := c.conn.SetDeadline(deadline)
+
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan bool)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+			c.conn.Close()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }, nil
+}
+
+// Sends a request with the given content and waits for the response. Once ctx
+// is done, any error returned is ctx.Err().
+func (c *Client) Call(ctx context.Context, header string, content interface{}) (*Message, error) {
+	msg := &Message{Header: header}
+	err := msg.Write(content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := c.begin(ctx, msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer end()
+
+	err = c.WriteMessage(msg)
+
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+
+	resp, err := c.ReadMessage()
+
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+
+	// peers from before request ids never send one
+	if resp.Id != 0 && resp.Id != msg.Id {
+		return nil, ErrWrongResponse
+	}
+
+	if resp.Header == ProtoSlowDown {
+		return nil, readSlowDown(resp)
+	}
+
+	return resp, nil
+}
+
+// Why the peer refused a request, given its response. nil if it did not.
+func refusal(resp *Message) error {
+	switch resp.Header {
+	case ProtoOk:
+		return nil
+
+	case ProtoSlowDown:
+		return readSlowDown(resp)
+	}
+
+	var reason string
+
+	if resp.Read(&reason) != nil || reason == "" {
+		return errors.New("Peer refused the request")
+	}
+
+	return errors.New(reason)
+}
+
+// Errors caused by cancelling a request are reported as the cancellation.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
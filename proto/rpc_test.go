@@ -0,0 +1,123 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dfindex/dfi/dht"
+)
+
+// Reads one request from conn, then calls respond with the client for it.
+func serve(conn net.Conn, respond func(*Client, *Message)) {
+	cl, _ := NewClient(conn)
+	msg, err := cl.ReadMessage()
+
+	if err != nil {
+		return
+	}
+
+	cl.requestId = msg.Id
+	respond(cl, msg)
+}
+
+func TestCallId(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go serve(b, func(cl *Client, msg *Message) {
+		cl.WriteMessage(Message{Header: ProtoOk})
+	})
+
+	cl, _ := NewClient(a)
+	resp, err := cl.Call(context.Background(), ProtoDhtQuery, "address")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !resp.Ok() || resp.Id == 0 || resp.Id != cl.requestId {
+		t.Fatalf("Response has id %d, request had %d", resp.Id, cl.requestId)
+	}
+
+	c, d := net.Pipe()
+	defer c.Close()
+	defer d.Close()
+
+	go serve(d, func(cl *Client, msg *Message) {
+		cl.WriteMessage(&Message{Header: ProtoOk, Id: msg.Id + 1})
+	})
+
+	cl, _ = NewClient(c)
+
+	if _, err = cl.Call(context.Background(), ProtoDhtQuery, "address"); err != ErrWrongResponse {
+		t.Fatalf("Expected a wrong response, got: %v", err)
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// never responds
+	go serve(b, func(*Client, *Message) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+
+	cl, _ := NewClient(a)
+
+	if _, err := cl.Call(ctx, ProtoDhtQuery, "address"); err != context.Canceled {
+		t.Fatalf("Expected the call to be cancelled, got: %v", err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	defer func(timeouts map[string]time.Duration) { Timeouts = timeouts }(Timeouts)
+	Timeouts = map[string]time.Duration{ProtoDhtQuery: time.Millisecond * 50}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go serve(b, func(*Client, *Message) {})
+
+	cl, _ := NewClient(a)
+	_, err := cl.Call(context.Background(), ProtoDhtQuery, "address")
+
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected a timeout, got: %v", err)
+	}
+}
+
+func TestPiecesCancel(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	go serve(b, func(*Client, *Message) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cl, _ := NewClient(a)
+
+	pieces := cl.Pieces(ctx, dht.Address{}, 0, 10, PieceFormatMsgpack)
+
+	if pieces == nil {
+		t.Fatal("Failed to request pieces")
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-pieces:
+		if ok {
+			t.Fatal("Recieved a piece after cancelling")
+		}
+
+	case <-time.After(time.Second * 5):
+		t.Fatal("Piece stream was not cancelled")
+	}
+}
@@ -3,9 +3,10 @@ package proto
 // tcp server
 
 import (
-	"encoding/binary"
+	"errors"
 	"io"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/dfindex/dfi/common"
@@ -47,29 +48,22 @@ func (s *Server) Listen(addr string, handler ProtocolHandler, data common.Encode
 
 		log.Info("New TCP connection")
 
-		var dfi int16
-		binary.Read(conn, binary.LittleEndian, &dfi)
-
-		if dfi != ProtoDFI {
-			log.Error("This is not a DFI connection: ", dfi)
-			continue
-		}
-
-		log.Debug("DFI connection")
-
-		var version int16
-		binary.Read(conn, binary.LittleEndian, &version)
-
-		if version != ProtoVersion {
-			log.Error("Incorrect protocol version: ", version)
-			continue
-		}
+		go s.accept(conn, handler, data)
+	}
+}
 
-		log.Debug("Correct version")
+// Negotiates a protocol version with a new connection, then handshakes.
+func (s *Server) accept(conn net.Conn, handler ProtocolHandler, data common.Encoder) {
+	version, err := AcceptVersion(conn)
 
-		log.Debug("Handshaking new connection")
-		go s.Handshake(conn, handler, data)
+	if err != nil {
+		log.Error(err.Error())
+		conn.Close()
+		return
 	}
+
+	log.WithField("version", version).Debug("Handshaking new connection")
+	s.Handshake(conn, version, handler, data)
 }
 
 func (s *Server) ListenStream(peer NetworkPeer, handler ProtocolHandler) {
@@ -95,7 +89,8 @@ func (s *Server) ListenStream(peer NetworkPeer, handler ProtocolHandler) {
 			return
 		}
 
-		err = stream.SetDeadline(time.Now().Add(time.Second * 10))
+		// until the request is read, and its timeout known
+		err = stream.SetDeadline(time.Now().Add(DefaultTimeout))
 
 		if err != nil {
 			log.Error(err.Error())
@@ -121,6 +116,9 @@ func (s *Server) HandleStream(peer NetworkPeer, handler ProtocolHandler, stream
 		return
 	}
 
+	cl.SetCompression(peer.Compression())
+	cl.SetVersion(peer.ProtocolVersion())
+
 	for {
 		msg, err := cl.ReadMessage()
 
@@ -128,44 +126,98 @@ func (s *Server) HandleStream(peer NetworkPeer, handler ProtocolHandler, stream
 			if err != io.EOF {
 				log.Error(err.Error())
 			}
+
+			if malformed(err) {
+				peer.InvalidMessage(err)
+			}
+
 			return
 		}
 		msg.Client = cl
 		msg.From = peer.Address()
 
-		s.RouteMessage(msg, handler)
+		// responses carry the id of the request
+		cl.requestId = msg.Id
+		err = stream.SetDeadline(time.Now().Add(Timeout(msg.Header)))
+
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+
+		s.RouteMessage(peer, msg, handler)
 	}
 }
 
-func (s *Server) RouteMessage(msg *Message, handler ProtocolHandler) {
+// Whether a read failed because the peer sent something that does not decode,
+// rather than because of the connection.
+func malformed(err error) bool {
+	return strings.HasPrefix(err.Error(), "msgpack:")
+}
+
+// Handles one type of message.
+type Route func(ProtocolHandler, *Message) error
+
+var routesV0 = map[string]Route{
+	ProtoDhtAnnounce:       ProtocolHandler.HandleAnnounce,
+	ProtoDhtQuery:          ProtocolHandler.HandleQuery,
+	ProtoDhtFindClosest:    ProtocolHandler.HandleFindClosest,
+	ProtoSearch:            ProtocolHandler.HandleSearch,
+	ProtoRecent:            ProtocolHandler.HandleRecent,
+	ProtoPopular:           ProtocolHandler.HandlePopular,
+	ProtoRequestHashList:   ProtocolHandler.HandleHashList,
+	ProtoRequestPiece:      ProtocolHandler.HandlePiece,
+	ProtoRequestPieceProof: ProtocolHandler.HandlePieceProof,
+	ProtoRequestOperations: ProtocolHandler.HandleOperations,
+	ProtoRequestAddPeer:    ProtocolHandler.HandleAddPeer,
+}
+
+// The messages understood at each protocol version, by header. A version that
+// changes a message gets its own table, so peers still speaking an older
+// version are routed as they always were. Version 1 only added negotiation,
+// 2 compressed content and 3 slow down responses, none of which changed any
+// requests.
+var VersionRoutes = map[int16]map[string]Route{
+	0: routesV0,
+	1: routesV0,
+	2: routesV0,
+	3: routesV0,
+}
+
+// Passes a request from peer to its handler, unless the peer has made too many
+// of that type recently. Those get a slow down instead, see RateLimits. Both
+// those and unknown messages count against the peer.
+func (s *Server) RouteMessage(peer NetworkPeer, msg *Message, handler ProtocolHandler) {
 	var err error
 
 	defer msg.Client.Close()
 
-	switch msg.Header {
+	version := peer.ProtocolVersion()
+	route, ok := VersionRoutes[version][msg.Header]
 
-	case ProtoDhtAnnounce:
-		err = handler.HandleAnnounce(msg)
-	case ProtoDhtQuery:
-		err = handler.HandleQuery(msg)
-	case ProtoDhtFindClosest:
-		err = handler.HandleFindClosest(msg)
-	case ProtoSearch:
-		err = handler.HandleSearch(msg)
-	case ProtoRecent:
-		err = handler.HandleRecent(msg)
-	case ProtoPopular:
-		err = handler.HandlePopular(msg)
-	case ProtoRequestHashList:
-		err = handler.HandleHashList(msg)
-	case ProtoRequestPiece:
-		err = handler.HandlePiece(msg)
-	case ProtoRequestAddPeer:
-		err = handler.HandleAddPeer(msg)
+	if !ok {
+		log.WithFields(log.Fields{
+			"header":  msg.Header,
+			"version": version,
+		}).Error("Unknown message type")
 
-	default:
-		log.Error("Unknown message type")
+		peer.InvalidMessage(errors.New("Unknown message type: " + msg.Header))
 
+		return
+	}
+
+	if allowed, retry := peer.Limiter().Allow(msg.Header); allowed {
+		err = route(handler, msg)
+	} else {
+		log.WithFields(log.Fields{
+			"peer":   peer.Address().StringOr(""),
+			"header": msg.Header,
+		}).Warn("Peer is making too many requests, asking it to slow down")
+
+		slowDown := &SlowDownError{msg.Header, retry}
+		peer.InvalidMessage(slowDown)
+
+		err = msg.Client.WriteSlowDown(slowDown.Header, slowDown.Retry)
 	}
 
 	if err != nil {
@@ -174,7 +226,7 @@ func (s *Server) RouteMessage(msg *Message, handler ProtocolHandler) {
 
 }
 
-func (s *Server) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encoder) {
+func (s *Server) Handshake(conn net.Conn, version int16, lp ProtocolHandler, data common.Encoder) {
 	cl, err := NewClient(conn)
 
 	if err != nil {
@@ -182,21 +234,49 @@ func (s *Server) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encode
 		return
 	}
 
-	header, caps, err := handshake(*cl, lp, data)
+	// refused before anything is read, if we can tell already
+	if lp.Banned(nil, conn.RemoteAddr().String()) {
+		log.WithField("from", conn.RemoteAddr().String()).Info("Refusing banned peer")
+		conn.Close()
+		return
+	}
+
+	header, caps, recieved, sent, err := handshake(*cl, lp, data)
+
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	if lp.Banned(&header.Address, header.PublicAddress) {
+		log.WithField("peer", header.Address.StringOr("")).Info("Refusing banned peer")
+		conn.Close()
+		return
+	}
+
+	secure, err := Secure(conn, false, lp, s.capabilities, caps, header, sent, recieved)
+
+	if err != nil {
+		log.Error(err.Error())
+		conn.Close()
+		return
+	}
+
+	cl, err = NewClient(secure)
 
 	if err != nil {
 		log.Error(err.Error())
 		return
 	}
 
-	peer, err := lp.HandleHandshake(ConnHeader{*cl, *header, *caps})
+	peer, err := lp.HandleHandshake(ConnHeader{*cl, *header, *caps, version})
 
 	if err != nil {
 		log.Error(err.Error())
 		return
 	}
 
-	lp.SetCapabilities(*caps)
+	peer.SetCapabilities(*caps)
 	lp.SetNetworkPeer(peer)
 
 	go s.ListenStream(peer, lp)
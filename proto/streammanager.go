@@ -3,7 +3,6 @@
 package proto
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -38,6 +37,20 @@ func (sm *StreamManager) SetConnection(conn ConnHeader) {
 	sm.connection = conn
 }
 
+// The protocol version negotiated with the peer.
+func (sm *StreamManager) Version() int16 {
+	return sm.connection.Version
+}
+
+// Where the connection to the peer goes, empty if there is none.
+func (sm *StreamManager) RemoteAddr() string {
+	if sm.connection.Client.conn == nil {
+		return ""
+	}
+
+	return sm.connection.Client.conn.RemoteAddr().String()
+}
+
 func (sm *StreamManager) Setup() {
 	sm.server = nil
 	sm.client = nil
@@ -55,13 +68,11 @@ func (sm *StreamManager) OpenSocks(addr string, lp ProtocolHandler, data common.
 		sm.torDialer = dialer
 	}
 
-	conn, err := sm.torDialer.Dial("tcp", addr)
-
-	if err != nil {
-		return nil, err
+	dial := func() (net.Conn, error) {
+		return sm.torDialer.Dial("tcp", addr)
 	}
 
-	return sm.handleConnection(conn, lp, data)
+	return sm.handleConnection(dial, lp, data)
 }
 
 func (sm *StreamManager) OpenTCP(addr string, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
@@ -73,31 +84,46 @@ func (sm *StreamManager) OpenTCP(addr string, lp ProtocolHandler, data common.En
 		return &sm.connection, nil
 	}
 
-	conn, err := net.Dial("tcp", addr)
-
-	if err != nil {
-		return nil, err
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
 	}
 
-	return sm.handleConnection(conn, lp, data)
+	return sm.handleConnection(dial, lp, data)
 }
 
-func (sm *StreamManager) handleConnection(conn net.Conn, lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
-	log.WithField("dfi", ProtoDFI).Info("Sending")
-	err := binary.Write(conn, binary.LittleEndian, ProtoDFI)
+// Dials, negotiates a version and handshakes. dial may be called twice, as
+// peers from before negotiation need a new connection speaking the legacy
+// version.
+func (sm *StreamManager) handleConnection(dial func() (net.Conn, error), lp ProtocolHandler, data common.Encoder) (*ConnHeader, error) {
+	conn, err := dial()
 
 	if err != nil {
 		return nil, err
 	}
 
-	log.WithField("version", ProtoVersion).Info("Sending")
-	err = binary.Write(conn, binary.LittleEndian, ProtoVersion)
+	version, err := OfferVersion(conn, ProtoVersion)
+
+	if err == ErrNoNegotiation && ProtoMinVersion <= ProtoVersionLegacy {
+		log.Info("Peer did not negotiate, retrying with the legacy version")
+		conn.Close()
+
+		conn, err = dial()
+
+		if err != nil {
+			return nil, err
+		}
+
+		version, err = OfferVersion(conn, ProtoVersionLegacy)
+	}
 
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	header, caps, err := sm.Handshake(conn, lp, data)
+	log.WithField("version", version).Info("Negotiated protocol version")
+
+	header, caps, sent, recieved, err := sm.Handshake(conn, lp, data)
 
 	if err != nil {
 		return nil, err
@@ -107,51 +133,61 @@ func (sm *StreamManager) handleConnection(conn net.Conn, lp ProtocolHandler, dat
 		return nil, errors.New("Failed to handshake, nil entry")
 	}
 
-	c, err := NewClient(conn)
+	// everything after the handshake, yamux included, goes over this
+	secure, err := Secure(conn, true, lp, lp.GetCapabilities(), caps, header, sent, recieved)
 
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	pair := ConnHeader{*c, *header, *caps}
+	c, err := NewClient(secure)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pair := ConnHeader{*c, *header, *caps, version}
 	sm.connection = pair
 
 	return &pair, nil
 }
 
-func (sm *StreamManager) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encoder) (*dht.Entry, *MessageCapabilities, error) {
+func (sm *StreamManager) Handshake(conn net.Conn, lp ProtocolHandler, data common.Encoder) (*dht.Entry, *MessageCapabilities, Transcript, Transcript, error) {
+	var sent, recieved Transcript
+
 	cl, err := NewClient(conn)
 
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, sent, recieved, err
 	}
 
 	log.Debug("Sending handshake")
-	err = handshake_send(*cl, lp, data)
+	sent, err = handshake_send(*cl, lp, data)
 
 	msg, err := cl.ReadMessage()
 
 	if err != nil {
-		return nil, nil, nil
+		return nil, nil, sent, recieved, nil
 	}
 
 	if !msg.Ok() {
-		return nil, nil, errors.New(string(msg.Content))
+		return nil, nil, sent, recieved, errors.New(string(msg.Content))
 	}
 
 	// server now knows that we are definitely who we say we are.
 	// but...
 	// is the server who we think it is?
 	// better check!
-	server_header, caps, err := handshake_recieve(*cl)
+	server_header, caps, recieved, err := handshake_recieve(*cl)
 
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, sent, recieved, err
 	}
 
 	log.Info("Handshake complete")
 
-	return server_header, caps, nil
+	return server_header, caps, sent, recieved, nil
 }
 
 func (sm *StreamManager) ConnectClient() (*yamux.Session, error) {
@@ -235,7 +271,8 @@ func (sm *StreamManager) OpenStream() (*Client, error) {
 		return nil, err
 	}
 
-	err = ret.conn.SetDeadline(time.Now().Add(time.Second * 10))
+	// requests set their own, see Client.Call
+	err = ret.conn.SetDeadline(time.Now().Add(DefaultTimeout))
 
 	if err != nil {
 		return nil, err
@@ -0,0 +1,146 @@
+// Protocol version negotiation, done before the handshake.
+
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// How long either side waits for the other while negotiating.
+const VersionTimeout = time.Second * 10
+
+// Returned by OfferVersion when the peer did not reply, it predates
+// negotiation and only speaks ProtoVersionLegacy.
+var ErrNoNegotiation = errors.New("Peer did not negotiate a protocol version")
+
+// The highest version both peers speak, given the highest the peer speaks.
+// Lower than ProtoMinVersion if there is none.
+func ChooseVersion(theirs int16) int16 {
+	if theirs < ProtoVersion {
+		return theirs
+	}
+
+	return ProtoVersion
+}
+
+// Sends the dfi header followed by version, the highest version we want to
+// speak, and reads which version the peer chose. Peers do not reply to
+// ProtoVersionLegacy, it is only sent to peers that returned ErrNoNegotiation.
+func OfferVersion(conn net.Conn, version int16) (int16, error) {
+	err := binary.Write(conn, binary.LittleEndian, ProtoDFI)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = binary.Write(conn, binary.LittleEndian, version)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if version == ProtoVersionLegacy {
+		return version, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(VersionTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	cl, err := NewClient(conn)
+
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.ReadMessage()
+
+	if ne, ok := err.(net.Error); err == io.EOF || (ok && ne.Timeout()) {
+		return 0, ErrNoNegotiation
+	} else if err != nil {
+		return 0, err
+	}
+
+	if !msg.Ok() {
+		var reason string
+		msg.Read(&reason)
+
+		return 0, errors.New("Peer rejected protocol version: " + reason)
+	}
+
+	chosen, err := msg.ReadInt()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if chosen < int(ProtoMinVersion) || chosen > int(version) {
+		return 0, fmt.Errorf("Peer chose unsupported protocol version %d", chosen)
+	}
+
+	return int16(chosen), nil
+}
+
+// Reads the dfi header and the highest version the peer speaks, then replies
+// with the version chosen or why there is none. Connections that are not dfi at
+// all get no reply.
+func AcceptVersion(conn net.Conn) (int16, error) {
+	conn.SetDeadline(time.Now().Add(VersionTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var dfi, theirs int16
+
+	err := binary.Read(conn, binary.LittleEndian, &dfi)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if dfi != ProtoDFI {
+		return 0, fmt.Errorf("This is not a DFI connection: %d", dfi)
+	}
+
+	err = binary.Read(conn, binary.LittleEndian, &theirs)
+
+	if err != nil {
+		return 0, err
+	}
+
+	version := ChooseVersion(theirs)
+
+	// legacy peers go straight to the handshake, they would not read a reply
+	if theirs == ProtoVersionLegacy {
+		if version < ProtoMinVersion {
+			return 0, errors.New("Legacy protocol version is no longer supported")
+		}
+
+		return version, nil
+	}
+
+	cl, err := NewClient(conn)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if version < ProtoMinVersion {
+		err = fmt.Errorf("Protocol version %d is not supported, need at least %d",
+			theirs, ProtoMinVersion)
+		cl.WriteErr(err)
+
+		return 0, err
+	}
+
+	msg := Message{Header: ProtoOk}
+	err = msg.Write(version)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return version, cl.WriteMessage(msg)
+}
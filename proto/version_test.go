@@ -0,0 +1,82 @@
+package proto
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// Offers version over a pipe, returning what each side settled on.
+func negotiate(version int16) (int16, int16, error, error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	var accepted int16
+	var acceptErr error
+	done := make(chan bool)
+
+	go func() {
+		accepted, acceptErr = AcceptVersion(b)
+		done <- true
+	}()
+
+	offered, offerErr := OfferVersion(a, version)
+	<-done
+
+	return offered, accepted, offerErr, acceptErr
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	offered, accepted, errA, errB := negotiate(ProtoVersion + 5)
+
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+
+	if offered != ProtoVersion || accepted != ProtoVersion {
+		t.Fatalf("Negotiated %d and %d", offered, accepted)
+	}
+
+	offered, accepted, errA, errB = negotiate(ProtoVersionLegacy)
+
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+
+	if offered != ProtoVersionLegacy || accepted != ProtoVersionLegacy {
+		t.Fatalf("Negotiated %d and %d with a legacy peer", offered, accepted)
+	}
+}
+
+func TestRejectVersion(t *testing.T) {
+	defer func(min int16) { ProtoMinVersion = min }(ProtoMinVersion)
+	ProtoMinVersion = ProtoVersion + 1
+
+	_, _, errA, errB := negotiate(ProtoVersion)
+
+	if errA == nil || errB == nil {
+		t.Fatal("Old version was not rejected")
+	}
+
+	if errA == ErrNoNegotiation {
+		t.Fatal("Rejection was not explained")
+	}
+}
+
+func TestNoNegotiation(t *testing.T) {
+	a, b := net.Pipe()
+
+	// a peer from before negotiation reads the header, and never replies
+	go func() {
+		var header [2]int16
+		binary.Read(b, binary.LittleEndian, &header)
+		b.Close()
+	}()
+
+	_, err := OfferVersion(a, ProtoVersion)
+
+	if err != ErrNoNegotiation {
+		t.Fatalf("Expected no negotiation, got: %v", err)
+	}
+}
@@ -0,0 +1,429 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+// Keeps track of how well peers behave. Peers lose reputation for sending us
+// bad data and gain it slowly by staying connected and responsive, those that
+// fall too far are banned. Bans can also be made by hand, and are kept across
+// restarts.
+
+package dfi
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dfindex/dfi/dht"
+)
+
+// Something a peer did that affects its reputation.
+type ReputationEvent int
+
+const (
+	// sent a piece that does not match the collection hash list
+	EventBadPiece ReputationEvent = iota
+	// sent an entry that failed dht.Entry.Verify
+	EventBadEntry
+	// sent a message we could not decode or do not understand
+	EventBadMessage
+	// made more requests than proto.RateLimits allow
+	EventOverLimit
+	// answered a heartbeat in good time
+	EventHeartbeat
+	// answered a heartbeat, but slower than SlowLatency
+	EventSlowHeartbeat
+)
+
+// How much each event changes a peer's score by.
+var ReputationScores = map[ReputationEvent]int{
+	EventBadPiece:      -25,
+	EventBadEntry:      -10,
+	EventBadMessage:    -5,
+	EventOverLimit:     -1,
+	EventHeartbeat:     1,
+	EventSlowHeartbeat: -1,
+}
+
+const (
+	// Peers start at zero, and can never build up more than this.
+	MaxReputation = 100
+
+	// Peers whose score falls to this are banned for AutoBanDuration.
+	BanReputation = -100
+
+	AutoBanDuration = time.Hour * 24
+
+	// Heartbeats slower than this count against a peer.
+	SlowLatency = time.Second * 2
+)
+
+var (
+	PeerBanned     = errors.New("Peer is banned")
+	ErrBanNoTarget = errors.New("A ban needs an address or a public address")
+)
+
+// How a single peer has behaved since we started.
+type Reputation struct {
+	Address string `json:"address"`
+	Score   int    `json:"score"`
+
+	// milliseconds, a moving average over heartbeats
+	Latency int64 `json:"latency"`
+	// seconds spent connected
+	Uptime int64 `json:"uptime"`
+
+	BadPieces   int `json:"badPieces"`
+	BadEntries  int `json:"badEntries"`
+	BadMessages int `json:"badMessages"`
+
+	// zero while disconnected
+	connected time.Time
+}
+
+// A peer we refuse to talk to. Either the DFI address or the public address may
+// be empty, but not both.
+type Ban struct {
+	Address       string `json:"address,omitempty"`
+	PublicAddress string `json:"public,omitempty"`
+	Reason        string `json:"reason"`
+	Created       int64  `json:"created"`
+
+	// unix time the ban ends, zero for never
+	Until int64 `json:"until"`
+}
+
+func (b *Ban) Expired() bool {
+	return b.Until != 0 && b.Until <= time.Now().Unix()
+}
+
+type ReputationManager struct {
+	mutex sync.Mutex
+	path  string
+
+	// by encoded DFI address
+	reputations map[string]*Reputation
+
+	// the same ban may be in both if it has both addresses
+	byAddress map[string]*Ban
+	byPublic  map[string]*Ban
+}
+
+// Bans are saved to and loaded from path.
+func NewReputationManager(path string) *ReputationManager {
+	ret := &ReputationManager{path: path}
+
+	ret.reputations = make(map[string]*Reputation)
+	ret.byAddress = make(map[string]*Ban)
+	ret.byPublic = make(map[string]*Ban)
+
+	return ret
+}
+
+// Loads the ban list, it not existing yet is not an error.
+func (rm *ReputationManager) Load() error {
+	file, err := ioutil.ReadFile(rm.path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var bans []*Ban
+	err = json.Unmarshal(file, &bans)
+
+	if err != nil {
+		return err
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	for _, i := range bans {
+		if !i.Expired() {
+			rm.add(i)
+		}
+	}
+
+	return nil
+}
+
+// Must hold the mutex.
+func (rm *ReputationManager) save() error {
+	data, err := json.MarshalIndent(rm.bans(), "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(rm.path, data, 0644)
+}
+
+// Must hold the mutex.
+func (rm *ReputationManager) add(ban *Ban) {
+	if ban.Address != "" {
+		rm.byAddress[ban.Address] = ban
+	}
+
+	if ban.PublicAddress != "" {
+		rm.byPublic[ban.PublicAddress] = ban
+	}
+}
+
+// Must hold the mutex.
+func (rm *ReputationManager) remove(ban *Ban) {
+	delete(rm.byAddress, ban.Address)
+	delete(rm.byPublic, ban.PublicAddress)
+}
+
+// Every ban in force, oldest first. Must hold the mutex.
+func (rm *ReputationManager) bans() []*Ban {
+	seen := make(map[*Ban]bool)
+	ret := make([]*Ban, 0, len(rm.byAddress)+len(rm.byPublic))
+
+	for _, bans := range []map[string]*Ban{rm.byAddress, rm.byPublic} {
+		for _, i := range bans {
+			if !seen[i] && !i.Expired() {
+				seen[i] = true
+				ret = append(ret, i)
+			}
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Created < ret[j].Created })
+
+	return ret
+}
+
+func (rm *ReputationManager) Bans() []Ban {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	ret := make([]Ban, 0, len(rm.byAddress))
+
+	for _, i := range rm.bans() {
+		ret = append(ret, *i)
+	}
+
+	return ret
+}
+
+// Adds a ban, replacing any for the same addresses, and saves the list. As with
+// Unban the peer's score goes back to zero, otherwise once the ban expires its
+// score would already be past BanReputation and it could never be banned again.
+func (rm *ReputationManager) Ban(ban Ban) error {
+	if ban.Address == "" && ban.PublicAddress == "" {
+		return ErrBanNoTarget
+	}
+
+	if ban.Address != "" {
+		if _, err := dht.DecodeAddress(ban.Address); err != nil {
+			return err
+		}
+	}
+
+	ban.PublicAddress = publicHost(ban.PublicAddress)
+
+	if ban.Created == 0 {
+		ban.Created = time.Now().Unix()
+	}
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	for _, old := range []*Ban{rm.byAddress[ban.Address], rm.byPublic[ban.PublicAddress]} {
+		if old != nil {
+			rm.remove(old)
+		}
+	}
+
+	rm.add(&ban)
+
+	if r, ok := rm.reputations[ban.Address]; ok {
+		r.Score = 0
+	}
+
+	return rm.save()
+}
+
+// Lifts any bans on either address, and saves the list. The peer starts over
+// with a score of zero, otherwise it would be banned again on its next mistake.
+func (rm *ReputationManager) Unban(address, public string) error {
+	public = publicHost(public)
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	for _, i := range rm.bans() {
+		if (address != "" && i.Address == address) || (public != "" && i.PublicAddress == public) {
+			rm.remove(i)
+		}
+	}
+
+	if r, ok := rm.reputations[address]; ok {
+		r.Score = 0
+	}
+
+	return rm.save()
+}
+
+// Whether either address is banned. address may be nil, and public empty.
+func (rm *ReputationManager) Banned(address *dht.Address, public string) bool {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if address != nil {
+		if ban, ok := rm.byAddress[address.StringOr("")]; ok && !ban.Expired() {
+			return true
+		}
+	}
+
+	if public != "" {
+		if ban, ok := rm.byPublic[publicHost(public)]; ok && !ban.Expired() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Must hold the mutex.
+func (rm *ReputationManager) get(addr dht.Address) *Reputation {
+	key := addr.StringOr("")
+	r, ok := rm.reputations[key]
+
+	if !ok {
+		r = &Reputation{Address: key}
+		rm.reputations[key] = r
+	}
+
+	return r
+}
+
+// Changes the score of the peer by the amount for event. Returns true if this
+// took it to BanReputation, at which point it should be banned.
+func (rm *ReputationManager) Record(addr dht.Address, event ReputationEvent) bool {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	r := rm.get(addr)
+
+	switch event {
+	case EventBadPiece:
+		r.BadPieces++
+	case EventBadEntry:
+		r.BadEntries++
+	case EventBadMessage, EventOverLimit:
+		r.BadMessages++
+	}
+
+	before := r.Score
+	r.Score += ReputationScores[event]
+
+	if r.Score > MaxReputation {
+		r.Score = MaxReputation
+	}
+
+	return before > BanReputation && r.Score <= BanReputation
+}
+
+// Records a heartbeat that took latency to be answered, see Record.
+func (rm *ReputationManager) RecordHeartbeat(addr dht.Address, latency time.Duration) bool {
+	rm.mutex.Lock()
+	r := rm.get(addr)
+
+	if r.Latency == 0 {
+		r.Latency = int64(latency / time.Millisecond)
+	} else {
+		r.Latency = (r.Latency*3 + int64(latency/time.Millisecond)) / 4
+	}
+
+	rm.mutex.Unlock()
+
+	if latency > SlowLatency {
+		return rm.Record(addr, EventSlowHeartbeat)
+	}
+
+	return rm.Record(addr, EventHeartbeat)
+}
+
+func (rm *ReputationManager) Connected(addr dht.Address) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	rm.get(addr).connected = time.Now()
+}
+
+func (rm *ReputationManager) Disconnected(addr dht.Address) {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	r := rm.get(addr)
+
+	if !r.connected.IsZero() {
+		r.Uptime += int64(time.Since(r.connected) / time.Second)
+		r.connected = time.Time{}
+	}
+}
+
+// The reputation of every peer we have had dealings with, best first.
+func (rm *ReputationManager) Reputations() []Reputation {
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	ret := make([]Reputation, 0, len(rm.reputations))
+
+	for _, i := range rm.reputations {
+		r := *i
+
+		if !r.connected.IsZero() {
+			r.Uptime += int64(time.Since(r.connected) / time.Second)
+		}
+
+		ret = append(ret, r)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Score > ret[j].Score })
+
+	return ret
+}
+
+// Strips any port from a public address, bans cover every port on a host.
+func publicHost(public string) string {
+	host, _, err := net.SplitHostPort(public)
+
+	if err != nil {
+		return public
+	}
+
+	return host
+}
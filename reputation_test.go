@@ -0,0 +1,215 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/dfindex/dfi/dht"
+)
+
+func testAddress(t *testing.T) dht.Address {
+	public, _, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var addr dht.Address
+	addr.Generate(public)
+
+	return addr
+}
+
+func TestReputationAutoBan(t *testing.T) {
+	rm := NewReputationManager("")
+	addr := testAddress(t)
+
+	for i := 0; i < MaxReputation; i++ {
+		rm.RecordHeartbeat(addr, time.Millisecond)
+	}
+
+	if r := rm.Reputations()[0]; r.Score != MaxReputation {
+		t.Fatalf("Score is %d, expected it capped at %d", r.Score, MaxReputation)
+	}
+
+	banned := 0
+
+	for i := 0; i < 20; i++ {
+		if rm.Record(addr, EventBadPiece) {
+			banned++
+		}
+	}
+
+	// only once, as it crosses the line
+	if banned != 1 {
+		t.Fatalf("Asked to ban %d times, expected once", banned)
+	}
+
+	if r := rm.Reputations()[0]; r.BadPieces != 20 || r.Score > BanReputation {
+		t.Fatalf("Score is %d after %d bad pieces", r.Score, r.BadPieces)
+	}
+}
+
+func TestBanList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfi")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bans.json")
+	addr := testAddress(t)
+	other := testAddress(t)
+
+	rm := NewReputationManager(path)
+
+	if err := rm.Load(); err != nil {
+		t.Fatal("A missing ban list failed to load: ", err)
+	}
+
+	if rm.Ban(Ban{Reason: "nothing"}) != ErrBanNoTarget {
+		t.Fatal("Banned nothing")
+	}
+
+	if err := rm.Ban(Ban{Address: addr.StringOr(""), Reason: "bad pieces"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rm.Ban(Ban{PublicAddress: "10.0.0.1:5050"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := Ban{Address: other.StringOr(""), Until: time.Now().Add(-time.Minute).Unix()}
+
+	if err := rm.Ban(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewReputationManager(path)
+
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded.Bans()) != 2 {
+		t.Fatalf("Loaded %d bans, expected 2", len(loaded.Bans()))
+	}
+
+	if !loaded.Banned(&addr, "") {
+		t.Fatal("Address ban was not kept")
+	}
+
+	// on any port
+	if !loaded.Banned(&other, "10.0.0.1:4242") {
+		t.Fatal("Public address ban was not kept")
+	}
+
+	if loaded.Banned(&other, "10.0.0.2") {
+		t.Fatal("Expired ban is still in force")
+	}
+
+	if err := loaded.Unban(addr.StringOr(""), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Banned(&addr, "") || !loaded.Banned(nil, "10.0.0.1") {
+		t.Fatal("Unbanned the wrong peer")
+	}
+}
+
+// Auto bans cover the host as well, otherwise a new address gets straight back
+// in.
+func TestAutoBanHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfi")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	pm := NewPeerManager(&LocalPeer{DataDir: dir})
+	addr := testAddress(t)
+
+	p := &Peer{address: addr, dialed: "10.0.0.5:5050"}
+	pm.peers.Set(string(addr.Raw), p)
+
+	for i := 0; i < 10 && pm.GetPeer(addr) != nil; i++ {
+		pm.Report(addr, EventBadPiece)
+	}
+
+	if !pm.Banned(&addr, "") {
+		t.Fatal("Address was not banned")
+	}
+
+	other := testAddress(t)
+
+	if !pm.Banned(&other, "10.0.0.5:4242") {
+		t.Fatal("Host was not banned")
+	}
+}
+
+// The score starts over with each ban, so a peer that misbehaves again once its
+// ban has expired is banned again.
+func TestAutoBanAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfi")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	pm := NewPeerManager(&LocalPeer{DataDir: dir})
+	addr := testAddress(t)
+
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 10 && !pm.Banned(&addr, ""); j++ {
+			pm.Report(addr, EventBadPiece)
+		}
+
+		if !pm.Banned(&addr, "") {
+			t.Fatalf("Address was not banned, time %d", i+1)
+		}
+
+		pm.reputation.mutex.Lock()
+		pm.reputation.byAddress[addr.StringOr("")].Until = time.Now().Unix() - 1
+		pm.reputation.mutex.Unlock()
+
+		if pm.Banned(&addr, "") {
+			t.Fatal("Ban did not expire")
+		}
+	}
+}
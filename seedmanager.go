@@ -26,11 +26,10 @@
 package dfi
 
 import (
-	"bytes"
+	"context"
 	"time"
 
 	"github.com/dfindex/dfi/dht"
-	"github.com/dfindex/dfi/util"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -91,10 +90,11 @@ func (sm *SeedManager) findSeeds() {
 		}
 
 		sm.entry = entry
+		sm.renew()
 
 		log.Info("Searching for new seeds")
-		for _, i := range sm.entry.Seeds {
-			addr := dht.Address{Raw: i}
+		for _, i := range sm.entry.VerifiedSeeds() {
+			addr := i.Seed
 
 			if addr.Equals(sm.lp.Address()) {
 				continue
@@ -121,55 +121,40 @@ func (sm *SeedManager) findSeeds() {
 
 			log.WithField("peer", es).Info("Querying for seeds")
 
-			qResultVerifiable, err := peer.Query(sm.entry.Address)
+			qResultVerifiable, err := peer.Query(context.Background(), sm.entry.Address)
 			if err != nil {
 				continue
 			}
 
 			qResult := qResultVerifiable.(*dht.Entry)
 
-			result := util.SliceDiff(sm.entry.Seeds, qResult.Seeds)
-
-			// make sure all these seeds actually link back! Otherwise they could
-			// be fakes
-			for n, i := range result {
-				seedAddress := dht.Address{Raw: i}
-
-				entry, err := sm.lp.Resolve(seedAddress)
+			known := make(map[string]bool)
+			for _, j := range sm.entry.Seeds {
+				known[string(j.Seed.Raw)] = true
+			}
 
-				// nope, we won't be adding this one
-				if err != nil {
-					if n >= len(result)-1 {
-						result = result[:n]
-					} else {
-						result = append(result[:n], result[n+1:]...)
-					}
-					result = append(result[:n], result[n+1:]...)
+			// the attestations are signed by the seeds themselves, so only
+			// need checking that we can find the seed at all
+			result := make([]dht.Attestation, 0)
+			for _, j := range qResult.VerifiedSeeds() {
+				if !j.For.Equals(&sm.track) {
 					continue
 				}
 
-				// check if the entry has registered itself as a seeder
+				if !known[string(j.Seed.Raw)] {
+					_, err := sm.lp.Resolve(j.Seed)
 
-				found := false
-				for _, j := range entry.Seeding {
-					if bytes.Equal(sm.track.Raw, j) {
-						found = true
-						break
+					// nope, we won't be adding this one
+					if err != nil {
+						continue
 					}
 				}
 
-				if !found {
-					if n >= len(result)-1 {
-						result = result[:n]
-					} else {
-						result = append(result[:n], result[n+1:]...)
-					}
-					continue
-				}
+				result = append(result, j)
 			}
 
 			if len(result) > 0 {
-				sm.entry.Seeds = append(sm.entry.Seeds, result...)
+				sm.entry.Seeds = dht.MergeSeeds(sm.entry.VerifiedSeeds(), result)
 
 				log.WithField("peer", s).Info("Found new seeds")
 				sm.lp.DHT.Insert(*sm.entry)
@@ -189,3 +174,29 @@ func (sm *SeedManager) findSeeds() {
 		}
 	}
 }
+
+// Keeps our own attestation for an entry we seed fresh, it is renewed once it
+// is half way to expiring. Other peers pick it up when they next query us.
+func (sm *SeedManager) renew() {
+	if sm.track.Equals(sm.lp.Address()) {
+		return
+	}
+
+	renewAt := uint64(time.Now().Add(-dht.AttestationTTL / 2).Unix())
+
+	for _, i := range sm.entry.Seeds {
+		if i.Seed.Equals(sm.lp.Address()) && i.Updated > renewAt {
+			return
+		}
+	}
+
+	log.WithField("peer", sm.track.StringOr("")).Info("Renewing seed attestation")
+
+	sm.entry.Seeds = dht.MergeSeeds(sm.entry.Seeds, []dht.Attestation{sm.lp.Attest(*sm.entry)})
+
+	_, err := sm.lp.DHT.Insert(*sm.entry)
+
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
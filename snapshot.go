@@ -0,0 +1,320 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
+)
+
+// A snapshot is a gzipped tar archive of an index that can be carried around
+// offline. It holds, in this order, the origin's signed entry, the hash list of
+// its collection, and every post (including tombstones) as JSONL. Nothing in it
+// needs to be trusted: the entry is signed, its collection hash is the Merkle
+// root of the hash list, and every piece is checked against the hash list
+// before it is stored.
+const (
+	// Used with /self/export/ alongside the formats in data
+	SnapshotFormat = "snapshot"
+
+	SnapshotEntryFile      = "entry.json"
+	SnapshotCollectionFile = "collection.dat"
+	SnapshotPostsFile      = "posts.jsonl"
+
+	// Limits on what is read from a snapshot, other than posts.
+	MaxSnapshotEntrySize      = 1 << 20
+	MaxSnapshotCollectionSize = 64 << 20
+)
+
+// Writes a snapshot of db, which must match the collection hash in the entry.
+func WriteSnapshot(w io.Writer, entry *dht.Entry, db data.PostStore) error {
+	col, err := data.CreateCollection(db, 0, data.PieceSize)
+
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(col.Hash(), entry.CollectionHash) {
+		return errors.New("Index does not match the entry's collection hash")
+	}
+
+	encoded, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	// tar needs to know the size up front, so posts go to a temporary file
+	posts, err := ioutil.TempFile("", "dfi-snapshot")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(posts.Name())
+	defer posts.Close()
+
+	buffered := bufio.NewWriter(posts)
+
+	err = data.EachPost(db, func(p *data.Post) error {
+		return data.WriteJSONL(p, buffered)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+
+	size, err := posts.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = posts.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	files := []struct {
+		name string
+		size int64
+		data io.Reader
+	}{
+		{SnapshotEntryFile, int64(len(encoded)), bytes.NewReader(encoded)},
+		{SnapshotCollectionFile, int64(len(col.HashList)), bytes.NewReader(col.HashList)},
+		{SnapshotPostsFile, size, posts},
+	}
+
+	for _, i := range files {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    i.name,
+			Mode:    0644,
+			Size:    i.size,
+			ModTime: time.Now(),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(tw, i.data); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// Reads and verifies a snapshot. Once the entry and hash list have been
+// checked, open is called to get the store the posts should go in. Each piece
+// replaces the one in the store as soon as it has been verified, so if this
+// fails part way the store should be treated like an interrupted mirror.
+func ReadSnapshot(r io.Reader, open func(*dht.Entry) (data.PostStore, error)) (*dht.Entry, *data.Collection, error) {
+	gz, err := gzip.NewReader(r)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tr := tar.NewReader(gz)
+
+	encoded, err := readSnapshotFile(tr, SnapshotEntryFile, MaxSnapshotEntrySize)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry, err := dht.DecodeEntry(encoded, true)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = entry.Verify(); err != nil {
+		return nil, nil, err
+	}
+
+	var owner dht.Address
+	owner.Generate(entry.PublicKey)
+
+	if !owner.Equals(&entry.Address) {
+		return nil, nil, errors.New("Entry address does not match its public key")
+	}
+
+	hashList, err := readSnapshotFile(tr, SnapshotCollectionFile, MaxSnapshotCollectionSize)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(hashList)%data.HashSize != 0 {
+		return nil, nil, errors.New("Invalid collection data file")
+	}
+
+	col := &data.Collection{HashList: hashList}
+	col.Rehash()
+
+	if !bytes.Equal(col.Hash(), entry.CollectionHash) {
+		return nil, nil, errors.New("Hash list does not match the entry's collection hash")
+	}
+
+	db, err := open(entry)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, err := tr.Next()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if header.Name != SnapshotPostsFile {
+		return nil, nil, errors.New("Expected " + SnapshotPostsFile + " in snapshot")
+	}
+
+	err = readSnapshotPosts(tr, col, db)
+
+	return entry, col, err
+}
+
+func readSnapshotFile(tr *tar.Reader, name string, max int64) ([]byte, error) {
+	header, err := tr.Next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Name != name {
+		return nil, errors.New("Expected " + name + " in snapshot")
+	}
+
+	if header.Size > max {
+		return nil, errors.New(name + " in snapshot is too large")
+	}
+
+	return ioutil.ReadAll(tr)
+}
+
+// Groups posts into pieces, verifying and storing each in turn. Pieces with no
+// posts must hash to an empty piece, and anything the store has past the end of
+// the collection is cleared.
+func readSnapshotPosts(r io.Reader, col *data.Collection, db data.PostStore) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), data.MaxPostSize*4)
+
+	next := 0
+	var piece *data.Piece
+
+	store := func(upTo int) error {
+		for next < upTo {
+			if piece == nil || int(piece.Id) != next {
+				piece = &data.Piece{Id: uint(next)}
+				piece.Setup()
+			}
+
+			hash := col.HashList[next*data.HashSize : next*data.HashSize+data.HashSize]
+
+			if !bytes.Equal(piece.Hash(), hash) {
+				return errors.New("Piece does not match the hash list")
+			}
+
+			if err := db.ReplacePiece(piece); err != nil {
+				return err
+			}
+
+			next++
+		}
+
+		return nil
+	}
+
+	for scanner.Scan() {
+		var post data.Post
+
+		if err := json.Unmarshal(scanner.Bytes(), &post); err != nil {
+			return err
+		}
+
+		index := (post.Id - 1) / data.PieceSize
+
+		if post.Id < 1 || index < next || index >= col.Size() {
+			return errors.New("Post is outside of the collection")
+		}
+
+		if err := store(index); err != nil {
+			return err
+		}
+
+		if piece == nil || int(piece.Id) != index {
+			piece = &data.Piece{Id: uint(index)}
+			piece.Setup()
+		}
+
+		piece.Add(post, true)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if err := store(col.Size()); err != nil {
+		return err
+	}
+
+	for ; next*data.PieceSize < int(db.PostCount()); next++ {
+		empty := &data.Piece{Id: uint(next)}
+		empty.Setup()
+
+		if err := db.ReplacePiece(empty); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
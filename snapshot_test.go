@@ -0,0 +1,211 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package dfi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/streamrail/concurrent-map"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/dfindex/dfi/data"
+	"github.com/dfindex/dfi/dht"
+)
+
+// An index of n posts, with an entry signing its collection hash.
+func testIndex(t *testing.T, n int) (data.PostStore, *dht.Entry, ed25519.PrivateKey) {
+	db := data.NewMemoryStore()
+
+	for i := 1; i <= n; i++ {
+		db.InsertPost(data.Post{InfoHash: string(rune(i)), Title: "post", Size: i})
+	}
+
+	col, err := data.CreateCollection(db, 0, data.PieceSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, private, err := ed25519.GenerateKey(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := &dht.Entry{
+		PublicKey:      public,
+		PublicAddress:  "example.com",
+		CollectionHash: col.Hash(),
+	}
+
+	entry.Address.Generate(public)
+	signEntry(entry, private)
+
+	return db, entry, private
+}
+
+func signEntry(entry *dht.Entry, key ed25519.PrivateKey) {
+	dat, _ := entry.Bytes()
+	entry.Signature = ed25519.Sign(key, dat)
+}
+
+func TestSnapshot(t *testing.T) {
+	db, entry, _ := testIndex(t, data.PieceSize+10)
+
+	buf := bytes.Buffer{}
+
+	if err := WriteSnapshot(&buf, entry, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// anything left over in the store past the snapshot is cleared
+	mirror := data.NewMemoryStore()
+	for i := 0; i < data.PieceSize*3; i++ {
+		mirror.InsertPost(data.Post{InfoHash: "old" + string(rune(i)), Title: "old"})
+	}
+
+	read, col, err := ReadSnapshot(&buf, func(*dht.Entry) (data.PostStore, error) {
+		return mirror, nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !read.Address.Equals(&entry.Address) || !bytes.Equal(col.Hash(), entry.CollectionHash) {
+		t.Fatal("Snapshot entry does not match")
+	}
+
+	copied, err := data.CreateCollection(mirror, 0, data.PieceSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(copied.Hash(), entry.CollectionHash) {
+		t.Fatal("Imported index does not match the collection hash")
+	}
+}
+
+func TestSnapshotTampered(t *testing.T) {
+	db, entry, key := testIndex(t, 10)
+
+	open := func(*dht.Entry) (data.PostStore, error) {
+		return data.NewMemoryStore(), nil
+	}
+
+	// a post changed after the entry was signed
+	db.AddMeta(1, "changed")
+	buf := bytes.Buffer{}
+
+	if err := WriteSnapshot(&buf, entry, db); err == nil {
+		t.Fatal("Wrote a snapshot that does not match its entry")
+	}
+
+	// re-signed by someone else
+	db.AddMeta(1, "")
+	_, other, _ := ed25519.GenerateKey(nil)
+	signEntry(entry, other)
+
+	if err := WriteSnapshot(&buf, entry, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ReadSnapshot(&buf, open); err == nil {
+		t.Fatal("Accepted a snapshot with a forged entry")
+	}
+
+	signEntry(entry, key)
+	buf.Reset()
+
+	if err := WriteSnapshot(&buf, entry, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ReadSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), open); err == nil {
+		t.Fatal("Accepted a truncated snapshot")
+	}
+
+	// posts that do not match the hash list
+	col, err := data.CreateCollection(db, 0, data.PieceSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	posts := bytes.Buffer{}
+	data.EachPost(db, func(p *data.Post) error {
+		p.Title = "changed"
+		return data.WriteJSONL(p, &posts)
+	})
+
+	if readSnapshotPosts(&posts, col, data.NewMemoryStore()) == nil {
+		t.Fatal("Accepted posts that do not match the hash list")
+	}
+}
+
+// A snapshot that fails part way does not leave a half filled mirror behind.
+func TestImportSnapshotDiscarded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfi")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	lp := &LocalPeer{DataDir: dir, Databases: cmap.New(), Collections: cmap.New()}
+	lp.address = testAddress(t)
+	lp.DHT = dht.NewDHT(lp.address, filepath.Join(dir, "peers.db"), dht.DefaultEntryTTL)
+	defer lp.DHT.Close()
+
+	db, entry, _ := testIndex(t, data.PieceSize*2)
+	buf := bytes.Buffer{}
+
+	if err := WriteSnapshot(&buf, entry, db); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()*3/4])
+
+	if _, err := lp.ImportSnapshot(truncated); err == nil {
+		t.Fatal("Accepted a truncated snapshot")
+	}
+
+	address := entry.Address.StringOr("")
+
+	if lp.Databases.Has(address) {
+		t.Fatal("Mirror was left registered")
+	}
+
+	if _, err := os.Stat(lp.DataPath(address)); !os.IsNotExist(err) {
+		t.Fatal("Mirror was left on disk")
+	}
+}
@@ -24,12 +24,16 @@
 // For more information, please refer to <http://unlicense.org/>
 package util
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type Limiter struct {
 	Throttle chan time.Time
 	Ticker   *time.Ticker
 	quit     chan bool
+	stop     sync.Once
 }
 
 // Return a new rate limiter. This is used to make sure that something like a
@@ -50,17 +54,22 @@ func NewLimiter(rate time.Duration, burst int, fill bool) *Limiter {
 	}
 
 	go func() {
-		for t := range tick.C {
+		for {
 			select {
 			case _ = <-quit:
+				// closed here, so nothing is sent to it after
+				close(throttle)
 				return
-			case throttle <- t:
-			default:
+			case t := <-tick.C:
+				select {
+				case throttle <- t:
+				default:
+				}
 			}
 		}
 	}()
 
-	return &Limiter{throttle, tick, quit}
+	return &Limiter{Throttle: throttle, Ticker: tick, quit: quit}
 }
 
 // Block until the given time has elapsed. Or just use a token from the bucket.
@@ -68,23 +77,83 @@ func (l *Limiter) Wait() {
 	_, _ = <-l.Throttle
 }
 
-// Finish running.
+// Use a token from the bucket if there is one, without blocking. Returns false
+// if there was none.
+func (l *Limiter) Allow() bool {
+	select {
+	case _ = <-l.Throttle:
+		return true
+	default:
+		return false
+	}
+}
+
+// True if the bucket holds as many tokens as it can.
+func (l *Limiter) Full() bool {
+	return len(l.Throttle) == cap(l.Throttle)
+}
+
+// Finish running. Anything blocked in Wait returns.
 func (l *Limiter) Stop() {
-	l.Ticker.Stop()
-	l.quit <- true
-	close(l.Throttle)
+	l.stop.Do(func() {
+		l.Ticker.Stop()
+		close(l.quit)
+	})
+}
+
+// The rate a token is added to a bucket, and how many it holds. See NewLimiter.
+type Limit struct {
+	Rate  time.Duration
+	Burst int
 }
 
-// Limits requests from peers
+// Limits requests from peers, each type of request has its own bucket.
 type PeerLimiter struct {
-	queryLimiter    *Limiter
-	announceLimiter *Limiter
+	limits   map[string]Limit
+	limiters map[string]*Limiter
+}
+
+// Creates a full bucket for each type of request in limits, types without a
+// limit are always allowed.
+func (pl *PeerLimiter) Setup(limits map[string]Limit) {
+	pl.limits = make(map[string]Limit, len(limits))
+	pl.limiters = make(map[string]*Limiter, len(limits))
+
+	for kind, limit := range limits {
+		pl.limits[kind] = limit
+		pl.limiters[kind] = NewLimiter(limit.Rate, limit.Burst, true)
+	}
 }
 
-func (pl *PeerLimiter) Setup() {
-	// Allow an announce every 10 minutes, bursting to allow three.
-	// The burst is there as people may make "mistakes" with titles or descriptions
-	pl.announceLimiter = NewLimiter(time.Minute*10, 3, true)
+// Use a token for a request of the given type. Returns false if the peer has
+// made too many, along with how long until it may make another.
+func (pl *PeerLimiter) Allow(kind string) (bool, time.Duration) {
+	if pl == nil {
+		return true, 0
+	}
 
-	pl.queryLimiter = NewLimiter(time.Second/3, 3, true)
+	limiter, ok := pl.limiters[kind]
+
+	if !ok || limiter.Allow() {
+		return true, 0
+	}
+
+	return false, pl.limits[kind].Rate
+}
+
+// True if every bucket is full, the same as a new PeerLimiter.
+func (pl *PeerLimiter) Full() bool {
+	for _, i := range pl.limiters {
+		if !i.Full() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (pl *PeerLimiter) Stop() {
+	for _, i := range pl.limiters {
+		i.Stop()
+	}
 }
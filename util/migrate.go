@@ -0,0 +1,206 @@
+// This is free and unencumbered software released into the public domain.
+//
+// Anyone is free to copy, modify, publish, use, compile, sell, or
+// distribute this software, either in source code form or as a compiled
+// binary, for any purpose, commercial or non-commercial, and by any
+// means.
+//
+// In jurisdictions that recognize copyright laws, the author or authors
+// of this software dedicate any and all copyright interest in the
+// software to the public domain. We make this dedication for the benefit
+// of the public at large and to the detriment of our heirs and
+// successors. We intend this dedication to be an overt act of
+// relinquishment in perpetuity of all present and future rights to this
+// software under copyright law.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+
+// For more information, please refer to <http://unlicense.org/>
+
+package util
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Every sqlite store records the version of its schema in a single row table.
+// Stores list their migrations in order, each one moves the schema up a
+// version. Databases created before versioning have no schema_version table,
+// and are treated as version 0, so the first migration must cope with tables
+// that already exist.
+
+const sqlCreateSchemaVersion = `CREATE TABLE IF NOT EXISTS
+									schema_version(
+										version INTEGER NOT NULL
+									)`
+
+const sqlHasSchemaVersion = `SELECT COUNT(*) FROM sqlite_master
+								WHERE type='table' AND name='schema_version'`
+
+const sqlQuerySchemaVersion = `SELECT IFNULL(MAX(version), 0) FROM schema_version`
+
+const sqlDeleteSchemaVersion = `DELETE FROM schema_version`
+
+const sqlInsertSchemaVersion = `INSERT INTO schema_version(version) VALUES(?)`
+
+var ErrSchemaTooNew = errors.New("Database schema is newer than this version of dfi supports")
+
+type Migration struct {
+	Version int
+	// What the migration does, for the logs
+	Name string
+	// Run within the same transaction as the version bump
+	Up func(tx *sql.Tx) error
+}
+
+// A migration that just runs some statements.
+func MigrateSQL(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, i := range stmts {
+			if _, err := tx.Exec(i); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// The version of the last migration.
+func LatestVersion(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+
+	return migrations[len(migrations)-1].Version
+}
+
+// The version a database is at, 0 if it has never been migrated.
+func SchemaVersion(conn *sql.DB) (int, error) {
+	var has, version int
+
+	err := conn.QueryRow(sqlHasSchemaVersion).Scan(&has)
+
+	if err != nil || has == 0 {
+		return 0, err
+	}
+
+	err = conn.QueryRow(sqlQuerySchemaVersion).Scan(&version)
+
+	return version, err
+}
+
+// Brings a database up to the latest version, one migration at a time. Fails
+// with ErrSchemaTooNew rather than touching a database from a newer version.
+func Migrate(conn *sql.DB, migrations []Migration) error {
+	for n, i := range migrations {
+		if i.Version != n+1 {
+			return fmt.Errorf("Migration %s is out of order", i.Name)
+		}
+	}
+
+	_, err := conn.Exec(sqlCreateSchemaVersion)
+
+	if err != nil {
+		return err
+	}
+
+	version, err := SchemaVersion(conn)
+
+	if err != nil {
+		return err
+	}
+
+	if version > LatestVersion(migrations) {
+		return ErrSchemaTooNew
+	}
+
+	for _, i := range migrations[version:] {
+		log.WithFields(log.Fields{
+			"version": i.Version,
+			"name":    i.Name,
+		}).Info("Migrating database")
+
+		err = migrate(conn, i)
+
+		if err != nil {
+			return fmt.Errorf("Migration %d (%s) failed: %s", i.Version, i.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func migrate(conn *sql.DB, m Migration) (err error) {
+	tx, err := conn.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	err = m.Up(tx)
+
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(sqlDeleteSchemaVersion)
+
+	if err != nil {
+		return
+	}
+
+	_, err = tx.Exec(sqlInsertSchemaVersion, m.Version)
+
+	return
+}
+
+// Checks that the database at path, if there is one, is not from a newer
+// version. Nothing is created or changed.
+func CheckSchema(path string, migrations []Migration) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", path))
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	version, err := SchemaVersion(conn)
+
+	if err != nil {
+		return err
+	}
+
+	if version > LatestVersion(migrations) {
+		return fmt.Errorf("%s is at schema version %d, this version of dfi supports up to %d",
+			path, version, LatestVersion(migrations))
+	}
+
+	return nil
+}